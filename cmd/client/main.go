@@ -2,54 +2,219 @@ package main
 
 import (
 	"context"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"runtime"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/meddion/pkg/core"
+	"github.com/meddion/pkg/crypto"
+	"github.com/meddion/pkg/kvstore"
+	"github.com/meddion/pkg/ledger"
 )
 
 const (
 	_dbFile                = "_test_db_file_"
-	_testAddr              = ""
 	_testPort              = "2022"
+	_controlPort           = "2023"
 	_isAliveInterval       = time.Minute * 2
 	_peerDiscoveryInterval = time.Minute * 5
+	_dialInterval          = time.Second * 10
+	_syncInterval          = time.Minute
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "generate" {
+		generate(os.Args[2:])
+		return
+	}
+
+	mine := flag.Bool("mine", false, "mine blocks on top of the main chain")
+	miningWorkers := flag.Int("mining-workers", runtime.NumCPU(), "number of goroutines searching for a nonce")
+	network := flag.String("network", core.DefaultChainParams.Network, "predefined network to join: devnet or regtest")
+	genesisFile := flag.String("genesis", "", "JSON file with the chain params and the genesis block, overrides -network")
+	app := flag.String("app", "", "application executing the blocks: kvstore, ledger, utxo or none")
+	coinbaseKey := flag.String("coinbase-key", "", "file with the key the mined blocks pay to, created if missing")
+	listen := flag.String("listen", ":"+_testPort, "host:port to listen for the peers on")
+	advertise := flag.String("advertise", "", "host:port the peers can dial this node at, defaults to -listen")
+	seedsFlag := flag.String("seeds", "", "comma-separated host:port of the nodes asked for the peer addresses on startup")
+	persistentFlag := flag.String("persistent-peers", "", "comma-separated host:port of the nodes to always stay connected to")
+	peersFile := flag.String("peers-config", "", "JSON file with the seeds and the persistent peers, merged with the flags")
+	maxInbound := flag.Int("max-inbound", core.DefaultConnLimits.MaxInbound, "max number of the peers dialing this node")
+	control := flag.String("control", "127.0.0.1:"+_controlPort, "loopback host:port for the operator RPC used by the generate command, empty disables it")
+	targetOutbound := flag.Int("target-outbound", core.DefaultConnLimits.TargetOutbound, "number of the peers this node keeps dialed, besides the persistent ones")
+	flag.Parse()
+
 	log := log.Default()
 
+	listenAddr, err := parseAddr(*listen)
+	if err != nil {
+		log.Fatalf("on parsing the listen address: %s", err)
+	}
+	advertiseAddr := listenAddr
+	if *advertise != "" {
+		if advertiseAddr, err = parseAddr(*advertise); err != nil {
+			log.Fatalf("on parsing the advertised address: %s", err)
+		}
+	}
+	if !advertiseAddr.IsRoutable() {
+		log.Printf("The node doesn't advertise a reachable address (%s), set -advertise to let the peers dial it", advertiseAddr)
+	}
+
+	var cfg peersConfig
+	if *peersFile != "" {
+		if cfg, err = loadPeersConfig(*peersFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	seeds, err := parseAddrs(append(cfg.Seeds, *seedsFlag)...)
+	if err != nil {
+		log.Fatalf("on parsing the seeds: %s", err)
+	}
+	persistentPeers, err := parseAddrs(append(cfg.PersistentPeers, *persistentFlag)...)
+	if err != nil {
+		log.Fatalf("on parsing the persistent peers: %s", err)
+	}
+
+	var params *core.ChainParams
+	if *genesisFile != "" {
+		params, err = core.LoadChainParams(*genesisFile)
+	} else {
+		params, err = core.NetworkParams(*network)
+	}
+	if err != nil {
+		log.Fatalf("on loading the chain params: %s", err)
+	}
+	log.Printf("Running on %s (chain ID %d)", params.Network, params.ChainID)
+
 	db, err := core.NewBlockRepo(_dbFile)
 	if err != nil {
 		log.Fatalf("on creating a block repo %s", err)
 	}
 
-	blkchain, err := core.NewBlockchain(db, log)
+	blkchain, err := core.NewBlockchain(db, params, log)
 	if err != nil {
 		log.Fatalf("on creating the Blockchain instance: %s", err)
 	}
 
-	peerPool := core.NewPeerPool(log, _peerDiscoveryInterval, _isAliveInterval)
-	rcv := core.NewReceiverRPC(blkchain, peerPool, log)
+	switch *app {
+	case "":
+	case "kvstore":
+		if err := blkchain.RegisterTxValidator(kvstore.PayloadType, kvstore.Validator()); err != nil {
+			log.Fatalf("on registering the kvstore validator: %s", err)
+		}
+		if err := blkchain.SetApplication(kvstore.New()); err != nil {
+			log.Fatalf("on starting the kvstore application: %s", err)
+		}
+	case "ledger":
+		l := ledger.New()
+		if err := blkchain.RegisterTxValidator(ledger.PayloadType, l.Validator()); err != nil {
+			log.Fatalf("on registering the ledger validator: %s", err)
+		}
+		if err := blkchain.SetApplication(l); err != nil {
+			log.Fatalf("on starting the ledger application: %s", err)
+		}
+	case "utxo":
+		utxos, err := core.NewUTXOSet(db, params)
+		if err != nil {
+			log.Fatalf("on creating the UTXO set: %s", err)
+		}
+		if err := blkchain.RegisterTxValidator(core.PayloadUTXO, utxos.Validator()); err != nil {
+			log.Fatalf("on registering the UTXO validator: %s", err)
+		}
+		if err := blkchain.SetApplication(utxos); err != nil {
+			log.Fatalf("on starting the UTXO application: %s", err)
+		}
+	default:
+		log.Fatalf("unknown application %q", *app)
+	}
+
+	peerPool := core.NewPeerPool(log, _isAliveInterval)
+
+	syncCtx, stopSync := context.WithCancel(context.Background())
+	defer stopSync()
+	go core.NewSyncer(blkchain, peerPool, log).Run(syncCtx, _syncInterval)
+
+	mempool := core.NewMempool(core.DefaultMempoolConfig, log)
+	mempool.Follow(blkchain)
+
+	rcv := core.NewReceiverRPC(blkchain, mempool, peerPool, advertiseAddr, log)
+	log.Printf("Node ID %s", rcv.LocalNode().ID)
+
+	book, err := core.NewAddrBook(db)
+	if err != nil {
+		log.Fatalf("on loading the address book: %s", err)
+	}
+	newAddrs, triedAddrs := book.Size()
+	log.Printf("Loaded %d new and %d tried peer addresses", newAddrs, triedAddrs)
+
+	limits := core.ConnLimits{MaxInbound: *maxInbound, TargetOutbound: *targetOutbound}
+	connMgr := core.NewConnManager(peerPool, rcv.LocalNode(), book, limits, log)
+	rcv.SetConnManager(connMgr)
+	for _, addr := range persistentPeers {
+		connMgr.AddPersistent(addr)
+	}
+	go func() {
+		if len(seeds) > 0 {
+			connMgr.Bootstrap(seeds)
+		} else if newAddrs+triedAddrs == 0 && len(persistentPeers) == 0 {
+			log.Print("No seeds, persistent peers or known addresses: the node waits for the peers to dial it")
+		}
+		connMgr.Run(syncCtx, _dialInterval, _peerDiscoveryInterval)
+	}()
+
+	miner := core.NewMiner(blkchain, mempool, peerPool, *miningWorkers, log)
+	if *coinbaseKey != "" {
+		key, err := loadOrCreateKey(*coinbaseKey)
+		if err != nil {
+			log.Fatalf("on loading the coinbase key: %s", err)
+		}
+		miner.SetCoinbaseKey(key)
+		log.Printf("Mined blocks pay to %s", key.Address())
+	}
+	if *mine {
+		go miner.Run(syncCtx)
+	}
 
 	serv, err := core.NewServer(rcv)
 	if err != nil {
 		log.Fatalf("on creating the Server: %s", err)
 	}
 
+	if *control != "" {
+		controlServ, err := startControlServer(*control, core.NewControlRPC(blkchain, miner))
+		if err != nil {
+			log.Fatalf("on starting the control Server: %s", err)
+		}
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+			defer cancel()
+
+			if err := controlServ.Close(ctx); err != nil {
+				log.Printf("on closing the control Server: %s", err)
+			}
+		}()
+	}
+
 	servDone := make(chan struct{}, 1)
 	go func() {
 		defer func() {
 			close(servDone)
 		}()
 
-		log.Printf("Starting listening for incoming connections on %s:%s", _testAddr, _testPort)
+		log.Printf("Starting listening for incoming connections on %s", listenAddr)
 
-		if err := serv.Start(_testAddr, _testPort); err != http.ErrServerClosed {
+		if err := serv.Start(listenAddr.IP, listenAddr.Port); err != http.ErrServerClosed {
 			log.Printf("on starting the Server: %s", err)
 		}
 		log.Print("The Server has been closed.")
@@ -59,6 +224,7 @@ func main() {
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 	<-sigs
 	log.Print("Got an OS signal. Preparing to close...")
+	stopSync()
 
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
 	defer cancel()
@@ -69,3 +235,96 @@ func main() {
 
 	<-servDone
 }
+
+// loadOrCreateKey reads a hex-encoded private key from the file.
+// A new key is generated and written to the file if it doesn't exist.
+func loadOrCreateKey(path string) (crypto.SignerECDSA, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		key, err := crypto.NewSignerECDSA()
+		if err != nil {
+			return crypto.SignerECDSA{}, err
+		}
+
+		return key, os.WriteFile(path, []byte(hex.EncodeToString(key.Bytes())), 0600)
+	}
+	if err != nil {
+		return crypto.SignerECDSA{}, err
+	}
+
+	b, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return crypto.SignerECDSA{}, err
+	}
+
+	return crypto.SignerECDSAFromBytes(b)
+}
+
+// startControlServer serves the operator RPC on a loopback address,
+// the peers must not be able to reach it.
+func startControlServer(hostPort string, ctl *core.ControlRPC) (*core.Server, error) {
+	addr, err := parseAddr(hostPort)
+	if err != nil {
+		return nil, err
+	}
+
+	if ip := net.ParseIP(addr.IP); addr.IP != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, fmt.Errorf("%s isn't a loopback address", addr.IP)
+	}
+
+	serv, err := core.NewControlServer(ctl)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		log.Printf("Starting listening for the operator requests on %s", addr)
+
+		if err := serv.Start(addr.IP, addr.Port); err != http.ErrServerClosed {
+			log.Printf("on starting the control Server: %s", err)
+		}
+	}()
+
+	return serv, nil
+}
+
+func parseAddr(hostPort string) (core.Addr, error) {
+	host, port, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return core.Addr{}, err
+	}
+
+	return core.Addr{IP: host, Port: port}, nil
+}
+
+// generate asks a running node to mine blocks: client generate [-addr host:port] N
+func generate(args []string) {
+	fs := flag.NewFlagSet("generate", flag.ExitOnError)
+	addr := fs.String("addr", "127.0.0.1:"+_controlPort, "control address of the node, see -control")
+	_ = fs.Parse(args)
+
+	count, err := strconv.Atoi(fs.Arg(0))
+	if err != nil || fs.NArg() != 1 {
+		log.Fatalf("usage: client generate [-addr host:port] N")
+	}
+
+	nodeAddr, err := parseAddr(*addr)
+	if err != nil {
+		log.Fatalf("on parsing the node address: %s", err)
+	}
+
+	client, err := core.NewControlClient(nodeAddr)
+	if err != nil {
+		log.Fatalf("on connecting to the node: %s", err)
+	}
+	defer client.Close()
+
+	hashes, err := client.Generate(count)
+	if err != nil {
+		log.Fatalf("on generating blocks: %s", err)
+	}
+
+	for _, hash := range hashes {
+		fmt.Printf("%x\n", hash)
+	}
+}
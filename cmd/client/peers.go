@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/meddion/pkg/core"
+)
+
+// peersConfig is the file with the peers the node starts with:
+//
+//	{
+//		"seeds": ["203.0.113.1:2022"],
+//		"persistent_peers": ["203.0.113.2:2022"]
+//	}
+//
+// The seeds are only asked for the addresses they know on startup,
+// the persistent peers are always kept connected.
+type peersConfig struct {
+	Seeds           []string `json:"seeds"`
+	PersistentPeers []string `json:"persistent_peers"`
+}
+
+func loadPeersConfig(path string) (peersConfig, error) {
+	var cfg peersConfig
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, fmt.Errorf("on reading the peers config: %w", err)
+	}
+
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("on decoding the peers config: %w", err)
+	}
+
+	return cfg, nil
+}
+
+// parseAddrs parses host:port addresses, the lists may be comma-separated.
+// The duplicates are skipped.
+func parseAddrs(lists ...string) ([]core.Addr, error) {
+	var (
+		addrs []core.Addr
+		added = make(map[core.Addr]struct{})
+	)
+	for _, list := range lists {
+		for _, hostPort := range strings.Split(list, ",") {
+			if hostPort = strings.TrimSpace(hostPort); hostPort == "" {
+				continue
+			}
+
+			addr, err := parseAddr(hostPort)
+			if err != nil {
+				return nil, fmt.Errorf("on parsing %q: %w", hostPort, err)
+			}
+
+			if _, exists := added[addr]; !exists {
+				added[addr] = struct{}{}
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+
+	return addrs, nil
+}
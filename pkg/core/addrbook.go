@@ -0,0 +1,437 @@
+package core
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	mrand "math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// The new addresses are spread over the buckets by the group of
+	// the node that told about them, so that a single source can only
+	// fill a few buckets
+	_newBucketCount           = 256
+	_newBucketsPerSourceGroup = 16
+	// The tried addresses of the same group can only fill a few buckets
+	_triedBucketCount     = 64
+	_triedBucketsPerGroup = 4
+	_bucketSize           = 32
+	// Addresses not seen for longer are neither dialed nor shared
+	_addrHorizon = time.Hour * 24 * 7
+)
+
+// addrEntry is what the AddrBook knows about an address. The times are
+// in Unix seconds.
+type addrEntry struct {
+	addr Addr
+	// The node the address was learned from
+	src Addr
+
+	lastSeen, lastAttempt, lastSuccess int64
+	// Failed dials since the last success
+	attempts  int
+	successes int
+
+	tried  bool
+	bucket int
+}
+
+// terrible reports whether the address isn't worth dialing or sharing.
+func (e *addrEntry) terrible(now int64) bool {
+	stale := int64(_addrHorizon / time.Second)
+
+	switch {
+	case now-e.lastSeen > stale && now-e.lastSuccess > stale:
+		return true
+	case e.attempts >= _maxDialAttempts && now-e.lastSuccess > stale:
+		return true
+	}
+
+	return false
+}
+
+// due reports whether the backoff after the failed dials has passed.
+func (e *addrEntry) due(now int64) bool {
+	return e.attempts == 0 || now >= e.lastAttempt+int64(dialBackoff(e.attempts)/time.Second)
+}
+
+// AddrBook keeps the addresses of the nodes in BoltDB. The addresses
+// start in the new buckets and move to the tried ones once connected
+// to. The bucket of an address depends on its network group, the group
+// of its source and a secret key, which makes it hard for an attacker to
+// fill the book with the nodes it controls.
+type AddrBook struct {
+	mtx   sync.Mutex
+	db    *BlockRepo
+	key   [32]byte
+	addrs map[Addr]*addrEntry
+
+	newBuckets   [_newBucketCount]map[Addr]*addrEntry
+	triedBuckets [_triedBucketCount]map[Addr]*addrEntry
+
+	rand *mrand.Rand
+	now  func() time.Time
+}
+
+// NewAddrBook loads the addresses saved in the repo.
+func NewAddrBook(db *BlockRepo) (*AddrBook, error) {
+	key, entries, err := db.addrBook()
+	if err != nil {
+		return nil, fmt.Errorf("on loading the address book: %w", err)
+	}
+
+	var seed [8]byte
+	if _, err := rand.Read(seed[:]); err != nil {
+		return nil, err
+	}
+
+	b := &AddrBook{
+		db:    db,
+		key:   key,
+		addrs: make(map[Addr]*addrEntry),
+		rand:  mrand.New(mrand.NewSource(int64(binary.BigEndian.Uint64(seed[:])))),
+		now:   time.Now,
+	}
+	for i := range b.newBuckets {
+		b.newBuckets[i] = make(map[Addr]*addrEntry)
+	}
+	for i := range b.triedBuckets {
+		b.triedBuckets[i] = make(map[Addr]*addrEntry)
+	}
+
+	var dropped []Addr
+	for _, e := range entries {
+		if e.tried {
+			e.bucket = b.triedBucket(e.addr)
+		} else {
+			e.bucket = b.newBucket(e.addr, e.src)
+		}
+
+		if bucket := b.bucketOf(e); len(bucket) < _bucketSize {
+			bucket[e.addr] = e
+			b.addrs[e.addr] = e
+		} else {
+			dropped = append(dropped, e.addr)
+		}
+	}
+
+	if err := b.save(nil, dropped); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// save writes the changed entries to the repo. An entry may have been
+// both changed and dropped, only its final state is saved.
+// Must be called with b.mtx held.
+func (b *AddrBook) save(changed []*addrEntry, dropped []Addr) error {
+	var put []*addrEntry
+	for _, e := range changed {
+		if b.addrs[e.addr] == e {
+			put = append(put, e)
+		}
+	}
+
+	var del []Addr
+	for _, addr := range dropped {
+		if _, exists := b.addrs[addr]; !exists {
+			del = append(del, addr)
+		}
+	}
+
+	return b.db.updateAddrBook(put, del)
+}
+
+// addrGroup returns the network group of the address: /16 for IPv4 and
+// /32 for IPv6. The nodes of a group are likely run by the same operator.
+func addrGroup(a Addr) string {
+	ip := net.ParseIP(a.IP)
+	switch {
+	case ip == nil:
+		return "host:" + a.IP
+	case ip.To4() != nil:
+		return ip.To4().Mask(net.CIDRMask(16, 32)).String()
+	}
+
+	return ip.Mask(net.CIDRMask(32, 128)).String()
+}
+
+func (b *AddrBook) keyedHash(parts ...string) uint64 {
+	h := sha256.New()
+	h.Write(b.key[:])
+	for _, p := range parts {
+		h.Write([]byte(p))
+		h.Write([]byte{0})
+	}
+
+	return binary.BigEndian.Uint64(h.Sum(nil))
+}
+
+func (b *AddrBook) newBucket(addr, src Addr) int {
+	i := b.keyedHash(addrGroup(addr), addrGroup(src)) % _newBucketsPerSourceGroup
+	return int(b.keyedHash(addrGroup(src), fmt.Sprint(i)) % _newBucketCount)
+}
+
+func (b *AddrBook) triedBucket(addr Addr) int {
+	i := b.keyedHash(addr.String()) % _triedBucketsPerGroup
+	return int(b.keyedHash(addrGroup(addr), fmt.Sprint(i)) % _triedBucketCount)
+}
+
+func (b *AddrBook) bucketOf(e *addrEntry) map[Addr]*addrEntry {
+	if e.tried {
+		return b.triedBuckets[e.bucket]
+	}
+
+	return b.newBuckets[e.bucket]
+}
+
+// Size returns the number of the new and the tried addresses.
+func (b *AddrBook) Size() (newAddrs, triedAddrs int) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	for _, e := range b.addrs {
+		if e.tried {
+			triedAddrs++
+		} else {
+			newAddrs++
+		}
+	}
+
+	return newAddrs, triedAddrs
+}
+
+// Add puts the addresses learned from src into the new buckets. The last
+// seen times of the known addresses are updated. A full bucket makes room
+// by dropping a terrible or the least recently seen address.
+func (b *AddrBook) Add(addrs []KnownAddr, src Addr) error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	now := b.now().Unix()
+	stale := int64(_addrHorizon / time.Second)
+
+	var (
+		put     []*addrEntry
+		dropped []Addr
+	)
+	for _, a := range addrs {
+		lastSeen := a.LastSeen
+		if lastSeen > now {
+			lastSeen = now
+		}
+		if !a.Addr.IsRoutable() || now-lastSeen > stale {
+			continue
+		}
+
+		if e, exists := b.addrs[a.Addr]; exists {
+			if lastSeen > e.lastSeen {
+				e.lastSeen = lastSeen
+				put = append(put, e)
+			}
+			continue
+		}
+
+		e := &addrEntry{addr: a.Addr, src: src, lastSeen: lastSeen, bucket: b.newBucket(a.Addr, src)}
+		if evicted := b.makeRoom(e, now); evicted != nil {
+			dropped = append(dropped, evicted.addr)
+		}
+		b.newBuckets[e.bucket][e.addr] = e
+		b.addrs[e.addr] = e
+		put = append(put, e)
+	}
+
+	return b.save(put, dropped)
+}
+
+// makeRoom drops the worst address from the new bucket of e if it's full.
+func (b *AddrBook) makeRoom(e *addrEntry, now int64) *addrEntry {
+	bucket := b.newBuckets[e.bucket]
+	if len(bucket) < _bucketSize {
+		return nil
+	}
+
+	var worst *addrEntry
+	for _, other := range bucket {
+		if other.terrible(now) {
+			worst = other
+			break
+		}
+		if worst == nil || other.lastSeen < worst.lastSeen {
+			worst = other
+		}
+	}
+
+	delete(bucket, worst.addr)
+	delete(b.addrs, worst.addr)
+
+	return worst
+}
+
+// Good records a successful connection and moves the address to the tried
+// buckets. A full tried bucket sends its least recently connected address
+// back to the new buckets.
+func (b *AddrBook) Good(addr Addr) error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	now := b.now().Unix()
+	e, exists := b.addrs[addr]
+	if !exists {
+		e = &addrEntry{addr: addr, src: addr}
+		b.addrs[addr] = e
+	} else {
+		delete(b.bucketOf(e), addr)
+	}
+
+	e.attempts, e.successes = 0, e.successes+1
+	e.lastSeen, e.lastAttempt, e.lastSuccess = now, now, now
+	e.tried, e.bucket = true, b.triedBucket(addr)
+
+	var (
+		put     = []*addrEntry{e}
+		dropped []Addr
+	)
+
+	bucket := b.triedBuckets[e.bucket]
+	if len(bucket) >= _bucketSize {
+		var oldest *addrEntry
+		for _, other := range bucket {
+			if oldest == nil || other.lastSuccess < oldest.lastSuccess {
+				oldest = other
+			}
+		}
+		delete(bucket, oldest.addr)
+
+		oldest.tried, oldest.bucket = false, b.newBucket(oldest.addr, oldest.src)
+		if evicted := b.makeRoom(oldest, now); evicted != nil {
+			dropped = append(dropped, evicted.addr)
+		}
+		b.newBuckets[oldest.bucket][oldest.addr] = oldest
+		put = append(put, oldest)
+	}
+	bucket[addr] = e
+
+	return b.save(put, dropped)
+}
+
+// Failed records a failed dial. The new addresses are dropped after
+// _maxDialAttempts failures in a row.
+func (b *AddrBook) Failed(addr Addr) error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	e, exists := b.addrs[addr]
+	if !exists {
+		return nil
+	}
+
+	e.attempts++
+	e.lastAttempt = b.now().Unix()
+
+	if !e.tried && e.attempts >= _maxDialAttempts {
+		b.remove(e)
+		return b.save(nil, []Addr{addr})
+	}
+
+	return b.save([]*addrEntry{e}, nil)
+}
+
+// Remove drops the address, e.g. of an incompatible node.
+func (b *AddrBook) Remove(addr Addr) error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	e, exists := b.addrs[addr]
+	if !exists {
+		return nil
+	}
+	b.remove(e)
+
+	return b.save(nil, []Addr{addr})
+}
+
+func (b *AddrBook) remove(e *addrEntry) {
+	delete(b.bucketOf(e), e.addr)
+	delete(b.addrs, e.addr)
+}
+
+// Select picks an address to dial. The tried and the new addresses are
+// equally likely to be picked, the ones failing to dial are less likely.
+// The addresses skip returns true for and the ones backing off aren't
+// picked.
+func (b *AddrBook) Select(skip func(Addr) bool) (Addr, bool) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	now := b.now().Unix()
+
+	var newAddrs, triedAddrs []*addrEntry
+	for _, e := range b.addrs {
+		if skip(e.addr) || !e.due(now) || e.terrible(now) {
+			continue
+		}
+
+		if e.tried {
+			triedAddrs = append(triedAddrs, e)
+		} else {
+			newAddrs = append(newAddrs, e)
+		}
+	}
+
+	candidates := newAddrs
+	if len(triedAddrs) > 0 && (len(newAddrs) == 0 || b.rand.Intn(2) == 0) {
+		candidates = triedAddrs
+	}
+	if len(candidates) == 0 {
+		return Addr{}, false
+	}
+
+	var total float64
+	for _, e := range candidates {
+		total += e.chance()
+	}
+
+	r := b.rand.Float64() * total
+	for _, e := range candidates {
+		if r -= e.chance(); r < 0 {
+			return e.addr, true
+		}
+	}
+
+	return candidates[len(candidates)-1].addr, true
+}
+
+// chance weighs the address for Select.
+func (e *addrEntry) chance() float64 {
+	return 1 / float64(1+e.attempts)
+}
+
+// Sample returns up to max random addresses to share with the peers.
+// The addresses failing to dial aren't shared.
+func (b *AddrBook) Sample(max int) []KnownAddr {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	now := b.now().Unix()
+
+	addrs := make([]KnownAddr, 0, len(b.addrs))
+	for _, e := range b.addrs {
+		if e.attempts == 0 && !e.terrible(now) {
+			addrs = append(addrs, KnownAddr{Addr: e.addr, LastSeen: e.lastSeen})
+		}
+	}
+
+	b.rand.Shuffle(len(addrs), func(i, j int) { addrs[i], addrs[j] = addrs[j], addrs[i] })
+	if len(addrs) > max {
+		addrs = addrs[:max]
+	}
+
+	return addrs
+}
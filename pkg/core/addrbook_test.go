@@ -0,0 +1,118 @@
+package core
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestAddrBook(t *testing.T) *AddrBook {
+	db, err := NewBlockRepo(filepath.Join(t.TempDir(), "blocks.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	book, err := NewAddrBook(db)
+	require.NoError(t, err)
+
+	return book
+}
+
+func TestAddrGroup(t *testing.T) {
+	assert.Equal(t, addrGroup(Addr{IP: "10.1.2.3"}), addrGroup(Addr{IP: "10.1.200.1"}))
+	assert.NotEqual(t, addrGroup(Addr{IP: "10.1.2.3"}), addrGroup(Addr{IP: "10.2.2.3"}))
+	assert.Equal(t, addrGroup(Addr{IP: "2001:db8::1"}), addrGroup(Addr{IP: "2001:db8:ffff::1"}))
+	assert.Equal(t, "host:example.com", addrGroup(Addr{IP: "example.com"}))
+}
+
+func TestIsRoutable(t *testing.T) {
+	for _, ip := range []string{"203.0.113.1", "2001:db8::1"} {
+		assert.True(t, Addr{IP: ip, Port: "2022"}.IsRoutable(), ip)
+	}
+	for _, ip := range []string{"", "0.0.0.0", "127.0.0.1", "10.0.0.1", "192.168.1.1", "169.254.0.1", "::1", "fe80::1", "fd00::1", "example.com"} {
+		assert.False(t, Addr{IP: ip, Port: "2022"}.IsRoutable(), ip)
+	}
+	assert.False(t, Addr{IP: "203.0.113.1"}.IsRoutable())
+}
+
+func TestAddrBook(t *testing.T) {
+	book := newTestAddrBook(t)
+	now := time.Unix(1_000_000, 0)
+	book.now = func() time.Time { return now }
+
+	addr := func(a, b, c int) Addr {
+		return Addr{IP: fmt.Sprintf("%d.%d.%d.1", a, b, c), Port: "2022"}
+	}
+	seen := func(addrs ...Addr) []KnownAddr {
+		known := make([]KnownAddr, len(addrs))
+		for i, a := range addrs {
+			known[i] = KnownAddr{Addr: a, LastSeen: now.Unix()}
+		}
+		return known
+	}
+
+	var flood []Addr
+	for i := 0; i < 5000; i++ {
+		flood = append(flood, addr(20+i/256, i%256, 0))
+	}
+	require.NoError(t, book.Add(seen(flood...), Addr{IP: "66.6.6.6", Port: "2022"}))
+
+	newAddrs, triedAddrs := book.Size()
+	assert.LessOrEqual(t, newAddrs, _newBucketsPerSourceGroup*_bucketSize, "a single source should only fill a few buckets")
+	assert.Zero(t, triedAddrs)
+
+	honest := []Addr{addr(1, 1, 1), addr(2, 2, 2), addr(3, 3, 3)}
+	for _, a := range honest {
+		require.NoError(t, book.Add(seen(a), a))
+	}
+	require.NoError(t, book.Good(honest[0]))
+	require.NoError(t, book.Failed(honest[1]))
+
+	_, triedAddrs = book.Size()
+	assert.Equal(t, 1, triedAddrs)
+
+	only := func(a Addr) func(Addr) bool {
+		return func(other Addr) bool { return other != a }
+	}
+	picked, ok := book.Select(only(honest[0]))
+	assert.True(t, ok)
+	assert.Equal(t, honest[0], picked)
+
+	_, ok = book.Select(only(honest[1]))
+	assert.False(t, ok, "the failed address should back off")
+	now = now.Add(dialBackoff(1))
+	_, ok = book.Select(only(honest[1]))
+	assert.True(t, ok)
+
+	assert.Len(t, book.Sample(10), 10)
+	for _, a := range book.Sample(MaxAddrsPerReply * 4) {
+		assert.NotEqual(t, honest[1], a.Addr, "the failed address shouldn't be shared")
+	}
+
+	t.Run("tried buckets", func(t *testing.T) {
+		for i := 0; i < 300; i++ {
+			a := addr(5, 5, i%256)
+			a.Port = fmt.Sprint(3000 + i)
+			require.NoError(t, book.Good(a))
+		}
+
+		_, triedAddrs := book.Size()
+		assert.LessOrEqual(t, triedAddrs, 1+_triedBucketsPerGroup*_bucketSize, "a single group should only fill a few buckets")
+		assert.Contains(t, book.addrs, honest[0], "the evicted tried addresses should go back to the new buckets")
+	})
+
+	t.Run("persistence", func(t *testing.T) {
+		reloaded, err := NewAddrBook(book.db)
+		require.NoError(t, err)
+		assert.Equal(t, book.key, reloaded.key)
+		assert.Equal(t, book.addrs, reloaded.addrs)
+
+		require.NoError(t, book.Remove(honest[2]))
+		reloaded, err = NewAddrBook(book.db)
+		require.NoError(t, err)
+		assert.NotContains(t, reloaded.addrs, honest[2])
+	})
+}
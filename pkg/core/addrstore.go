@@ -0,0 +1,131 @@
+package core
+
+import (
+	"crypto/rand"
+	"fmt"
+
+	"github.com/boltdb/bolt"
+)
+
+const _dbAddrBookBucket = "addrbook"
+
+// Keys the AddrBook buckets, see AddrBook.newBucket
+var _addrBookKey = []byte("addrbookkey")
+
+// addrBook returns the key and the saved entries of the AddrBook.
+// The key is generated on the first call.
+func (b *BlockRepo) addrBook() ([32]byte, []*addrEntry, error) {
+	var (
+		key     [32]byte
+		entries []*addrEntry
+	)
+
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		addrs, state := tx.Bucket([]byte(_dbAddrBookBucket)), tx.Bucket([]byte(_dbChainStateBucket))
+		if addrs == nil || state == nil {
+			return ErrBucketNotFound
+		}
+
+		if stored := state.Get(_addrBookKey); len(stored) == len(key) {
+			copy(key[:], stored)
+		} else {
+			if _, err := rand.Read(key[:]); err != nil {
+				return err
+			}
+			if err := state.Put(_addrBookKey, key[:]); err != nil {
+				return err
+			}
+		}
+
+		return addrs.ForEach(func(k, v []byte) error {
+			d := decoder{buf: v}
+			e := d.addrEntry()
+			if err := d.finish(); err != nil {
+				return fmt.Errorf("on decoding the entry of %s: %w", k, err)
+			}
+
+			entries = append(entries, e)
+			return nil
+		})
+	})
+
+	return key, entries, err
+}
+
+// updateAddrBook saves the entries and deletes the addresses at once.
+func (b *BlockRepo) updateAddrBook(put []*addrEntry, del []Addr) error {
+	if len(put) == 0 && len(del) == 0 {
+		return nil
+	}
+
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(_dbAddrBookBucket))
+		if bucket == nil {
+			return ErrBucketNotFound
+		}
+
+		for _, addr := range del {
+			if err := bucket.Delete(addrKey(addr)); err != nil {
+				return err
+			}
+		}
+
+		for _, e := range put {
+			var enc encoder
+			enc.addrEntry(e)
+			if err := bucket.Put(addrKey(e.addr), enc.buf); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func addrKey(a Addr) []byte {
+	var e encoder
+	e.addr(a)
+
+	return e.buf
+}
+
+func (e *encoder) addr(a Addr) {
+	e.bytes([]byte(a.IP))
+	e.bytes([]byte(a.Port))
+}
+
+func (d *decoder) addr() Addr {
+	return Addr{IP: string(d.bytes()), Port: string(d.bytes())}
+}
+
+// The entries are encoded as
+//
+//	addrEntry = Addr | Src Addr | LastSeen i64 | LastAttempt i64 | LastSuccess i64 |
+//	            Attempts u32 | Successes u32 | Tried u8
+func (e *encoder) addrEntry(entry *addrEntry) {
+	e.addr(entry.addr)
+	e.addr(entry.src)
+	e.int64(entry.lastSeen)
+	e.int64(entry.lastAttempt)
+	e.int64(entry.lastSuccess)
+	e.uint32(uint32(entry.attempts))
+	e.uint32(uint32(entry.successes))
+	if entry.tried {
+		e.uint8(1)
+	} else {
+		e.uint8(0)
+	}
+}
+
+func (d *decoder) addrEntry() *addrEntry {
+	return &addrEntry{
+		addr:        d.addr(),
+		src:         d.addr(),
+		lastSeen:    d.int64(),
+		lastAttempt: d.int64(),
+		lastSuccess: d.int64(),
+		attempts:    int(d.uint32()),
+		successes:   int(d.uint32()),
+		tried:       d.uint8() == 1,
+	}
+}
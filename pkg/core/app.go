@@ -0,0 +1,154 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/meddion/pkg/crypto"
+)
+
+var ErrAppStateMismatch = errors.New("application state doesn't match the main chain")
+
+// TxCodeOK is the TxResult code of a successfully executed transaction
+const TxCodeOK uint32 = 0
+
+// Application is a deterministic state machine driven by the main chain.
+// For every connected block the Blockchain calls BeginBlock, DeliverTx for
+// each transaction in order, EndBlock and Commit. Disconnected blocks are
+// reverted with Rollback, the most recent one first.
+//
+// An error from BeginBlock, EndBlock or Commit rejects the block: it is
+// marked invalid and its descendants are refused. The calls are made with
+// the chain locked, one at a time.
+type Application interface {
+	// Info describes the last committed block
+	Info() AppInfo
+	// BeginBlock starts the execution of a block. The changes of a block
+	// that was started but never committed must be dropped.
+	BeginBlock(BlockInfo) error
+	// DeliverTx executes a transaction. A failed transaction stays in the block
+	// but must not change the state.
+	DeliverTx(Transaction) TxResult
+	EndBlock(BlockInfo) error
+	// Commit persists the changes of the block and returns the hash of the new state
+	Commit() (crypto.HashValue, error)
+	// Rollback reverts the last committed block, which is described by BlockInfo
+	Rollback(BlockInfo) error
+}
+
+// AppInfo describes the state of an Application
+type AppInfo struct {
+	// -1 if no block was committed
+	LastHeight    int
+	LastBlockHash crypto.HashValue
+	AppHash       crypto.HashValue
+}
+
+// BlockInfo describes the block being executed
+type BlockInfo struct {
+	Hash   crypto.HashValue
+	Height int
+	Header Header
+}
+
+// TxResult is the outcome of a transaction execution
+type TxResult struct {
+	Code uint32
+	Log  string
+}
+
+func (r TxResult) IsOK() bool {
+	return r.Code == TxCodeOK
+}
+
+// SetApplication attaches the application to the chain and replays the main
+// chain blocks the application hasn't committed yet. The blocks it has
+// committed outside the main chain are rolled back first. From then on the
+// application follows the main chain, reorganizations included.
+func (b *Blockchain) SetApplication(app Application) error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	rolledBack, err := b.rewindApp(app)
+	if err != nil {
+		return err
+	}
+	if rolledBack > 0 {
+		b.logger.Printf("Application rolled back %d blocks outside the main chain", rolledBack)
+	}
+
+	info := app.Info()
+	for height := info.LastHeight + 1; height <= b.lastNode.Height; height++ {
+		node := b.lastNode.Ancestor(height)
+		block, err := b.db.Get(node.Hash)
+		if err != nil {
+			return err
+		}
+
+		if _, err := executeBlock(app, node, block); err != nil {
+			return fmt.Errorf("on replaying block %x: %w", node.Hash, err)
+		}
+	}
+
+	b.app = app
+	b.logger.Printf("Application replayed %d blocks", b.lastNode.Height-info.LastHeight)
+
+	return nil
+}
+
+// rewindApp rolls back the blocks the application has committed outside
+// the main chain. They are left if the node stops between executing a block
+// and storing the new tip, or during a reorganization. Returns the number
+// of the blocks rolled back.
+// Must be called with b.mtx held.
+func (b *Blockchain) rewindApp(app Application) (int, error) {
+	rolledBack := 0
+	for info := app.Info(); info.LastHeight >= 0; info = app.Info() {
+		node := b.index.GetNode(info.LastBlockHash)
+		if node == nil || node.Height != info.LastHeight {
+			return rolledBack, fmt.Errorf("%w: unknown block %x at height %d",
+				ErrAppStateMismatch, info.LastBlockHash, info.LastHeight)
+		}
+
+		if b.isInMainChain(node) {
+			break
+		}
+
+		block, err := b.db.Get(node.Hash)
+		if err != nil {
+			return rolledBack, err
+		}
+
+		if err := app.Rollback(BlockInfo{Hash: node.Hash, Height: node.Height, Header: block.Header}); err != nil {
+			return rolledBack, fmt.Errorf("on rolling back block %x: %w", node.Hash, err)
+		}
+		rolledBack++
+	}
+
+	return rolledBack, nil
+}
+
+// executeBlock runs the block through the application and returns the new app hash.
+func executeBlock(app Application, node *blockNode, block Block) (crypto.HashValue, error) {
+	info := BlockInfo{Hash: node.Hash, Height: node.Height, Header: block.Header}
+
+	if err := app.BeginBlock(info); err != nil {
+		return crypto.HashValue{}, fmt.Errorf("on beginning a block: %w", err)
+	}
+
+	for _, tx := range block.Body {
+		// Failed transactions are recorded by the application itself
+		app.DeliverTx(tx)
+	}
+
+	if err := app.EndBlock(info); err != nil {
+		return crypto.HashValue{}, fmt.Errorf("on ending a block: %w", err)
+	}
+
+	hash, err := app.Commit()
+	if err != nil {
+		return crypto.HashValue{}, fmt.Errorf("on committing a block: %w", err)
+	}
+
+	return hash, nil
+}
@@ -0,0 +1,154 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/meddion/pkg/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingApp keeps the hashes of the committed blocks and logs the calls
+type recordingApp struct {
+	calls     []string
+	committed []crypto.HashValue
+	pending   crypto.HashValue
+	failOn    crypto.HashValue
+}
+
+func (a *recordingApp) Info() AppInfo {
+	info := AppInfo{LastHeight: len(a.committed) - 1}
+	if info.LastHeight >= 0 {
+		info.LastBlockHash = a.committed[info.LastHeight]
+		info.AppHash = crypto.HashValue{byte(len(a.committed))}
+	}
+
+	return info
+}
+
+func (a *recordingApp) BeginBlock(info BlockInfo) error {
+	if info.Hash == a.failOn {
+		return errors.New("application failure")
+	}
+
+	a.pending = info.Hash
+	a.calls = append(a.calls, fmt.Sprintf("begin %d", info.Height))
+
+	return nil
+}
+
+func (a *recordingApp) DeliverTx(Transaction) TxResult {
+	a.calls = append(a.calls, "deliver")
+	return TxResult{}
+}
+
+func (a *recordingApp) EndBlock(info BlockInfo) error {
+	a.calls = append(a.calls, fmt.Sprintf("end %d", info.Height))
+	return nil
+}
+
+func (a *recordingApp) Commit() (crypto.HashValue, error) {
+	a.committed = append(a.committed, a.pending)
+	a.calls = append(a.calls, "commit")
+
+	return crypto.HashValue{byte(len(a.committed))}, nil
+}
+
+func (a *recordingApp) Rollback(info BlockInfo) error {
+	last := len(a.committed) - 1
+	if a.committed[last] != info.Hash {
+		return fmt.Errorf("block %x isn't the last committed one", info.Hash)
+	}
+
+	a.committed = a.committed[:last]
+	a.calls = append(a.calls, fmt.Sprintf("rollback %d", info.Height))
+
+	return nil
+}
+
+func TestApplication(t *testing.T) {
+	blkchain := newTestBlockchain(t)
+
+	var appHashes []crypto.HashValue
+	blkchain.Subscribe(func(n Notification) {
+		if n.Type == NTBlockConnected {
+			appHashes = append(appHashes, n.AppHash)
+		}
+	})
+
+	genesisHash, genesis := getGenesisPair()
+	a1 := mineTestBlock(t, genesis, 1)
+	a2 := mineTestBlock(t, a1, 1)
+	b2 := mineTestBlock(t, a1, 2)
+	b3 := mineTestBlock(t, b2, 1)
+
+	txs, err := genRandTransactions(2)
+	require.NoError(t, err)
+	a2.Body = txs
+	a2.MerkleRoot, err = merkleRoot(a2.Version, a2.Body)
+	require.NoError(t, err)
+	a2.Nonce, err = a2.Header.GenNonce()
+	require.NoError(t, err)
+
+	require.NoError(t, blkchain.ProcessBlock(a1))
+
+	app := &recordingApp{}
+	require.NoError(t, blkchain.SetApplication(app), "on replaying the chain")
+	assert.Equal(t, []string{"begin 0", "end 0", "commit", "begin 1", "end 1", "commit"}, app.calls)
+	assert.Equal(t, []crypto.HashValue{genesisHash, blockHash(t, a1)}, app.committed)
+
+	app.calls, appHashes = nil, nil
+	require.NoError(t, blkchain.ProcessBlock(a2))
+	require.NoError(t, blkchain.ProcessBlock(b2))
+	assert.Equal(t, []string{"begin 2", "deliver", "deliver", "end 2", "commit"}, app.calls, "side chains aren't executed")
+	assert.Equal(t, []crypto.HashValue{{3}}, appHashes)
+
+	app.calls = nil
+	require.NoError(t, blkchain.ProcessBlock(b3))
+	assert.Equal(t, []string{"rollback 2", "begin 2", "end 2", "commit", "begin 3", "end 3", "commit"}, app.calls)
+	assert.Equal(t, []crypto.HashValue{genesisHash, blockHash(t, a1), blockHash(t, b2), blockHash(t, b3)}, app.committed)
+
+	a3 := mineTestBlock(t, a2, 1)
+	t.Run("failed reorganization", func(t *testing.T) {
+		a4 := mineTestBlock(t, a3, 1)
+		app.failOn = blockHash(t, a3)
+
+		require.NoError(t, blkchain.ProcessBlock(a3))
+		assert.Error(t, blkchain.ProcessBlock(a4))
+
+		tip, height := blkchain.BestBlock()
+		assert.Equal(t, blockHash(t, b3), tip, "the main chain should be restored")
+		assert.Equal(t, 3, height)
+		assert.Equal(t, []crypto.HashValue{genesisHash, blockHash(t, a1), blockHash(t, b2), blockHash(t, b3)}, app.committed)
+
+		app.calls = nil
+		assert.ErrorIs(t, blkchain.ProcessBlock(mineTestBlock(t, a4, 1)), ErrInvalidAncestor,
+			"the descendants of the invalid block should be invalid")
+		assert.Empty(t, app.calls, "the invalid branch shouldn't be reorganized to again")
+
+		restarted, err := NewBlockchain(blkchain.db, blkchain.params, blkchain.logger)
+		require.NoError(t, err)
+		assert.ErrorIs(t, restarted.ProcessBlock(mineTestBlock(t, a4, 2)), ErrInvalidAncestor,
+			"the invalid blocks should be remembered")
+	})
+
+	t.Run("interrupted reorganization", func(t *testing.T) {
+		// The node stopped after the app had committed the blocks of a side chain
+		stale := &recordingApp{committed: []crypto.HashValue{genesisHash, blockHash(t, a1), blockHash(t, a2), blockHash(t, a3)}}
+		require.NoError(t, blkchain.SetApplication(stale))
+		assert.Equal(t, []string{"rollback 3", "rollback 2", "begin 2", "end 2", "commit", "begin 3", "end 3", "commit"}, stale.calls)
+		assert.Equal(t, []crypto.HashValue{genesisHash, blockHash(t, a1), blockHash(t, b2), blockHash(t, b3)}, stale.committed)
+	})
+
+	t.Run("mismatch", func(t *testing.T) {
+		other := newTestBlockchain(t)
+		assert.ErrorIs(t, other.SetApplication(app), ErrAppStateMismatch)
+
+		require.NoError(t, other.ProcessBlock(a1))
+		require.NoError(t, other.ProcessBlock(a2))
+		require.NoError(t, other.ProcessBlock(mineTestBlock(t, a2, 5)))
+		assert.ErrorIs(t, other.SetApplication(app), ErrAppStateMismatch, "the app follows another branch")
+	})
+}
@@ -4,34 +4,74 @@ import (
 	"errors"
 	"fmt"
 	"log"
-	"math/rand"
 	"sync"
 	"time"
 
 	"github.com/meddion/pkg/crypto"
 )
 
+var (
+	ErrDuplicateBlock  = errors.New("dublicate block")
+	ErrOrphanBlock     = errors.New("orphan block")
+	ErrNotChainTip     = errors.New("block doesn't match the chain tip")
+	ErrNoForkPoint     = errors.New("chains have no common ancestor")
+	ErrGenesisMismatch = errors.New("stored chain doesn't match the genesis block")
+	ErrTxNotInBlock    = errors.New("transaction is not in the block")
+	ErrInvalidAncestor = errors.New("block descends from an invalid block")
+)
+
 type Blockchain struct {
-	db     *BlockRepo
-	logger *log.Logger
+	db          *BlockRepo
+	params      *ChainParams
+	genesisHash crypto.HashValue
+	timeSource  *MedianTimeSource
+	logger      *log.Logger
 
-	index blockIndex
+	index      blockIndex
+	orphans    *orphanPool
+	validators *txValidators
 
+	// Follows the main chain, guarded by mtx. Nil if not set.
+	app Application
+
+	// mtx guards lastNode and serializes changes to the main chain
 	mtx      sync.RWMutex
 	lastNode *blockNode
+
+	subsMtx     sync.RWMutex
+	subscribers []func(Notification)
+
+	// The notifications are queued with mtx held, in order of the chain
+	// changes, and delivered by one goroutine at a time holding notifyMtx
+	queueMtx  sync.Mutex
+	queue     []Notification
+	notifyMtx sync.Mutex
 }
 
-func NewBlockchain(db *BlockRepo, logger *log.Logger) (*Blockchain, error) {
+func NewBlockchain(db *BlockRepo, params *ChainParams, logger *log.Logger) (*Blockchain, error) {
+	if err := params.Validate(); err != nil {
+		return nil, err
+	}
+
 	b := &Blockchain{
-		db:     db,
-		logger: logger,
-		index:  newBlockIndex(),
+		db:         db,
+		params:     params,
+		timeSource: NewMedianTimeSource(),
+		logger:     logger,
+		index:      newBlockIndex(),
+		orphans:    newOrphanPool(_maxOrphanBlocks, _orphanTTL),
+		validators: newTxValidators(),
 	}
 
-	go b.startSyncing()
+	genesisHash, err := params.GenesisHash()
+	if err != nil {
+		return nil, fmt.Errorf("on hashing the genesis block: %w", err)
+	}
+
+	b.genesisHash = genesisHash
 
-	if err := b.setGenesisBlock(getGenesisPair()); err != nil {
-		return nil, fmt.Errorf("on setting a genesis block: %w", err)
+	if err := b.loadChain(genesisHash, params.Genesis); err != nil {
+		return nil, fmt.Errorf("on loading the chain: %w", err)
 	}
 
 	return b, nil
@@ -49,74 +89,614 @@ func (b *Blockchain) setGenesisBlock(hash crypto.HashValue, block Block) error {
 		return err
 	}
 
-	b.setLastBlock(node)
-	if err := b.db.Store(_lastCommitedBlockNodeKey, node); err != nil {
+	if err := b.db.StoreGenesis(hash); err != nil {
 		return err
 	}
 
-	return nil
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	return b.setLastBlock(node)
+}
+
+// loadChain rebuilds the block index from the stored blocks and restores
+// the main chain tip. An empty store is initialized with the genesis block.
+func (b *Blockchain) loadChain(genesisHash crypto.HashValue, genesis Block) error {
+	storedGenesis, err := b.db.Genesis()
+	if err != nil && !errors.Is(err, ErrMissingChainState) {
+		return err
+	}
+	if err == nil && storedGenesis != genesisHash {
+		return fmt.Errorf("%w: stored %x, configured %x", ErrGenesisMismatch, storedGenesis, genesisHash)
+	}
+
+	headers := make(map[crypto.HashValue]Header)
+	children := make(map[crypto.HashValue][]crypto.HashValue)
+	if err := b.db.ForEach(func(hash crypto.HashValue, block Block) error {
+		headers[hash] = block.Header
+		children[block.PrevBlockHash] = append(children[block.PrevBlockHash], hash)
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	if len(headers) == 0 {
+		return b.setGenesisBlock(genesisHash, genesis)
+	}
+
+	genesisHeader, exists := headers[genesisHash]
+	if !exists {
+		return fmt.Errorf("%w: genesis block %x isn't stored", ErrGenesisMismatch, genesisHash)
+	}
+
+	root, err := newBlockNode(nil, genesisHeader)
+	if err != nil {
+		return err
+	}
+	b.index.AddNode(root)
+
+	// Parents are always linked before their children
+	for queue := []*blockNode{root}; len(queue) > 0; queue = queue[1:] {
+		parent := queue[0]
+		for _, hash := range children[parent.Hash] {
+			node, err := newBlockNode(parent, headers[hash])
+			if err != nil {
+				return err
+			}
+			if node.Hash != hash {
+				return fmt.Errorf("block %x is stored under a wrong key %x", node.Hash, hash)
+			}
+
+			b.index.AddNode(node)
+			queue = append(queue, node)
+		}
+	}
+
+	if unlinked := len(headers) - b.index.Len(); unlinked > 0 {
+		b.logger.Printf("%d stored blocks aren't linked to the genesis block", unlinked)
+	}
+
+	invalid, err := b.db.InvalidBlocks()
+	if err != nil {
+		return err
+	}
+	for _, hash := range invalid {
+		if node := b.index.GetNode(hash); node != nil {
+			b.markInvalid(node)
+		}
+	}
+
+	tip := b.index.BestNode()
+	if tipHash, err := b.db.Tip(); err == nil {
+		if n := b.index.GetNode(tipHash); n != nil {
+			tip = n
+		}
+	} else if !errors.Is(err, ErrMissingChainState) {
+		return err
+	}
+
+	if err := b.db.StoreGenesis(genesisHash); err != nil {
+		return err
+	}
+
+	b.logger.Printf("Loaded %d blocks, the tip is %x at height %d", b.index.Len(), tip.Hash, tip.Height)
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	return b.setLastBlock(tip)
+}
+
+// BestBlock returns the hash and the height of the main chain tip.
+func (b *Blockchain) BestBlock() (crypto.HashValue, int) {
+	b.mtx.RLock()
+	defer b.mtx.RUnlock()
+
+	return b.lastNode.Hash, b.lastNode.Height
 }
 
-func (b *Blockchain) startSyncing() {
-	b.logger.Print("Starting to sync the Blockchain...")
-	time.Sleep(time.Second * time.Duration(rand.Int()%50))
-	b.logger.Print("All relevant blocks have been downloaded. The Blockchain is synced :)")
+// Block returns a stored block by its hash.
+func (b *Blockchain) Block(hash crypto.HashValue) (Block, error) {
+	return b.db.Get(hash)
 }
 
+// OrphanRoot returns the hash of the missing block the given orphan
+// (transitively) depends on. False is returned if the block is not an orphan.
+func (b *Blockchain) OrphanRoot(hash crypto.HashValue) (crypto.HashValue, bool) {
+	return b.orphans.Root(hash)
+}
+
+// ProcessBlock validates a block and adds it to the chain. A block with
+// an unknown parent is kept in the orphan pool and ErrOrphanBlock is returned;
+// it is processed as soon as the parent gets connected.
 func (b *Blockchain) ProcessBlock(block Block) error {
 	hashKey, err := block.Header.Checksum()
 	if err != nil {
 		return err
 	}
 
-	if n := b.index.GetNode(hashKey); n != nil {
-		return errors.New("dublicate block")
+	b.mtx.Lock()
+	notifications, err := b.processBlock(hashKey, block)
+	b.queueNotifications(notifications)
+	b.mtx.Unlock()
+
+	b.deliverNotifications()
+
+	return err
+}
+
+// Must be called with b.mtx held.
+func (b *Blockchain) processBlock(hashKey crypto.HashValue, block Block) ([]Notification, error) {
+	if b.index.IsNodePresent(hashKey) || b.orphans.Has(hashKey) {
+		return nil, ErrDuplicateBlock
+	}
+
+	if !b.index.IsNodePresent(block.PrevBlockHash) {
+		// A bounded target and a valid PoW make the orphans cost work
+		// to produce, the context-free checks of the body come after.
+		// The payloads are validated once the height of the block is known.
+		if err := block.Header.Verify(b.params); err != nil {
+			return nil, err
+		}
+		if err := block.Verify(ChainContext{Params: b.params}); err != nil {
+			return nil, err
+		}
+
+		b.orphans.Add(hashKey, block)
+		b.logger.Printf("Block %x is an orphan, waiting for %x", hashKey, block.PrevBlockHash)
+
+		return nil, ErrOrphanBlock
 	}
 
+	notifications, err := b.acceptBlock(hashKey, block)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(notifications, b.processOrphans(hashKey)...), nil
+}
+
+// processOrphans accepts the orphans waiting for the given block,
+// then the ones waiting for them and so on.
+// Must be called with b.mtx held.
+func (b *Blockchain) processOrphans(hash crypto.HashValue) []Notification {
+	var (
+		notifications []Notification
+		parents       = []crypto.HashValue{hash}
+	)
+
+	for len(parents) > 0 {
+		parent := parents[0]
+		parents = parents[1:]
+
+		for _, o := range b.orphans.TakeChildren(parent) {
+			n, err := b.acceptBlock(o.hash, o.block)
+			if err != nil {
+				b.logger.Printf("On accepting an orphan block %x: %s", o.hash, err)
+				continue
+			}
+
+			notifications = append(notifications, n...)
+			parents = append(parents, o.hash)
+		}
+	}
+
+	return notifications
+}
+
+// Must be called with b.mtx held.
+func (b *Blockchain) acceptBlock(hashKey crypto.HashValue, block Block) ([]Notification, error) {
 	parentNode := b.index.GetNode(block.PrevBlockHash)
 
 	if parentNode == nil {
-		return ErrMissingParentNode
+		return nil, ErrMissingParentNode
 	}
 
-	if block.Timestamp < parentNode.Timestamp {
-		return ErrInvalidTimestamp
+	if parentNode.invalid {
+		return nil, ErrInvalidAncestor
 	}
 
-	if err := block.Verify(); err != nil {
-		return err
+	if err := checkHeaderContext(b.params, parentNode, block.Header, b.timeSource.AdjustedTime()); err != nil {
+		return nil, err
+	}
+
+	if err := block.Verify(b.chainContext(parentNode.Height + 1)); err != nil {
+		return nil, err
 	}
 
 	node, err := newBlockNode(parentNode, block.Header)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	b.index.AddNode(node)
 
 	if err := b.db.Store(hashKey[:], block); err != nil {
-		return err
+		return nil, err
 	}
 
-	return b.connectNodeToChain(node)
+	return b.connectNodeToChain(node, block)
 }
 
-func (b *Blockchain) setLastBlock(node *blockNode) {
-	b.mtx.Lock()
+// checkHeaderContext performs the header checks that depend on its ancestors
+// and on the network-adjusted time.
+func checkHeaderContext(params *ChainParams, parent *blockNode, header Header, now time.Time) error {
+	if header.Timestamp <= parent.MedianTimePast(params.MedianTimeBlocks) {
+		return ErrTimestampTooOld
+	}
+
+	if header.Timestamp > now.Add(params.MaxFutureDrift).Unix() {
+		return ErrTimestampTooFarAhead
+	}
+
+	if header.Version < parent.Version {
+		return fmt.Errorf("%w: %d follows %d", ErrUnsupportedVer, header.Version, parent.Version)
+	}
+
+	if header.Version < _compactBitsVersion {
+		if expected := params.nextDifficulty(parent); header.Difficulty != expected {
+			return fmt.Errorf("%w: expected %d, got %d", ErrInvalidDifficulty, expected, header.Difficulty)
+		}
+	} else if expected := params.nextBits(parent); header.Bits != expected {
+		return fmt.Errorf("%w: expected bits %08x, got %08x", ErrInvalidDifficulty, expected, header.Bits)
+	}
+
+	return nil
+}
+
+// BlockLocator returns hashes of the main chain blocks going back from
+// the tip, densely at first and then with exponentially growing steps.
+func (b *Blockchain) BlockLocator() []crypto.HashValue {
+	b.mtx.RLock()
+	defer b.mtx.RUnlock()
+
+	return blockLocator(b.lastNode)
+}
+
+func blockLocator(node *blockNode) []crypto.HashValue {
+	var locator []crypto.HashValue
+	for step := 1; node != nil; {
+		locator = append(locator, node.Hash)
+		if node.Height == 0 {
+			break
+		}
+
+		height := node.Height - step
+		if height < 0 {
+			height = 0
+		}
+		node = node.Ancestor(height)
+
+		if len(locator) >= 10 {
+			step *= 2
+		}
+	}
+
+	return locator
+}
+
+// HeadersAfter returns up to max main chain headers following the first
+// locator hash found on the main chain, stopping at the stop hash.
+func (b *Blockchain) HeadersAfter(locator []crypto.HashValue, stop crypto.HashValue, max int) []Header {
+	b.mtx.RLock()
+	defer b.mtx.RUnlock()
+
+	// Starting from the genesis block if no common block is found
+	start := b.lastNode.Ancestor(0)
+	for _, hash := range locator {
+		if node := b.index.GetNode(hash); node != nil && b.isInMainChain(node) {
+			start = node
+			break
+		}
+	}
+
+	end := start.Height + max
+	if end > b.lastNode.Height {
+		end = b.lastNode.Height
+	}
+
+	var nodes []*blockNode
+	for n := b.lastNode.Ancestor(end); n != nil && n != start; n = n.Prev {
+		nodes = append(nodes, n)
+	}
+	reverseNodes(nodes)
+
+	headers := make([]Header, 0, len(nodes))
+	for _, node := range nodes {
+		headers = append(headers, node.Header())
+		if node.Hash == stop {
+			break
+		}
+	}
+
+	return headers
+}
+
+// TxProof builds the merkle proof of a transaction included into a stored block.
+func (b *Blockchain) TxProof(blockHash, txHash crypto.HashValue) (TxProofResp, error) {
+	node := b.index.GetNode(blockHash)
+	if node == nil {
+		return TxProofResp{}, ErrMissingBlock
+	}
+
+	block, err := b.db.Get(blockHash)
+	if err != nil {
+		return TxProofResp{}, err
+	}
+
+	index := -1
+	for i, tx := range block.Body {
+		if tx.Hash == txHash {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		return TxProofResp{}, ErrTxNotInBlock
+	}
+
+	proof, err := merkleProof(block.Version, block.Body, index)
+	if err != nil {
+		return TxProofResp{}, fmt.Errorf("on generating a merkle proof: %w", err)
+	}
+
+	b.mtx.RLock()
+	inMainChain := b.isInMainChain(node)
+	b.mtx.RUnlock()
+
+	return TxProofResp{
+		Header:      block.Header,
+		Height:      node.Height,
+		InMainChain: inMainChain,
+		Proof:       proof,
+	}, nil
+}
+
+// Must be called with b.mtx held.
+func (b *Blockchain) isInMainChain(node *blockNode) bool {
+	return b.lastNode.Ancestor(node.Height) == node
+}
+
+// TimeSource returns the clock blocks are validated against. Time samples
+// reported by peers adjust it.
+func (b *Blockchain) TimeSource() *MedianTimeSource {
+	return b.timeSource
+}
+
+// MedianTimePast returns the time a block on top of the main chain must be newer than.
+func (b *Blockchain) MedianTimePast() int64 {
+	return b.tipNode().MedianTimePast(b.params.MedianTimeBlocks)
+}
+
+func (b *Blockchain) tipNode() *blockNode {
+	b.mtx.RLock()
+	defer b.mtx.RUnlock()
+
+	return b.lastNode
+}
+
+// Must be called with b.mtx held.
+func (b *Blockchain) setLastBlock(node *blockNode) error {
 	b.lastNode = node
-	b.mtx.Unlock()
+
+	return b.db.StoreTip(node.Hash)
 }
 
-func (b *Blockchain) connectNodeToChain(node *blockNode) error {
+func (b *Blockchain) connectNodeToChain(node *blockNode, block Block) ([]Notification, error) {
 	// Adding to the tip
-	// Adding to an existing chain
-	// If the amound of work on this chain is larger -- make it the man chain
-	if b.lastNode.Hash == node.Prev.Hash || node.WorkAmount.Cmp(b.lastNode.WorkAmount) > 0 {
-		b.setLastBlock(node)
-		if err := b.db.Store(_lastCommitedBlockNodeKey, node); err != nil {
-			return err
+	if node.Prev == b.lastNode {
+		appHash, err := b.connectBlock(node, block)
+		if err != nil {
+			return nil, err
 		}
+
+		return []Notification{{Type: NTBlockConnected, Block: block, Height: node.Height, AppHash: appHash}}, nil
+	}
+
+	// Adding to a side chain. If the amount of work on it
+	// is larger -- make it the main chain
+	if node.WorkAmount.Cmp(b.lastNode.WorkAmount) <= 0 {
+		b.logger.Printf("Block %x extends a side chain at height %d", node.Hash, node.Height)
+		return nil, nil
+	}
+
+	return b.reorganize(node)
+}
+
+// connectBlock moves the tip one block up the chain and executes the block
+// by the application. Returns the app hash after the block.
+// Must be called with b.mtx held.
+func (b *Blockchain) connectBlock(node *blockNode, block Block) (crypto.HashValue, error) {
+	if node.Prev != b.lastNode {
+		return crypto.HashValue{}, ErrNotChainTip
+	}
+
+	if err := b.checkCoinbase(node.Height, block); err != nil {
+		b.invalidate(node)
+		return crypto.HashValue{}, err
+	}
+
+	if b.app == nil {
+		return crypto.HashValue{}, b.setLastBlock(node)
+	}
+
+	appHash, err := executeBlock(b.app, node, block)
+	if err != nil {
+		b.invalidate(node)
+		return crypto.HashValue{}, err
+	}
+
+	if err := b.setLastBlock(node); err != nil {
+		return crypto.HashValue{}, b.rollbackApp(node, block, err)
+	}
+
+	return appHash, nil
+}
+
+// invalidate marks the node and its descendants invalid, so that no chain
+// is built on top of them. The node is remembered across restarts.
+// Must be called with b.mtx held.
+func (b *Blockchain) invalidate(node *blockNode) {
+	b.markInvalid(node)
+
+	if err := b.db.StoreInvalid(node.Hash); err != nil {
+		b.logger.Printf("On storing invalid block %x: %s", node.Hash, err)
+	}
+}
+
+func (b *Blockchain) markInvalid(node *blockNode) {
+	node.invalid = true
+	for _, n := range b.index.Descendants(node) {
+		n.invalid = true
+	}
+}
+
+// disconnectBlock moves the tip one block down the chain and
+// reverts the block in the application.
+// Must be called with b.mtx held.
+func (b *Blockchain) disconnectBlock(node *blockNode, block Block) error {
+	if node != b.lastNode {
+		return ErrNotChainTip
+	}
+
+	if err := b.setLastBlock(node.Prev); err != nil {
+		return err
+	}
+
+	if b.app == nil {
+		return nil
+	}
+
+	if err := b.app.Rollback(BlockInfo{Hash: node.Hash, Height: node.Height, Header: block.Header}); err != nil {
+		if tipErr := b.setLastBlock(node); tipErr != nil {
+			return fmt.Errorf("on rolling back the application: %v; on restoring the tip: %w", err, tipErr)
+		}
+		return fmt.Errorf("on rolling back the application: %w", err)
 	}
 
 	return nil
 }
+
+// rollbackApp reverts a block executed by the application which
+// couldn't be connected. Returns cause.
+// Must be called with b.mtx held.
+func (b *Blockchain) rollbackApp(node *blockNode, block Block, cause error) error {
+	if err := b.app.Rollback(BlockInfo{Hash: node.Hash, Height: node.Height, Header: block.Header}); err != nil {
+		return fmt.Errorf("%v; on rolling back the application: %w", cause, err)
+	}
+
+	return cause
+}
+
+// reorganize makes newTip the tip of the main chain: the blocks of the old
+// branch are disconnected from the tip down to the fork point, then the
+// blocks of the new branch are connected in order.
+// Must be called with b.mtx held.
+func (b *Blockchain) reorganize(newTip *blockNode) ([]Notification, error) {
+	oldTip := b.lastNode
+	fork := findFork(oldTip, newTip)
+	if fork == nil {
+		return nil, ErrNoForkPoint
+	}
+
+	var detached, attached []*blockNode
+	for n := oldTip; n != fork; n = n.Prev {
+		detached = append(detached, n)
+	}
+	for n := newTip; n != fork; n = n.Prev {
+		attached = append(attached, n)
+	}
+	reverseNodes(attached)
+
+	b.logger.Printf("Reorganizing the chain: %x (height %d) -> %x (height %d), fork at height %d",
+		oldTip.Hash, oldTip.Height, newTip.Hash, newTip.Height, fork.Height)
+
+	notifications := make([]Notification, 0, len(detached)+len(attached)+1)
+	reorg := Reorg{
+		OldTip:     oldTip.Hash,
+		NewTip:     newTip.Hash,
+		ForkHeight: fork.Height,
+	}
+
+	for i, n := range detached {
+		block, err := b.db.Get(n.Hash)
+		if err == nil {
+			err = b.disconnectBlock(n, block)
+		}
+		if err != nil {
+			return nil, b.undoReorganize(detached[:i], nil, fmt.Errorf("on disconnecting block %x: %w", n.Hash, err))
+		}
+
+		reorg.Detached = append(reorg.Detached, n.Hash)
+		notifications = append(notifications, Notification{Type: NTBlockDisconnected, Block: block, Height: n.Height})
+	}
+
+	for i, n := range attached {
+		var appHash crypto.HashValue
+		block, err := b.db.Get(n.Hash)
+		if err == nil {
+			appHash, err = b.connectBlock(n, block)
+		}
+		if err != nil {
+			return nil, b.undoReorganize(detached, attached[:i], fmt.Errorf("on connecting block %x: %w", n.Hash, err))
+		}
+
+		reorg.Attached = append(reorg.Attached, n.Hash)
+		notifications = append(notifications, Notification{Type: NTBlockConnected, Block: block, Height: n.Height, AppHash: appHash})
+	}
+
+	return append(notifications, Notification{Type: NTReorganization, Reorg: reorg}), nil
+}
+
+// undoReorganize restores the main chain that existed before a failed
+// reorganization: attached blocks are disconnected and detached ones
+// are connected back. Returns cause, wrapped if the chain can't be restored.
+// Must be called with b.mtx held.
+func (b *Blockchain) undoReorganize(detached, attached []*blockNode, cause error) error {
+	for i := len(attached) - 1; i >= 0; i-- {
+		block, err := b.db.Get(attached[i].Hash)
+		if err == nil {
+			err = b.disconnectBlock(attached[i], block)
+		}
+		if err != nil {
+			return fmt.Errorf("%v; on restoring the main chain: %w", cause, err)
+		}
+	}
+
+	for i := len(detached) - 1; i >= 0; i-- {
+		block, err := b.db.Get(detached[i].Hash)
+		if err == nil {
+			_, err = b.connectBlock(detached[i], block)
+		}
+		if err != nil {
+			return fmt.Errorf("%v; on restoring the main chain: %w", cause, err)
+		}
+	}
+
+	return cause
+}
+
+// findFork returns the most recent common ancestor of two nodes.
+func findFork(a, b *blockNode) *blockNode {
+	if a.Height > b.Height {
+		a = a.Ancestor(b.Height)
+	} else {
+		b = b.Ancestor(a.Height)
+	}
+
+	for a != nil && b != nil && a != b {
+		a, b = a.Prev, b.Prev
+	}
+
+	if a != b {
+		return nil
+	}
+
+	return a
+}
+
+func reverseNodes(nodes []*blockNode) {
+	for i, j := 0, len(nodes)-1; i < j; i, j = i+1, j-1 {
+		nodes[i], nodes[j] = nodes[j], nodes[i]
+	}
+}
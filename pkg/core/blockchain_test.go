@@ -0,0 +1,222 @@
+package core
+
+import (
+	"io"
+	"log"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/meddion/pkg/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestBlockchain(t *testing.T) *Blockchain {
+	return newTestBlockchainWithParams(t, &DefaultChainParams)
+}
+
+func newTestBlockchainWithParams(t *testing.T, params *ChainParams) *Blockchain {
+	db, err := NewBlockRepo(filepath.Join(t.TempDir(), "blocks.db"))
+	require.NoError(t, err, "on creating a block repo")
+	t.Cleanup(func() { db.Close() })
+
+	blkchain, err := NewBlockchain(db, params, log.New(io.Discard, "", 0))
+	require.NoError(t, err, "on creating the Blockchain instance")
+
+	return blkchain
+}
+
+func mineTestBlock(t *testing.T, parent Block, timeOffset int64) Block {
+	prevHash, err := parent.Header.Checksum()
+	require.NoError(t, err, "on hashing a parent header")
+
+	mroot, err := crypto.GenMerkleRoot(Body{})
+	require.NoError(t, err, "on generating a merkle root")
+
+	h := Header{
+		Version:       1,
+		Timestamp:     parent.Timestamp + timeOffset,
+		PrevBlockHash: prevHash,
+		MerkleRoot:    mroot,
+		Difficulty:    Difficulty(15),
+	}
+
+	h.Nonce, err = h.Difficulty.GenNonce(h)
+	require.NoError(t, err, "on generating a nonce")
+
+	return Block{Header: h, Body: Body{}}
+}
+
+func blockHash(t *testing.T, block Block) crypto.HashValue {
+	hash, err := block.Header.Checksum()
+	require.NoError(t, err, "on hashing a header")
+
+	return hash
+}
+
+func TestReorganization(t *testing.T) {
+	blkchain := newTestBlockchain(t)
+
+	var notifications []Notification
+	blkchain.Subscribe(func(n Notification) {
+		notifications = append(notifications, n)
+	})
+
+	_, genesis := getGenesisPair()
+	a1 := mineTestBlock(t, genesis, 1)
+	a2 := mineTestBlock(t, a1, 1)
+	b2 := mineTestBlock(t, a1, 2)
+	b3 := mineTestBlock(t, b2, 1)
+
+	for _, block := range []Block{a1, a2, b2} {
+		require.NoError(t, blkchain.ProcessBlock(block), "on processing a block")
+	}
+
+	tip, height := blkchain.BestBlock()
+	assert.Equal(t, blockHash(t, a2), tip, "a side chain with equal work must not replace the tip")
+	assert.Equal(t, 2, height)
+	assert.Len(t, notifications, 2)
+
+	notifications = nil
+	require.NoError(t, blkchain.ProcessBlock(b3), "on processing a block")
+
+	tip, height = blkchain.BestBlock()
+	assert.Equal(t, blockHash(t, b3), tip, "a side chain with more work must become the main one")
+	assert.Equal(t, 3, height)
+
+	types := make([]NotificationType, len(notifications))
+	for i, n := range notifications {
+		types[i] = n.Type
+	}
+	assert.Equal(t, []NotificationType{
+		NTBlockDisconnected, NTBlockConnected, NTBlockConnected, NTReorganization,
+	}, types)
+
+	assert.Equal(t, a2.Header, notifications[0].Block.Header)
+	assert.Equal(t, b2.Header, notifications[1].Block.Header)
+	assert.Equal(t, b3.Header, notifications[2].Block.Header)
+
+	assert.Equal(t, Reorg{
+		OldTip:     blockHash(t, a2),
+		NewTip:     blockHash(t, b3),
+		ForkHeight: 1,
+		Detached:   []crypto.HashValue{blockHash(t, a2)},
+		Attached:   []crypto.HashValue{blockHash(t, b2), blockHash(t, b3)},
+	}, notifications[3].Reorg)
+}
+
+func TestConcurrentNotifications(t *testing.T) {
+	blkchain := newTestBlockchain(t)
+
+	_, genesis := getGenesisPair()
+	b1 := mineTestBlock(t, genesis, 1)
+	b2 := mineTestBlock(t, b1, 1)
+
+	var (
+		mtx       sync.Mutex
+		connected []crypto.HashValue
+		processed = make(chan error, 1)
+	)
+	blkchain.Subscribe(func(n Notification) {
+		if n.Block.Header == b1.Header {
+			// The next block is connected while this notification is delivered
+			go func() { processed <- blkchain.ProcessBlock(b2) }()
+			time.Sleep(time.Millisecond * 100)
+		}
+
+		mtx.Lock()
+		connected = append(connected, blockHash(t, n.Block))
+		mtx.Unlock()
+	})
+
+	require.NoError(t, blkchain.ProcessBlock(b1))
+	require.NoError(t, <-processed)
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	assert.Equal(t, []crypto.HashValue{blockHash(t, b1), blockHash(t, b2)}, connected,
+		"the notifications should be delivered in order of the chain changes")
+}
+
+func TestFindFork(t *testing.T) {
+	_, genesis := getGenesisPair()
+	root, err := newBlockNode(nil, genesis.Header)
+	require.NoError(t, err)
+
+	chain := func(prev *blockNode, n int, ts int64) []*blockNode {
+		nodes := make([]*blockNode, n)
+		for i := range nodes {
+			h := genesis.Header
+			h.Timestamp = ts + int64(i)
+			h.PrevBlockHash = prev.Hash
+			prev, err = newBlockNode(prev, h)
+			require.NoError(t, err)
+			nodes[i] = prev
+		}
+		return nodes
+	}
+
+	main := chain(root, 5, 100)
+	side := chain(main[1], 4, 200)
+
+	assert.Equal(t, main[1], findFork(main[4], side[3]))
+	assert.Equal(t, main[1], findFork(side[3], main[4]))
+	assert.Equal(t, main[3], findFork(main[4], main[3]))
+	assert.Equal(t, root, findFork(root, side[0]))
+}
+
+func TestLoadChain(t *testing.T) {
+	dbFile := filepath.Join(t.TempDir(), "blocks.db")
+	logger := log.New(io.Discard, "", 0)
+
+	db, err := NewBlockRepo(dbFile)
+	require.NoError(t, err, "on creating a block repo")
+
+	blkchain, err := NewBlockchain(db, &DefaultChainParams, logger)
+	require.NoError(t, err, "on creating the Blockchain instance")
+
+	_, genesis := getGenesisPair()
+	a1 := mineTestBlock(t, genesis, 1)
+	a2 := mineTestBlock(t, a1, 1)
+	b2 := mineTestBlock(t, a1, 2)
+	for _, block := range []Block{a1, a2, b2} {
+		require.NoError(t, blkchain.ProcessBlock(block), "on processing a block")
+	}
+	require.NoError(t, db.Close())
+
+	t.Run("restart", func(t *testing.T) {
+		db, err := NewBlockRepo(dbFile)
+		require.NoError(t, err, "on opening a block repo")
+		defer db.Close()
+
+		restored, err := NewBlockchain(db, &DefaultChainParams, logger)
+		require.NoError(t, err, "on restoring the Blockchain instance")
+
+		tip, height := restored.BestBlock()
+		assert.Equal(t, blockHash(t, a2), tip, "the stored tip should be restored")
+		assert.Equal(t, 2, height)
+		assert.Equal(t, blkchain.index.Len(), restored.index.Len())
+
+		for _, block := range []Block{a1, a2, b2} {
+			hash := blockHash(t, block)
+			expected, actual := blkchain.index.GetNode(hash), restored.index.GetNode(hash)
+			require.NotNil(t, actual, "on looking up a restored node")
+			assert.Equal(t, expected.Height, actual.Height)
+			assert.Equal(t, expected.Prev.Hash, actual.Prev.Hash)
+			assert.Zero(t, expected.WorkAmount.Cmp(actual.WorkAmount))
+		}
+	})
+
+	t.Run("genesis_mismatch", func(t *testing.T) {
+		db, err := NewBlockRepo(dbFile)
+		require.NoError(t, err, "on opening a block repo")
+		defer db.Close()
+
+		require.NoError(t, db.StoreGenesis(crypto.HashValue{0x1}))
+
+		_, err = NewBlockchain(db, &DefaultChainParams, logger)
+		assert.ErrorIs(t, err, ErrGenesisMismatch)
+	})
+}
@@ -1,26 +1,30 @@
 package core
 
 import (
-	"bytes"
-	"encoding/gob"
 	"math/big"
+	"sort"
 	"sync"
 
 	"github.com/meddion/pkg/crypto"
 )
 
-// Fields are exported to satisfy gob encoder/decorer
 type blockNode struct {
 	Prev       *blockNode
 	WorkAmount *big.Int
 	Height     int
 	Hash       crypto.HashValue
+	// Set once the block or one of its ancestors fails to connect.
+	// Guarded by Blockchain.mtx.
+	invalid bool
 
 	// Some fields from Header
-	Version    uint8
-	Timestamp  int64
-	MerkleRoot crypto.HashValue
-	Nonce      Nonce
+	Version       uint8
+	Timestamp     int64
+	PrevBlockHash crypto.HashValue
+	MerkleRoot    crypto.HashValue
+	Difficulty    Difficulty
+	Bits          Bits
+	Nonce         Nonce
 }
 
 func newBlockNode(prev *blockNode, header Header) (*blockNode, error) {
@@ -30,12 +34,15 @@ func newBlockNode(prev *blockNode, header Header) (*blockNode, error) {
 	}
 
 	node := &blockNode{
-		Hash:       hash,
-		WorkAmount: header.Difficulty.WorkAmount(),
-		Version:    header.Version,
-		Timestamp:  header.Timestamp,
-		MerkleRoot: header.MerkleRoot,
-		Nonce:      header.Nonce,
+		Hash:          hash,
+		WorkAmount:    header.WorkAmount(),
+		Version:       header.Version,
+		Timestamp:     header.Timestamp,
+		PrevBlockHash: header.PrevBlockHash,
+		MerkleRoot:    header.MerkleRoot,
+		Difficulty:    header.Difficulty,
+		Bits:          header.Bits,
+		Nonce:         header.Nonce,
 	}
 	if prev != nil {
 		node.Prev = prev
@@ -46,6 +53,36 @@ func newBlockNode(prev *blockNode, header Header) (*blockNode, error) {
 	return node, nil
 }
 
+// Header reconstructs the block header the node was created from.
+func (node *blockNode) Header() Header {
+	return Header{
+		Version:       node.Version,
+		Timestamp:     node.Timestamp,
+		PrevBlockHash: node.PrevBlockHash,
+		MerkleRoot:    node.MerkleRoot,
+		Difficulty:    node.Difficulty,
+		Bits:          node.Bits,
+		Nonce:         node.Nonce,
+	}
+}
+
+// MedianTimePast returns the median timestamp of the node
+// and up to n-1 of its ancestors.
+func (node *blockNode) MedianTimePast(n int) int64 {
+	timestamps := make([]int64, 0, n)
+	for i, iter := 0, node; i < n && iter != nil; i, iter = i+1, iter.Prev {
+		timestamps = append(timestamps, iter.Timestamp)
+	}
+
+	if len(timestamps) == 0 {
+		return 0
+	}
+
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+
+	return timestamps[len(timestamps)/2]
+}
+
 func (node *blockNode) Ancestor(height int) *blockNode {
 	if height < 0 || height > node.Height {
 		return nil
@@ -58,16 +95,6 @@ func (node *blockNode) Ancestor(height int) *blockNode {
 	return n
 }
 
-func (b blockNode) Bytes() ([]byte, error) {
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-	if err := enc.Encode(b); err != nil {
-		return nil, err
-	}
-
-	return buf.Bytes(), nil
-}
-
 type blockIndex struct {
 	mut   sync.RWMutex
 	index map[crypto.HashValue]*blockNode
@@ -99,3 +126,66 @@ func (b *blockIndex) AddNode(node *blockNode) {
 	b.index[node.Hash] = node
 	b.mut.Unlock()
 }
+
+func (b *blockIndex) Len() int {
+	b.mut.RLock()
+	defer b.mut.RUnlock()
+
+	return len(b.index)
+}
+
+// BestNode returns the valid node with the largest amount of work.
+func (b *blockIndex) BestNode() *blockNode {
+	b.mut.RLock()
+	defer b.mut.RUnlock()
+
+	var best *blockNode
+	for _, node := range b.index {
+		if node.invalid {
+			continue
+		}
+		if best == nil || node.WorkAmount.Cmp(best.WorkAmount) > 0 {
+			best = node
+		}
+	}
+
+	return best
+}
+
+// Descendants returns the indexed nodes descending from node.
+func (b *blockIndex) Descendants(node *blockNode) []*blockNode {
+	b.mut.RLock()
+	defer b.mut.RUnlock()
+
+	// Whether a node descends from node or is node itself
+	descends := map[*blockNode]bool{node: true}
+	for _, n := range b.index {
+		var (
+			path   []*blockNode
+			result bool
+		)
+		for iter := n; ; iter = iter.Prev {
+			if known, exists := descends[iter]; exists {
+				result = known
+				break
+			}
+			if iter == nil || iter.Height <= node.Height {
+				break
+			}
+			path = append(path, iter)
+		}
+
+		for _, p := range path {
+			descends[p] = result
+		}
+	}
+
+	var nodes []*blockNode
+	for n, isDescendant := range descends {
+		if isDescendant && n != node {
+			nodes = append(nodes, n)
+		}
+	}
+
+	return nodes
+}
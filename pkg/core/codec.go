@@ -0,0 +1,348 @@
+package core
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/meddion/pkg/crypto"
+)
+
+// The canonical encoding used for hashing, storage and the wire. All the
+// integers are big-endian and of fixed width, byte fields are prefixed
+// with their length as uint32.
+//
+//	Header      = Version u8 | Timestamp i64 | PrevBlockHash [32] | MerkleRoot [32] |
+//	              Difficulty u32 | Bits u32 | Nonce u32
+//	Transaction = Format u8 | Type u8 (typed format only) | Hash [32] | Data bytes |
+//	              Sig bytes (empty if unsigned)
+//	Block       = Header | TxCount u32 | (Transaction bytes) * TxCount
+//
+// The layout of a header is bound by its version, a transaction carries
+// its own format version.
+const (
+	HeaderSize = 1 + 8 + 2*int(crypto.HashLen) + 3*4
+
+	// The untyped transactions, their data is opaque
+	_txFormatVersion uint8 = 1
+	// The transactions carrying a payload type other than PayloadOpaque
+	_typedTxFormat uint8 = 2
+)
+
+var ErrInvalidEncoding = errors.New("invalid encoding")
+
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) uint8(v uint8) {
+	e.buf = append(e.buf, v)
+}
+
+func (e *encoder) uint32(v uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	e.buf = append(e.buf, b[:]...)
+}
+
+func (e *encoder) int64(v int64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(v))
+	e.buf = append(e.buf, b[:]...)
+}
+
+func (e *encoder) uint64(v uint64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	e.buf = append(e.buf, b[:]...)
+}
+
+func (e *encoder) hash(v crypto.HashValue) {
+	e.buf = append(e.buf, v[:]...)
+}
+
+func (e *encoder) bytes(v []byte) {
+	e.uint32(uint32(len(v)))
+	e.buf = append(e.buf, v...)
+}
+
+// decoder reads the fields one by one. The first error sticks and
+// all the following reads return zero values.
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+
+	if n < 0 || n > len(d.buf) {
+		d.err = fmt.Errorf("%w: unexpected end of data", ErrInvalidEncoding)
+		return nil
+	}
+
+	b := d.buf[:n:n]
+	d.buf = d.buf[n:]
+
+	return b
+}
+
+func (d *decoder) uint8() uint8 {
+	if b := d.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (d *decoder) uint32() uint32 {
+	if b := d.next(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (d *decoder) int64() int64 {
+	if b := d.next(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+func (d *decoder) uint64() uint64 {
+	if b := d.next(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (d *decoder) hash() (h crypto.HashValue) {
+	copy(h[:], d.next(int(crypto.HashLen)))
+	return h
+}
+
+// bytes returns nil for an empty field. The length is checked against
+// the remaining data before anything is allocated.
+func (d *decoder) bytes() []byte {
+	n := d.uint32()
+	if n == 0 || d.err != nil {
+		return nil
+	}
+
+	if uint64(n) > uint64(len(d.buf)) {
+		d.err = fmt.Errorf("%w: field length %d exceeds the data", ErrInvalidEncoding, n)
+		return nil
+	}
+
+	return append([]byte(nil), d.next(int(n))...)
+}
+
+// finish fails if anything is left unread.
+func (d *decoder) finish() error {
+	if d.err == nil && len(d.buf) != 0 {
+		d.err = fmt.Errorf("%w: %d trailing bytes", ErrInvalidEncoding, len(d.buf))
+	}
+
+	return d.err
+}
+
+func (e *encoder) header(h Header) {
+	e.uint8(h.Version)
+	e.int64(h.Timestamp)
+	e.hash(h.PrevBlockHash)
+	e.hash(h.MerkleRoot)
+	e.uint32(uint32(h.Difficulty))
+	e.uint32(uint32(h.Bits))
+	e.uint32(uint32(h.Nonce))
+}
+
+func (d *decoder) header() Header {
+	return Header{
+		Version:       d.uint8(),
+		Timestamp:     d.int64(),
+		PrevBlockHash: d.hash(),
+		MerkleRoot:    d.hash(),
+		Difficulty:    Difficulty(d.uint32()),
+		Bits:          Bits(d.uint32()),
+		Nonce:         Nonce(d.uint32()),
+	}
+}
+
+// signature writes an empty field for a nil signature
+func (e *encoder) signature(sig Signature) error {
+	var b []byte
+	if sig != nil {
+		var err error
+		if b, err = sig.Bytes(); err != nil {
+			return fmt.Errorf("on encoding a signature: %w", err)
+		}
+	}
+	e.bytes(b)
+
+	return nil
+}
+
+func (d *decoder) signature() Signature {
+	b := d.bytes()
+	if b == nil {
+		return nil
+	}
+
+	sig, err := crypto.SigECDSAFromBytes(b)
+	if err != nil {
+		d.err = fmt.Errorf("%w: %s", ErrInvalidEncoding, err)
+		return nil
+	}
+
+	return sig
+}
+
+func (e *encoder) transaction(t Transaction) error {
+	if t.Type == PayloadOpaque {
+		e.uint8(_txFormatVersion)
+	} else {
+		e.uint8(_typedTxFormat)
+		e.uint8(uint8(t.Type))
+	}
+	e.hash(t.Hash)
+	e.bytes(t.Data)
+
+	return e.signature(t.Sig)
+}
+
+func (d *decoder) transaction() Transaction {
+	var t Transaction
+	switch ver := d.uint8(); {
+	case d.err != nil, ver == _txFormatVersion:
+	case ver == _typedTxFormat:
+		// The untyped transactions have a single encoding
+		if t.Type = PayloadType(d.uint8()); d.err == nil && t.Type == PayloadOpaque {
+			d.err = fmt.Errorf("%w: untyped transaction in the typed format", ErrInvalidEncoding)
+		}
+	default:
+		d.err = fmt.Errorf("%w: unknown transaction format %d", ErrInvalidEncoding, ver)
+	}
+
+	t.Hash = d.hash()
+	t.Data = d.bytes()
+	t.Sig = d.signature()
+	if d.err != nil {
+		return Transaction{}
+	}
+
+	return t
+}
+
+func (h Header) Bytes() ([]byte, error) {
+	e := encoder{buf: make([]byte, 0, HeaderSize)}
+	e.header(h)
+
+	return e.buf, nil
+}
+
+func (h *Header) FromBytes(data []byte) error {
+	d := decoder{buf: data}
+	header := d.header()
+	if err := d.finish(); err != nil {
+		return err
+	}
+
+	*h = header
+	return nil
+}
+
+func (t Transaction) Bytes() ([]byte, error) {
+	var e encoder
+	if err := e.transaction(t); err != nil {
+		return nil, err
+	}
+
+	return e.buf, nil
+}
+
+func (t *Transaction) FromBytes(data []byte) error {
+	d := decoder{buf: data}
+	tx := d.transaction()
+	if err := d.finish(); err != nil {
+		return err
+	}
+
+	*t = tx
+	return nil
+}
+
+func (b Block) Bytes() ([]byte, error) {
+	e := encoder{buf: make([]byte, 0, HeaderSize+4)}
+	e.header(b.Header)
+	e.uint32(uint32(len(b.Body)))
+
+	for _, tx := range b.Body {
+		var txEnc encoder
+		if err := txEnc.transaction(tx); err != nil {
+			return nil, err
+		}
+		e.bytes(txEnc.buf)
+	}
+
+	return e.buf, nil
+}
+
+func (b *Block) FromBytes(data []byte) error {
+	d := decoder{buf: data}
+	header := d.header()
+
+	n := d.uint32()
+	// Every transaction takes at least its length prefix
+	if d.err == nil && uint64(n)*4 > uint64(len(d.buf)) {
+		return fmt.Errorf("%w: %d transactions don't fit into the data", ErrInvalidEncoding, n)
+	}
+
+	body := make(Body, 0, n)
+	for i := uint32(0); i < n && d.err == nil; i++ {
+		txDec := decoder{buf: d.next(int(d.uint32()))}
+		if d.err != nil {
+			break
+		}
+
+		tx := txDec.transaction()
+		if err := txDec.finish(); err != nil {
+			return fmt.Errorf("on decoding transaction #%d: %w", i, err)
+		}
+		body = append(body, tx)
+	}
+
+	if err := d.finish(); err != nil {
+		return err
+	}
+
+	*b = Block{Header: header, Body: body}
+	return nil
+}
+
+// The types implement encoding.BinaryMarshaler, so gob, and hence the RPC,
+// sends them in the canonical encoding as well
+
+func (h Header) MarshalBinary() ([]byte, error) {
+	return h.Bytes()
+}
+
+func (h *Header) UnmarshalBinary(data []byte) error {
+	return h.FromBytes(data)
+}
+
+func (t Transaction) MarshalBinary() ([]byte, error) {
+	return t.Bytes()
+}
+
+func (t *Transaction) UnmarshalBinary(data []byte) error {
+	return t.FromBytes(data)
+}
+
+func (b Block) MarshalBinary() ([]byte, error) {
+	return b.Bytes()
+}
+
+func (b *Block) UnmarshalBinary(data []byte) error {
+	return b.FromBytes(data)
+}
@@ -0,0 +1,172 @@
+package core
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"testing"
+
+	"github.com/meddion/pkg/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCodecGoldenVectors(t *testing.T) {
+	h := Header{
+		Version:       2,
+		Timestamp:     0x0102030405060708,
+		PrevBlockHash: crypto.HashValue{0xaa},
+		MerkleRoot:    crypto.HashValue{31: 0xbb},
+		Difficulty:    0x11,
+		Bits:          0x1f00ffff,
+		Nonce:         0xdeadbeef,
+	}
+
+	b, err := h.Bytes()
+	require.NoError(t, err)
+	assert.Len(t, b, HeaderSize)
+	assert.Equal(t, "02"+"0102030405060708"+
+		"aa"+zeros(31)+
+		zeros(31)+"bb"+
+		"00000011"+"1f00ffff"+"deadbeef", hex.EncodeToString(b))
+
+	tx := Transaction{Hash: crypto.HashValue{0x01}, Data: TxData("hi")}
+	b, err = tx.Bytes()
+	require.NoError(t, err)
+	assert.Equal(t, "01"+"01"+zeros(31)+"00000002"+"6869"+"00000000", hex.EncodeToString(b))
+
+	typed := Transaction{Hash: crypto.HashValue{0x01}, Type: 7, Data: TxData("hi")}
+	b, err = typed.Bytes()
+	require.NoError(t, err)
+	assert.Equal(t, "02"+"07"+"01"+zeros(31)+"00000002"+"6869"+"00000000", hex.EncodeToString(b))
+
+	block := Block{Header: h, Body: Body{tx}}
+	b, err = block.Bytes()
+	require.NoError(t, err)
+	headerBytes, _ := h.Bytes()
+	txBytes, _ := tx.Bytes()
+	assert.Equal(t, hex.EncodeToString(headerBytes)+"00000001"+"0000002b"+hex.EncodeToString(txBytes), hex.EncodeToString(b))
+
+	_, genesis := getGenesisPair()
+	b, err = genesis.Header.Bytes()
+	require.NoError(t, err)
+	assert.Equal(t, "01"+"0000000060359700"+
+		// sha256("genesis") and sha256("")
+		"aeebad4a796fcc2e15dc4c6061b45ed9b373f26adfc798ca7d2d8cc58182718e"+
+		"e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"+
+		"00000000"+"00000000"+"000201a2",
+		hex.EncodeToString(b), "the genesis header encoding shouldn't change")
+}
+
+func zeros(n int) string {
+	return hex.EncodeToString(make([]byte, n))
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	txs, err := genRandTransactions(3)
+	require.NoError(t, err)
+
+	t.Run("header", func(t *testing.T) {
+		h := Header{Version: 3, Timestamp: -1, Bits: 0x1e00ffff, Nonce: NonceMaxValue}
+		b, err := h.Bytes()
+		require.NoError(t, err)
+
+		var decoded Header
+		require.NoError(t, decoded.FromBytes(b))
+		assert.Equal(t, h, decoded)
+	})
+
+	t.Run("transaction", func(t *testing.T) {
+		signer, err := crypto.NewSignerECDSA()
+		require.NoError(t, err)
+		typed, err := NewTx(signer, 7, TxData("typed"))
+		require.NoError(t, err)
+
+		for _, tx := range append(txs, Transaction{Data: TxData{0x1}}, typed) {
+			b, err := tx.Bytes()
+			require.NoError(t, err)
+
+			var decoded Transaction
+			require.NoError(t, decoded.FromBytes(b))
+			assert.Equal(t, tx.Hash, decoded.Hash)
+			assert.Equal(t, tx.Type, decoded.Type)
+			assert.Equal(t, tx.Data, decoded.Data)
+
+			if tx.Sig == nil {
+				assert.Nil(t, decoded.Sig)
+				continue
+			}
+			assert.NoError(t, decoded.Verify(ChainContext{Params: &DefaultChainParams}), "the signature should survive the round trip")
+
+			again, err := decoded.Bytes()
+			require.NoError(t, err)
+			assert.Equal(t, b, again)
+		}
+	})
+
+	t.Run("block", func(t *testing.T) {
+		_, genesis := getGenesisPair()
+		for _, block := range []Block{genesis, {Header: genesis.Header, Body: txs}} {
+			b, err := block.Bytes()
+			require.NoError(t, err)
+
+			var decoded Block
+			require.NoError(t, decoded.FromBytes(b))
+			assert.Equal(t, block.Header, decoded.Header)
+			assert.Len(t, decoded.Body, len(block.Body))
+
+			again, err := decoded.Bytes()
+			require.NoError(t, err)
+			assert.Equal(t, b, again)
+		}
+	})
+
+	t.Run("gob", func(t *testing.T) {
+		req := BlockReq{Block: Block{Body: txs}}
+
+		var buf bytes.Buffer
+		require.NoError(t, gob.NewEncoder(&buf).Encode(req))
+
+		var decoded BlockReq
+		require.NoError(t, gob.NewDecoder(&buf).Decode(&decoded))
+		assert.Equal(t, req.Header, decoded.Header)
+		require.Len(t, decoded.Block.Body, len(txs))
+		assert.NoError(t, decoded.Block.Body[0].Verify(ChainContext{Params: &DefaultChainParams}))
+	})
+}
+
+func TestCodecMalformed(t *testing.T) {
+	txs, err := genRandTransactions(2)
+	require.NoError(t, err)
+
+	block := Block{Body: txs}
+	b, err := block.Bytes()
+	require.NoError(t, err)
+
+	var decoded Block
+	assert.ErrorIs(t, decoded.FromBytes(b[:len(b)-1]), ErrInvalidEncoding, "truncated")
+	assert.ErrorIs(t, decoded.FromBytes(append(b, 0)), ErrInvalidEncoding, "trailing bytes")
+
+	huge := append([]byte(nil), b[:HeaderSize]...)
+	huge = append(huge, 0xff, 0xff, 0xff, 0xff)
+	assert.ErrorIs(t, decoded.FromBytes(huge), ErrInvalidEncoding, "too many transactions")
+
+	txBytes, err := txs[0].Bytes()
+	require.NoError(t, err)
+
+	var tx Transaction
+	txBytes[0] = _typedTxFormat + 1
+	assert.ErrorIs(t, tx.FromBytes(txBytes), ErrInvalidEncoding, "unknown format")
+
+	untyped := append([]byte{_typedTxFormat, byte(PayloadOpaque)}, txBytes[1:]...)
+	assert.ErrorIs(t, tx.FromBytes(untyped), ErrInvalidEncoding, "untyped transaction in the typed format")
+
+	txBytes[0] = _txFormatVersion
+	// Moving the public key off the curve
+	sigStart := 1 + int(crypto.HashLen) + 4 + len(txs[0].Data) + 4
+	txBytes[sigStart+1] ^= 0xff
+	assert.ErrorIs(t, tx.FromBytes(txBytes), ErrInvalidEncoding, "invalid signature")
+
+	var h Header
+	assert.ErrorIs(t, h.FromBytes(make([]byte, HeaderSize-1)), ErrInvalidEncoding)
+}
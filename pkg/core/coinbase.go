@@ -0,0 +1,215 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/meddion/pkg/crypto"
+)
+
+// PayloadCoinbase is the payload type of the coinbase transactions
+const PayloadCoinbase PayloadType = 4
+
+// The smallest amounts in a coin
+const _coin = 100_000_000
+
+var (
+	ErrCoinbaseNotFirst  = errors.New("coinbase isn't the first transaction of a block")
+	ErrMultipleCoinbases = errors.New("block has more than one coinbase")
+	ErrCoinbaseHeight    = errors.New("coinbase height doesn't match the block")
+	ErrCoinbaseAmount    = errors.New("coinbase pays more than the subsidy and fees")
+	ErrCoinbaseInMempool = errors.New("coinbase can only be included by a miner")
+	ErrImmatureCoinbase  = errors.New("coinbase output isn't mature yet")
+)
+
+// Coinbase is the payload of the first transaction of a block that pays
+// the block subsidy and the fees to the miner. The height makes
+// the coinbases of different blocks distinct.
+//
+//	Coinbase = Height u64 | OutCount u32 | (Amount u64 | To [20]) * OutCount
+type Coinbase struct {
+	Height  uint64
+	Outputs []TxOut
+}
+
+func (c Coinbase) Bytes() []byte {
+	var e encoder
+	e.uint64(c.Height)
+	e.uint32(uint32(len(c.Outputs)))
+	for _, out := range c.Outputs {
+		e.txOut(out)
+	}
+
+	return e.buf
+}
+
+func (c *Coinbase) FromBytes(data []byte) error {
+	d := decoder{buf: data}
+	coinbase := Coinbase{Height: d.uint64()}
+
+	n := d.uint32()
+	if d.err == nil && uint64(n)*28 > uint64(len(d.buf)) {
+		d.err = fmt.Errorf("%w: %d outputs don't fit into the data", ErrInvalidEncoding, n)
+	}
+	for i := uint32(0); i < n && d.err == nil; i++ {
+		coinbase.Outputs = append(coinbase.Outputs, d.txOut())
+	}
+
+	if err := d.finish(); err != nil {
+		return err
+	}
+
+	*c = coinbase
+	return nil
+}
+
+// NewCoinbaseTx returns a coinbase of the block at the given height paying
+// the amount to the signer.
+func NewCoinbaseTx(signer crypto.SignerECDSA, height int, amount uint64) (Transaction, error) {
+	data := Coinbase{
+		Height:  uint64(height),
+		Outputs: []TxOut{{Amount: amount, To: signer.Address()}},
+	}.Bytes()
+
+	return NewTx(signer, PayloadCoinbase, data)
+}
+
+// IsCoinbase reports whether the transaction is a coinbase.
+func IsCoinbase(tx Transaction) bool {
+	return tx.Type == PayloadCoinbase
+}
+
+// decodeCoinbase returns false for the transactions of other payload types.
+func decodeCoinbase(tx Transaction) (Coinbase, bool, error) {
+	if !IsCoinbase(tx) {
+		return Coinbase{}, false, nil
+	}
+
+	var c Coinbase
+	return c, true, c.FromBytes(tx.Data)
+}
+
+// BlockSubsidy returns the amount a coinbase can create at the given height.
+func (p *ChainParams) BlockSubsidy(height int) uint64 {
+	if p.HalvingInterval == 0 {
+		return p.InitialSubsidy
+	}
+
+	halvings := height / p.HalvingInterval
+	if halvings >= 64 {
+		return 0
+	}
+
+	return p.InitialSubsidy >> halvings
+}
+
+// verifyCoinbase checks that a block has at most one coinbase, it goes
+// first and its outputs are valid. The height and the amount are checked
+// once the block gets to the chain.
+func verifyCoinbase(body Body) error {
+	for i, tx := range body {
+		coinbase, ok, err := decodeCoinbase(tx)
+		switch {
+		case !ok:
+			continue
+		case i > 0 && IsCoinbase(body[0]):
+			return ErrMultipleCoinbases
+		case i > 0:
+			return ErrCoinbaseNotFirst
+		case err != nil:
+			return fmt.Errorf("on decoding a coinbase: %w", err)
+		}
+
+		if err := (UTXOTx{Outputs: coinbase.Outputs}).verify(); err != nil {
+			return fmt.Errorf("invalid coinbase: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// FeeCalculator is implemented by the Applications whose transactions pay
+// fees to the miner. The fee of a transaction is calculated in the context
+// of the block it gets into, before the block is executed.
+type FeeCalculator interface {
+	Fee(ctx ChainContext, tx Transaction) (uint64, error)
+}
+
+// blockFees sums up the fees of the transactions following the coinbase.
+// Applications that don't implement FeeCalculator collect no fees.
+func blockFees(app Application, ctx ChainContext, body Body) (uint64, error) {
+	calc, ok := app.(FeeCalculator)
+	if !ok {
+		return 0, nil
+	}
+
+	var fees uint64
+	ctx.Preceding = NewPrecedingTxs()
+	for _, tx := range body {
+		if !IsCoinbase(tx) {
+			fee, err := calc.Fee(ctx, tx)
+			if err != nil {
+				return 0, fmt.Errorf("on calculating the fee of %x: %w", tx.Hash, err)
+			}
+
+			if fees > math.MaxUint64-fee {
+				return 0, ErrAmountOverflow
+			}
+			fees += fee
+		}
+		ctx.Preceding.Add(tx)
+	}
+
+	return fees, nil
+}
+
+// pendingFees returns the fees the body pays in the context of the next block.
+func (b *Blockchain) pendingFees(ctx ChainContext, body Body) (uint64, error) {
+	b.mtx.RLock()
+	defer b.mtx.RUnlock()
+
+	return blockFees(b.app, ctx, body)
+}
+
+// checkCoinbase checks the height of the coinbase of a block and that it
+// pays no more than the subsidy and the fees of the block.
+// Must be called with b.mtx held on top of the parent of the block.
+func (b *Blockchain) checkCoinbase(height int, block Block) error {
+	if len(block.Body) == 0 {
+		return nil
+	}
+
+	coinbase, ok, err := decodeCoinbase(block.Body[0])
+	if !ok {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if coinbase.Height != uint64(height) {
+		return fmt.Errorf("%w: %d at height %d", ErrCoinbaseHeight, coinbase.Height, height)
+	}
+
+	fees, err := blockFees(b.app, b.chainContext(height), block.Body)
+	if err != nil {
+		return err
+	}
+
+	claimed, err := UTXOTx{Outputs: coinbase.Outputs}.OutputSum()
+	if err != nil {
+		return err
+	}
+
+	subsidy := b.params.BlockSubsidy(height)
+	if fees > math.MaxUint64-subsidy {
+		return ErrAmountOverflow
+	}
+
+	if claimed > subsidy+fees {
+		return fmt.Errorf("%w: %d > %d + %d", ErrCoinbaseAmount, claimed, subsidy, fees)
+	}
+
+	return nil
+}
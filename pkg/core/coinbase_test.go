@@ -0,0 +1,121 @@
+package core
+
+import (
+	"context"
+	"io"
+	"log"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlockSubsidy(t *testing.T) {
+	params := ChainParams{InitialSubsidy: 50, HalvingInterval: 10}
+
+	for _, c := range []struct {
+		height  int
+		subsidy uint64
+	}{
+		{0, 50}, {9, 50}, {10, 25}, {25, 12}, {59, 1}, {60, 0}, {640, 0}, {1 << 20, 0},
+	} {
+		assert.Equal(t, c.subsidy, params.BlockSubsidy(c.height), "height %d", c.height)
+	}
+
+	params.HalvingInterval = 0
+	assert.Equal(t, uint64(50), params.BlockSubsidy(1<<20), "the subsidy never halves")
+}
+
+func TestCoinbase(t *testing.T) {
+	alice, minerKey := newTestSigner(t), newTestSigner(t)
+	logger := log.New(io.Discard, "", 0)
+
+	params := RegtestChainParams
+	params.InitialSubsidy, params.HalvingInterval, params.CoinbaseMaturity = 50, 2, 2
+
+	blkchain, utxos, allocationHash := newTestUTXOChain(t, params, TxOut{Amount: 100, To: alice.Address()})
+
+	mempool := NewMempool(DefaultMempoolConfig, logger)
+	mempool.Follow(blkchain)
+	rcv := NewReceiverRPC(blkchain, mempool, NewPeerPool(logger, 0), Addr{}, logger)
+
+	submit := func(tx Transaction) TransactionResp {
+		var resp TransactionResp
+		require.NoError(t, rcv.HandleTransaction(TransactionReq{Transaction: tx}, &resp))
+		return resp
+	}
+
+	miner := NewMiner(blkchain, mempool, nil, 1, logger)
+	miner.SetCoinbaseKey(minerKey)
+
+	require.True(t, submit(spendTestTx(t, alice, []OutPoint{{TxHash: allocationHash}}, TxOut{Amount: 90, To: alice.Address()})).Status)
+
+	block, err := miner.MineBlock(context.Background())
+	require.NoError(t, err)
+	require.Len(t, block.Body, 2)
+	require.True(t, IsCoinbase(block.Body[0]))
+
+	reward := OutPoint{TxHash: block.Body[0].Hash}
+	entry, err := utxos.UTXO(reward)
+	require.NoError(t, err)
+	assert.Equal(t, UTXOEntry{Out: TxOut{Amount: 60, To: minerKey.Address()}, Height: 1, Coinbase: true}, entry,
+		"the coinbase should collect the subsidy and the fees")
+
+	resp := submit(block.Body[0])
+	assert.False(t, resp.Status)
+	assert.Contains(t, resp.Msg, ErrCoinbaseInMempool.Error())
+
+	spendReward := spendTestTx(t, minerKey, []OutPoint{reward}, TxOut{Amount: 60, To: alice.Address()})
+	resp = submit(spendReward)
+	assert.False(t, resp.Status)
+	assert.Contains(t, resp.Msg, ErrImmatureCoinbase.Error())
+
+	block, err = miner.MineBlock(context.Background())
+	require.NoError(t, err)
+	require.Len(t, block.Body, 1)
+	assert.Equal(t, uint64(25), blockCoinbaseAmount(t, block), "the subsidy should halve")
+
+	assert.True(t, submit(spendReward).Status, "the coinbase should mature")
+
+	opaque, err := NewTx(alice, PayloadOpaque, TxData{byte(PayloadCoinbase), 1, 2, 3})
+	require.NoError(t, err)
+	assert.False(t, IsCoinbase(opaque), "only the typed format marks a coinbase")
+	assert.True(t, submit(opaque).Status)
+
+	t.Run("consensus", func(t *testing.T) {
+		coinbase := func(height int, amount uint64) Transaction {
+			tx, err := NewCoinbaseTx(minerKey, height, amount)
+			require.NoError(t, err)
+			return tx
+		}
+
+		txs, err := genRandTransactions(1)
+		require.NoError(t, err)
+
+		for _, c := range []struct {
+			body Body
+			err  error
+		}{
+			{Body{txs[0], coinbase(3, 25)}, ErrCoinbaseNotFirst},
+			{Body{coinbase(3, 25), coinbase(3, 24)}, ErrMultipleCoinbases},
+			{Body{coinbase(2, 25)}, ErrCoinbaseHeight},
+			{Body{coinbase(3, 26)}, ErrCoinbaseAmount},
+		} {
+			assert.ErrorIs(t, blkchain.ProcessBlock(mineRegtestBlock(t, block, 1, c.body)), c.err)
+		}
+
+		assert.NoError(t, blkchain.ProcessBlock(mineRegtestBlock(t, block, 1, Body{coinbase(3, 20), spendReward})),
+			"the coinbase can claim less than allowed")
+	})
+}
+
+func blockCoinbaseAmount(t *testing.T, block Block) uint64 {
+	coinbase, ok, err := decodeCoinbase(block.Body[0])
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	amount, err := UTXOTx{Outputs: coinbase.Outputs}.OutputSum()
+	require.NoError(t, err)
+
+	return amount
+}
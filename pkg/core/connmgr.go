@@ -0,0 +1,363 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// The delay before redialing an address doubles with every failed
+	// attempt, from the base up to the max
+	_dialBackoffBase = time.Second * 5
+	_dialBackoffMax  = time.Minute * 10
+	// Addresses failing that many dials in a row are given up on
+	_maxDialAttempts = 8
+	// Limits the number of dials made at once
+	_maxDialsPerTick = 8
+)
+
+// ConnLimits bound the number of the peers. The ConnManager dials the
+// addresses from the AddrBook until there are TargetOutbound outbound peers,
+// the persistent peers aren't counted. The inbound peers over MaxInbound
+// are rejected or make a low-value inbound peer evicted, see selectEviction.
+type ConnLimits struct {
+	MaxInbound     int
+	TargetOutbound int
+}
+
+var DefaultConnLimits = ConnLimits{
+	MaxInbound:     32,
+	TargetOutbound: 8,
+}
+
+// ConnManager learns the addresses of the nodes from the handshakes and
+// the peers, and dials the ones picked from the AddrBook.
+type ConnManager struct {
+	pool   PeerPool
+	local  *LocalNode
+	book   *AddrBook
+	limits ConnLimits
+	logger *log.Logger
+
+	mtx     sync.Mutex
+	dialing map[Addr]struct{}
+	// Redialed no matter how many times they fail
+	persistent map[Addr]*persistentPeer
+	inbound    map[*inboundSession]struct{}
+	// The connections made back by the outbound peers
+	reverse map[Addr]*inboundSession
+
+	dial func(Addr, *LocalNode) (Peer, error)
+}
+
+func NewConnManager(pool PeerPool, local *LocalNode, book *AddrBook, limits ConnLimits, logger *log.Logger) *ConnManager {
+	return &ConnManager{
+		pool:       pool,
+		local:      local,
+		book:       book,
+		limits:     limits,
+		logger:     logger,
+		dialing:    make(map[Addr]struct{}),
+		persistent: make(map[Addr]*persistentPeer),
+		inbound:    make(map[*inboundSession]struct{}),
+		reverse:    make(map[Addr]*inboundSession),
+		dial:       NewPeer,
+	}
+}
+
+type persistentPeer struct {
+	// Failed dials in a row
+	attempts int
+	nextDial time.Time
+}
+
+// AddPersistent makes the ConnManager keep a connection to the address.
+// Unlike the addresses from the AddrBook, it's never given up on.
+func (c *ConnManager) AddPersistent(addr Addr) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if _, exists := c.persistent[addr]; !exists {
+		c.persistent[addr] = &persistentPeer{}
+	}
+}
+
+// Bootstrap asks the seeds for the addresses of the nodes and closes
+// the connections. The seeds are added to the AddrBook along with
+// the addresses they know.
+func (c *ConnManager) Bootstrap(seeds []Addr) {
+	var wg sync.WaitGroup
+	for _, seed := range seeds {
+		wg.Add(1)
+		go func(seed Addr) {
+			defer wg.Done()
+
+			if err := c.querySeed(seed); err != nil {
+				c.logger.Printf("On querying the seed %s: %s", seed, err)
+			}
+		}(seed)
+	}
+	wg.Wait()
+}
+
+func (c *ConnManager) querySeed(seed Addr) error {
+	peer, err := c.dial(seed, c.local)
+	if err != nil {
+		return err
+	}
+	if closer, ok := peer.Sender.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	resp, err := peer.SendPeersDiscovery()
+	if err != nil {
+		return err
+	}
+
+	addrs := resp.Addrs
+	if len(addrs) > MaxAddrsPerReply {
+		addrs = addrs[:MaxAddrsPerReply]
+	}
+	c.AddAddrs(addrs, seed)
+	c.logger.Printf("Got %d addresses from the seed %s", len(addrs), seed)
+
+	return c.book.Good(seed)
+}
+
+// AddAddrs puts the addresses learned from src into the AddrBook.
+func (c *ConnManager) AddAddrs(addrs []KnownAddr, src Addr) {
+	others := make([]KnownAddr, 0, len(addrs))
+	for _, a := range addrs {
+		if a.Addr != c.local.ListenAddr {
+			others = append(others, a)
+		}
+	}
+
+	if err := c.book.Add(others, src); err != nil {
+		c.logger.Printf("On adding the addresses from %s: %s", src, err)
+	}
+}
+
+// Connect makes the address dialed on the next tick of Run.
+func (c *ConnManager) Connect(addr Addr) {
+	c.AddAddrs([]KnownAddr{{Addr: addr, LastSeen: c.book.now().Unix()}}, addr)
+}
+
+// KnownAddrs returns up to max addresses to advertise to the peers,
+// the connected peers go first.
+func (c *ConnManager) KnownAddrs(max int) []KnownAddr {
+	now := c.book.now().Unix()
+	addrs := make([]KnownAddr, 0, max)
+	added := make(map[Addr]struct{})
+
+	for _, p := range c.pool.Peers() {
+		if _, exists := added[p.Addr()]; exists || !p.Addr().IsRoutable() {
+			continue
+		}
+		added[p.Addr()] = struct{}{}
+		addrs = append(addrs, KnownAddr{Addr: p.Addr(), LastSeen: now})
+	}
+
+	for _, a := range c.book.Sample(max) {
+		if _, exists := added[a.Addr]; !exists {
+			addrs = append(addrs, a)
+		}
+	}
+
+	if len(addrs) > max {
+		addrs = addrs[:max]
+	}
+
+	return addrs
+}
+
+// Run dials the known addresses and asks the peers for new ones until
+// the context is canceled.
+func (c *ConnManager) Run(ctx context.Context, dialInterval, discoveryInterval time.Duration) {
+	c.dialDue()
+
+	dialTicker := time.NewTicker(dialInterval)
+	defer dialTicker.Stop()
+	discoveryTicker := time.NewTicker(discoveryInterval)
+	defer discoveryTicker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-dialTicker.C:
+			c.dialDue()
+		case <-discoveryTicker.C:
+			c.discoverAddrs()
+		}
+	}
+}
+
+// dialDue dials the persistent peers and the addresses picked from
+// the AddrBook.
+func (c *ConnManager) dialDue() {
+	var wg sync.WaitGroup
+	for _, addr := range append(c.duePersistent(), c.dueAddrs()...) {
+		wg.Add(1)
+		go func(addr Addr) {
+			defer wg.Done()
+			c.connect(addr)
+		}(addr)
+	}
+	wg.Wait()
+}
+
+// duePersistent returns the persistent peers to redial and marks them
+// as being dialed.
+func (c *ConnManager) duePersistent() []Addr {
+	connected := make(map[Addr]struct{})
+	for _, p := range c.pool.Peers() {
+		connected[p.Addr()] = struct{}{}
+	}
+
+	now := c.book.now()
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	var due []Addr
+	for addr, p := range c.persistent {
+		_, isConnected := connected[addr]
+		_, isDialing := c.dialing[addr]
+		if !isConnected && !isDialing && !p.nextDial.After(now) {
+			c.dialing[addr] = struct{}{}
+			due = append(due, addr)
+		}
+	}
+
+	return due
+}
+
+// dueAddrs picks the addresses to dial from the AddrBook up to the target
+// number of the outbound peers and marks them as being dialed.
+// The connected addresses aren't picked.
+func (c *ConnManager) dueAddrs() []Addr {
+	peers := c.pool.Peers()
+	skip := make(map[Addr]struct{}, len(peers))
+	for _, p := range peers {
+		skip[p.Addr()] = struct{}{}
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	missing := c.limits.TargetOutbound
+	for _, p := range peers {
+		if _, isPersistent := c.persistent[p.Addr()]; !isPersistent && !p.Inbound() {
+			missing--
+		}
+	}
+	for addr := range c.dialing {
+		skip[addr] = struct{}{}
+		if _, isPersistent := c.persistent[addr]; !isPersistent {
+			missing--
+		}
+	}
+	if missing > _maxDialsPerTick {
+		missing = _maxDialsPerTick
+	}
+
+	var due []Addr
+	for len(due) < missing {
+		addr, ok := c.book.Select(func(a Addr) bool {
+			_, exists := skip[a]
+			return exists
+		})
+		if !ok {
+			break
+		}
+
+		skip[addr] = struct{}{}
+		c.dialing[addr] = struct{}{}
+		due = append(due, addr)
+	}
+
+	return due
+}
+
+// connect dials the address and adds the peer to the pool. The outcome is
+// recorded in the AddrBook, the incompatible nodes are removed from it.
+// The persistent peers are only backed off.
+func (c *ConnManager) connect(addr Addr) {
+	peer, err := c.dial(addr, c.local)
+
+	c.mtx.Lock()
+	delete(c.dialing, addr)
+	p, isPersistent := c.persistent[addr]
+	if isPersistent && err != nil {
+		p.attempts++
+		p.nextDial = c.book.now().Add(dialBackoff(p.attempts))
+	} else if isPersistent {
+		p.attempts, p.nextDial = 0, time.Time{}
+	}
+	c.mtx.Unlock()
+
+	switch {
+	case isPersistent && err != nil:
+		c.logger.Printf("On connecting to the persistent peer %s: %s", addr, err)
+		return
+	case errors.Is(err, ErrIncompatiblePeer) || errors.Is(err, ErrPeerRejected):
+		c.logger.Printf("On connecting to %s: %s", addr, err)
+		err = c.book.Remove(addr)
+	case err != nil:
+		c.logger.Printf("On connecting to %s: %s", addr, err)
+		err = c.book.Failed(addr)
+	default:
+		if !c.pool.Add(peer) {
+			// Dialed back while the dial was in progress
+			peer.close()
+		} else {
+			c.logger.Printf("Connected to %s (node %s)", addr, peer.Info().ID)
+		}
+		err = c.book.Good(addr)
+	}
+
+	if err != nil {
+		c.logger.Printf("On updating the address book: %s", err)
+	}
+}
+
+// dialBackoff returns the delay after the given number of failed dials.
+func dialBackoff(attempts int) time.Duration {
+	backoff := _dialBackoffBase
+	for i := 1; i < attempts && backoff < _dialBackoffMax; i++ {
+		backoff *= 2
+	}
+	if backoff > _dialBackoffMax {
+		backoff = _dialBackoffMax
+	}
+
+	return backoff
+}
+
+// discoverAddrs asks the peers for the addresses they know.
+func (c *ConnManager) discoverAddrs() {
+	errs := c.pool.SendToPeers(func(p Peer) error {
+		resp, err := p.SendPeersDiscovery()
+		if err != nil {
+			return fmt.Errorf("on getting the addresses from %s: %w", p.Addr(), err)
+		}
+
+		addrs := resp.Addrs
+		if len(addrs) > MaxAddrsPerReply {
+			addrs = addrs[:MaxAddrsPerReply]
+		}
+		c.AddAddrs(addrs, p.Addr())
+
+		return nil
+	})
+
+	for err := range errs {
+		c.logger.Print(err)
+	}
+}
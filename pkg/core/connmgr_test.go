@@ -0,0 +1,418 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnManager(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+	self := Addr{IP: "198.51.100.1", Port: "8090"}
+	pool := NewPeerPool(logger, 0)
+
+	book := newTestAddrBook(t)
+	now := time.Unix(1_000_000, 0)
+	book.now = func() time.Time { return now }
+
+	c := NewConnManager(pool, NewLocalNode(newTestBlockchain(t), self), book, DefaultConnLimits, logger)
+
+	// The dialed nodes know no addresses
+	silent := localSender{rcv: &ReceiverRPC{}}
+	var mtx sync.Mutex
+	dials := make(map[Addr]int)
+	failing := map[Addr]error{}
+	c.dial = func(addr Addr, _ *LocalNode) (Peer, error) {
+		mtx.Lock()
+		defer mtx.Unlock()
+
+		dials[addr]++
+		if err, ok := failing[addr]; ok {
+			return Peer{}, err
+		}
+		return Peer{Sender: silent, addr: addr}, nil
+	}
+
+	good, bad := Addr{IP: "9.0.0.1", Port: "2022"}, Addr{IP: "9.0.0.2", Port: "2022"}
+	failing[bad] = errors.New("connection refused")
+
+	c.AddAddrs([]KnownAddr{
+		{Addr: good, LastSeen: now.Unix()},
+		{Addr: bad, LastSeen: now.Add(time.Hour).Unix()},
+		{Addr: self, LastSeen: now.Unix()},
+		{Addr: Addr{IP: "0.0.0.0", Port: "2022"}, LastSeen: now.Unix()},
+		{Addr: Addr{IP: "9.0.0.3"}, LastSeen: now.Unix()},
+		{Addr: Addr{IP: "9.0.0.4", Port: "2022"}, LastSeen: now.Add(-_addrHorizon * 2).Unix()},
+	}, Addr{IP: "9.9.9.9", Port: "2022"})
+	require.Len(t, book.addrs, 2, "only the reachable, recently seen addresses of other nodes should be kept")
+	assert.Equal(t, now.Unix(), book.addrs[bad].lastSeen, "the last seen time shouldn't be in the future")
+
+	c.dialDue()
+	assert.Equal(t, map[Addr]int{good: 1, bad: 1}, dials)
+	assert.Equal(t, []Peer{{Sender: silent, addr: good}}, pool.Peers())
+	assert.True(t, book.addrs[good].tried, "the connected address should be moved to the tried buckets")
+
+	c.dialDue()
+	assert.Equal(t, map[Addr]int{good: 1, bad: 1}, dials, "connected and backed off addresses shouldn't be dialed")
+
+	for attempt := 2; attempt <= _maxDialAttempts; attempt++ {
+		now = now.Add(dialBackoff(attempt - 1))
+		c.dialDue()
+		assert.Equal(t, attempt, dials[bad])
+	}
+	assert.NotContains(t, book.addrs, bad, "the address should be forgotten after too many failures")
+
+	c.Connect(bad)
+	failing[bad] = fmt.Errorf("on a handshake: %w", ErrChainMismatch)
+	c.dialDue()
+	assert.NotContains(t, book.addrs, bad, "incompatible nodes should be forgotten at once")
+
+	assert.Equal(t, _dialBackoffBase*4, dialBackoff(3))
+	assert.Equal(t, _dialBackoffMax, dialBackoff(100))
+
+	t.Run("exchange", func(t *testing.T) {
+		remote := NewReceiverRPC(newTestBlockchain(t), NewMempool(DefaultMempoolConfig, logger), NewPeerPool(logger, 0),
+			Addr{IP: "127.0.0.1", Port: "8091"}, logger)
+		remoteBook := newTestAddrBook(t)
+		remote.SetConnManager(NewConnManager(NewPeerPool(logger, 0), remote.LocalNode(), remoteBook, DefaultConnLimits, logger))
+
+		for i := 0; i < MaxAddrsPerReply*2; i++ {
+			remote.connMgr.Connect(Addr{IP: fmt.Sprintf("%d.%d.0.1", 11+i/256, i%256), Port: "2022"})
+		}
+
+		remote.connMgr.dial = func(Addr, *LocalNode) (Peer, error) {
+			return Peer{}, errors.New("connection refused")
+		}
+		conn := &fakeConn{remote: &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 50000}}
+		inbound, _, err := remote.serveConn(conn)
+		require.NoError(t, err)
+		_, _, err = handshake(localSender{rcv: inbound}, remote.LocalNode().ListenAddr, c.local)
+		require.NoError(t, err)
+		require.Contains(t, remoteBook.addrs, self, "the dialing node's listen address should be learned")
+		assert.Equal(t, Addr{IP: "203.0.113.7", Port: "50000"}, remoteBook.addrs[self].src,
+			"the address should be learned from where the connection comes from")
+
+		var resp PeersDiscoveryResp
+		require.NoError(t, remote.HandlePeersDiscovery(Empty{}, &resp))
+		assert.Len(t, resp.Addrs, MaxAddrsPerReply)
+
+		pool.Add(Peer{Sender: localSender{rcv: remote}, addr: Addr{IP: "127.0.0.1", Port: "8091"}})
+		c.discoverAddrs()
+
+		// A single source only fills a few buckets, so some addresses may be evicted
+		newAddrs, _ := book.Size()
+		assert.Greater(t, newAddrs, MaxAddrsPerReply*3/4, "the advertised addresses should be learned")
+		assert.NotContains(t, book.addrs, self)
+		for addr, e := range book.addrs {
+			if !e.tried {
+				assert.Equal(t, Addr{IP: "127.0.0.1", Port: "8091"}, e.src, "%s should be learned from the peer", addr)
+			}
+		}
+	})
+}
+
+func TestBootstrap(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+	seed := Addr{IP: "9.0.0.1", Port: "2022"}
+
+	seedRcv := NewReceiverRPC(newTestBlockchain(t), NewMempool(DefaultMempoolConfig, logger), NewPeerPool(logger, 0), seed, logger)
+	seedRcv.SetConnManager(NewConnManager(NewPeerPool(logger, 0), seedRcv.LocalNode(), newTestAddrBook(t), DefaultConnLimits, logger))
+	for i := 0; i < 10; i++ {
+		seedRcv.connMgr.Connect(Addr{IP: fmt.Sprintf("%d.0.0.1", 11+i), Port: "2022"})
+	}
+
+	pool := NewPeerPool(logger, 0)
+	book := newTestAddrBook(t)
+	c := NewConnManager(pool, NewLocalNode(newTestBlockchain(t), Addr{IP: "127.0.0.1", Port: "8090"}), book, DefaultConnLimits, logger)
+	c.dial = func(addr Addr, _ *LocalNode) (Peer, error) {
+		if addr != seed {
+			return Peer{}, errors.New("connection refused")
+		}
+		return Peer{Sender: localSender{rcv: seedRcv}, addr: addr}, nil
+	}
+
+	c.Bootstrap([]Addr{seed, {IP: "9.0.0.2", Port: "2022"}})
+
+	newAddrs, triedAddrs := book.Size()
+	assert.Equal(t, 10, newAddrs, "the addresses known to the seed should be learned")
+	assert.Equal(t, 1, triedAddrs)
+	assert.True(t, book.addrs[seed].tried, "the seed should be added to the book")
+	assert.Zero(t, pool.NumberOfPeers(), "the seeds are only queried")
+}
+
+func TestPersistentPeers(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+	pool := NewPeerPool(logger, 0)
+	book := newTestAddrBook(t)
+	now := time.Unix(1_000_000, 0)
+	book.now = func() time.Time { return now }
+
+	c := NewConnManager(pool, NewLocalNode(newTestBlockchain(t), Addr{IP: "127.0.0.1", Port: "8090"}), book, DefaultConnLimits, logger)
+	persistent := Addr{IP: "9.0.0.1", Port: "2022"}
+	c.AddPersistent(persistent)
+
+	var (
+		dials int
+		up    bool
+	)
+	c.dial = func(addr Addr, _ *LocalNode) (Peer, error) {
+		dials++
+		if !up {
+			return Peer{}, fmt.Errorf("on a handshake: %w", ErrChainMismatch)
+		}
+		return Peer{Sender: localSender{rcv: &ReceiverRPC{}}, addr: addr}, nil
+	}
+
+	for attempt := 1; attempt <= _maxDialAttempts*2; attempt++ {
+		c.dialDue()
+		assert.Equal(t, attempt, dials, "the persistent peer should never be given up on")
+		c.dialDue()
+		assert.Equal(t, attempt, dials, "the persistent peer should back off")
+		now = now.Add(dialBackoff(attempt))
+	}
+
+	up = true
+	c.dialDue()
+	assert.Equal(t, 1, pool.NumberOfPeers())
+	assert.Zero(t, c.persistent[persistent].attempts)
+
+	c.dialDue()
+	assert.Equal(t, _maxDialAttempts*2+1, dials, "the connected peer shouldn't be redialed")
+}
+
+func TestOutboundTarget(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+	pool := NewPeerPool(logger, 0)
+	book := newTestAddrBook(t)
+	now := time.Unix(1_000_000, 0)
+	book.now = func() time.Time { return now }
+
+	c := NewConnManager(pool, NewLocalNode(newTestBlockchain(t), Addr{IP: "127.0.0.1", Port: "8090"}), book,
+		ConnLimits{TargetOutbound: 3}, logger)
+	var (
+		mtx   sync.Mutex
+		dials int
+	)
+	c.dial = func(addr Addr, _ *LocalNode) (Peer, error) {
+		mtx.Lock()
+		defer mtx.Unlock()
+
+		dials++
+		return Peer{Sender: localSender{rcv: &ReceiverRPC{}}, addr: addr}, nil
+	}
+
+	c.AddPersistent(Addr{IP: "9.0.0.1", Port: "2022"})
+	pool.Add(Peer{addr: Addr{IP: "9.0.0.2", Port: "2022"}, inbound: true})
+	for i := 0; i < 10; i++ {
+		c.Connect(Addr{IP: fmt.Sprintf("%d.0.0.1", 11+i), Port: "2022"})
+	}
+
+	c.dialDue()
+	assert.Equal(t, 4, dials, "the persistent and the inbound peers shouldn't be counted")
+	assert.Equal(t, 5, pool.NumberOfPeers())
+
+	c.dialDue()
+	assert.Equal(t, 4, dials, "no more peers should be dialed once the target is reached")
+
+	for _, p := range pool.Peers() {
+		if _, isPersistent := c.persistent[p.Addr()]; !isPersistent && !p.Inbound() {
+			pool.Remove(p.Addr())
+			break
+		}
+	}
+	c.dialDue()
+	assert.Equal(t, 5, dials, "the lost outbound peer should be replaced")
+	assert.Equal(t, 5, pool.NumberOfPeers())
+}
+
+// fakeConn is an inbound connection from the remote address
+type fakeConn struct {
+	net.Conn
+	remote net.Addr
+
+	mtx    sync.Mutex
+	closed bool
+}
+
+func (f *fakeConn) RemoteAddr() net.Addr {
+	return f.remote
+}
+
+func (f *fakeConn) Close() error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	f.closed = true
+	return nil
+}
+
+func (f *fakeConn) isClosed() bool {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	return f.closed
+}
+
+func TestInboundPeers(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+	pool := NewPeerPool(logger, 0)
+	book := newTestAddrBook(t)
+	now := time.Unix(1_000_000, 0)
+	book.now = func() time.Time { return now }
+
+	rcv := NewReceiverRPC(newTestBlockchain(t), NewMempool(DefaultMempoolConfig, logger), pool,
+		Addr{IP: "127.0.0.1", Port: "8090"}, logger)
+	c := NewConnManager(pool, rcv.LocalNode(), book, ConnLimits{MaxInbound: 2}, logger)
+	rcv.SetConnManager(c)
+
+	// The inbound nodes are dialed back at their listen addresses
+	var mtx sync.Mutex
+	nodes := make(map[Addr]NodeInfo)
+	c.dial = func(addr Addr, _ *LocalNode) (Peer, error) {
+		mtx.Lock()
+		defer mtx.Unlock()
+
+		return Peer{Sender: localSender{rcv: &ReceiverRPC{}}, addr: addr, info: nodes[addr]}, nil
+	}
+
+	// open makes a connection to this node from the IP
+	open := func(ip string) (*inboundReceiver, *fakeConn, func(), error) {
+		conn := &fakeConn{remote: &net.TCPAddr{IP: net.ParseIP(ip), Port: 50000}}
+		r, done, err := rcv.serveConn(conn)
+		now = now.Add(time.Minute)
+		if err != nil {
+			return nil, conn, nil, err
+		}
+
+		return r.(*inboundReceiver), conn, done, nil
+	}
+	// introduce makes a handshake as a node listening at the IP
+	introduce := func(r *inboundReceiver, ip string, params *ChainParams) error {
+		listen := Addr{IP: ip, Port: "2022"}
+		info := NewLocalNode(newTestBlockchainWithParams(t, params), listen).Info()
+		mtx.Lock()
+		nodes[listen] = info
+		mtx.Unlock()
+
+		var resp HandshakeResp
+		require.NoError(t, r.HandleHandshake(HandshakeReq{Info: info}, &resp))
+		return resp.Err()
+	}
+	connect := func(ip string) (*inboundReceiver, *fakeConn, func(), error) {
+		r, conn, done, err := open(ip)
+		if err != nil {
+			return nil, conn, nil, err
+		}
+
+		return r, conn, done, introduce(r, ip, &DefaultChainParams)
+	}
+	inboundPeers := func() []string {
+		var ips []string
+		for _, p := range pool.Peers() {
+			if p.Inbound() {
+				ips = append(ips, p.Addr().IP)
+			}
+		}
+		sort.Strings(ips)
+		return ips
+	}
+	eventually := func(ips ...string) {
+		assert.Eventually(t, func() bool {
+			return assert.ObjectsAreEqual(ips, inboundPeers())
+		}, time.Second, time.Millisecond*10, "the inbound peers should be %v", ips)
+	}
+
+	t.Run("handshake", func(t *testing.T) {
+		r, conn, done, err := open("9.8.0.1")
+		require.NoError(t, err)
+		defer done()
+
+		assert.ErrorIs(t, r.HandleIsAlive(Empty{}, &Empty{}), ErrNoHandshake, "nothing should be served before the handshake")
+		assert.ErrorIs(t, r.HandlePeersDiscovery(Empty{}, &PeersDiscoveryResp{}), ErrNoHandshake)
+
+		params := DefaultChainParams
+		params.ChainID++
+		assert.ErrorIs(t, introduce(r, "9.8.0.1", &params), ErrPeerRejected)
+		assert.Eventually(t, conn.isClosed, _rejectLinger*2, time.Millisecond*10,
+			"the connection should be closed once the peer is rejected")
+	})
+
+	a, _, _, err := connect("9.0.0.1")
+	require.NoError(t, err)
+	assert.NoError(t, a.HandleIsAlive(Empty{}, &Empty{}))
+
+	newAddrs, triedAddrs := book.Size()
+	info := NewLocalNode(newTestBlockchain(t), Addr{IP: "9.0.1.1", Port: "2022"}).Info()
+	assert.ErrorIs(t, a.HandleHandshake(HandshakeReq{Info: info}, &HandshakeResp{}), ErrDuplicateHandshake)
+	newAfter, triedAfter := book.Size()
+	assert.Equal(t, newAddrs+triedAddrs, newAfter+triedAfter, "a repeated handshake shouldn't add addresses")
+	_, bConn, bDone, err := connect("9.1.0.1")
+	require.NoError(t, err)
+	eventually("9.0.0.1", "9.1.0.1")
+
+	outbound := Addr{IP: "9.9.0.1", Port: "2022"}
+	pool.Add(Peer{addr: outbound})
+	_, reverseConn, _, err := connect(outbound.IP)
+	require.NoError(t, err, "the connections made back by the outbound peers shouldn't take the inbound slots")
+	assert.False(t, reverseConn.isClosed())
+	assert.False(t, bConn.isClosed())
+
+	d, _, dDone, err := connect("9.2.0.1")
+	require.NoError(t, err, "a new peer should make room for itself")
+	assert.True(t, bConn.isClosed(), "the newest of the not protected peers should be evicted")
+	eventually("9.0.0.1", "9.2.0.1")
+	bDone()
+
+	c.touch(a.session, func(s *inboundSession, now time.Time) { s.lastBlock = now })
+	c.touch(d.session, func(s *inboundSession, now time.Time) { s.lastTx = now })
+	_, _, _, err = open("9.3.0.1")
+	assert.ErrorIs(t, err, ErrTooManyPeers, "the peers relaying blocks and transactions should be protected")
+	_, _, _, err = open(outbound.IP)
+	assert.ErrorIs(t, err, ErrTooManyPeers, "an outbound peer should only make a single connection back")
+
+	dDone()
+	eventually("9.0.0.1")
+	_, _, _, err = connect("9.4.0.1")
+	require.NoError(t, err, "the closed connection should free the slot")
+	eventually("9.0.0.1", "9.4.0.1")
+}
+
+func TestSelectEviction(t *testing.T) {
+	start := time.Unix(1_000_000, 0)
+	var sessions []*inboundSession
+	session := func(ip string) *inboundSession {
+		s := &inboundSession{
+			remote:    Addr{IP: ip, Port: "50000"},
+			connected: start.Add(time.Minute * time.Duration(len(sessions))),
+		}
+		sessions = append(sessions, s)
+		return s
+	}
+
+	session("9.0.0.1")
+	session("9.1.0.1")
+	session("9.2.0.1")
+	session("9.3.0.1")
+	session("9.1.0.2")
+	b3 := session("9.1.0.3")
+	session("9.0.0.2")
+	c2 := session("9.2.0.2")
+
+	assert.Same(t, b3, selectEviction(sessions), "the newest peer of the largest group should be evicted")
+
+	b3.lastBlock = start
+	assert.Same(t, c2, selectEviction(sessions), "the newest peer should be evicted if the groups are equal")
+
+	sessions[0].lastTx = start
+	assert.Nil(t, selectEviction(sessions[:1]), "the peer relaying transactions should be protected")
+	assert.Nil(t, selectEviction(nil))
+}
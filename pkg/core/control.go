@@ -0,0 +1,88 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/rpc"
+
+	"github.com/meddion/pkg/crypto"
+)
+
+const MaxGenerateBlocks = 1000
+
+var (
+	ErrMiningOnDemandDisabled = errors.New("mining on demand is disabled on the network")
+	ErrInvalidBlockCount      = errors.New("invalid block count")
+)
+
+// ControlRPC serves the requests of the node operator rather than of peers.
+// It is served on its own listener the peers can't reach, see NewControlServer.
+type ControlRPC struct {
+	blkchain *Blockchain
+	miner    *Miner
+}
+
+func NewControlRPC(blkchain *Blockchain, miner *Miner) *ControlRPC {
+	return &ControlRPC{
+		blkchain: blkchain,
+		miner:    miner,
+	}
+}
+
+// HandleGenerate mines the requested number of blocks on top of the main chain
+// one after another. Only the networks with MineBlocksOnDemand allow that.
+func (c *ControlRPC) HandleGenerate(req GenerateReq, resp *GenerateResp) error {
+	if !c.blkchain.params.MineBlocksOnDemand {
+		return ErrMiningOnDemandDisabled
+	}
+
+	if req.Count < 1 || req.Count > MaxGenerateBlocks {
+		return fmt.Errorf("%w: %d", ErrInvalidBlockCount, req.Count)
+	}
+
+	for len(resp.Hashes) < req.Count {
+		block, err := c.miner.MineBlock(context.Background())
+		if errors.Is(err, ErrStaleTemplate) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		hash, err := block.Header.Checksum()
+		if err != nil {
+			return err
+		}
+		resp.Hashes = append(resp.Hashes, hash)
+	}
+
+	return nil
+}
+
+type ControlClient struct {
+	client *rpc.Client
+}
+
+func NewControlClient(addr Addr) (*ControlClient, error) {
+	c, err := rpc.DialHTTPPath("tcp", addr.String(), _rpcPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ControlClient{client: c}, nil
+}
+
+// Generate asks the node to mine count blocks and returns their hashes.
+func (c *ControlClient) Generate(count int) ([]crypto.HashValue, error) {
+	var resp GenerateResp
+	if err := c.client.Call("ControlRPC.HandleGenerate", GenerateReq{Count: count}, &resp); err != nil {
+		return nil, err
+	}
+
+	return resp.Hashes, nil
+}
+
+func (c *ControlClient) Close() error {
+	return c.client.Close()
+}
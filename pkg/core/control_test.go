@@ -0,0 +1,39 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerate(t *testing.T) {
+	blkchain := newTestBlockchainWithParams(t, &RegtestChainParams)
+	control := NewControlRPC(blkchain, newTestMiner(t, blkchain, 1))
+
+	var resp GenerateResp
+	require.NoError(t, control.HandleGenerate(GenerateReq{Count: 20}, &resp))
+	require.Len(t, resp.Hashes, 20)
+
+	tip, height := blkchain.BestBlock()
+	assert.Equal(t, 20, height)
+	assert.Equal(t, resp.Hashes[19], tip)
+	assert.Equal(t, RegtestChainParams.Genesis.Bits, blkchain.NextBits(), "regtest difficulty shouldn't change")
+
+	err := control.HandleGenerate(GenerateReq{Count: 0}, &GenerateResp{})
+	assert.ErrorIs(t, err, ErrInvalidBlockCount)
+
+	devnet := newTestBlockchain(t)
+	err = NewControlRPC(devnet, newTestMiner(t, devnet, 1)).HandleGenerate(GenerateReq{Count: 1}, &GenerateResp{})
+	assert.ErrorIs(t, err, ErrMiningOnDemandDisabled)
+}
+
+func TestNetworkParams(t *testing.T) {
+	params, err := NetworkParams("regtest")
+	require.NoError(t, err)
+	assert.Same(t, &RegtestChainParams, params)
+	assert.NoError(t, params.Validate())
+
+	_, err = NetworkParams("mainnet")
+	assert.ErrorIs(t, err, ErrUnknownNetwork)
+}
@@ -7,26 +7,23 @@ import (
 	"github.com/meddion/pkg/crypto"
 )
 
-var (
-	_genesisBlock     Block
-	_genesisBlockHash crypto.HashValue
-)
-
+// getGenesisPair returns the genesis block of DefaultChainParams and its hash.
 func getGenesisPair() (crypto.HashValue, Block) {
-	if _genesisBlock.Nonce != 0 {
-		return _genesisBlockHash, _genesisBlock
+	hash, err := DefaultChainParams.GenesisHash()
+	if err != nil {
+		panic(fmt.Sprintf("on hashing a genesis block: %v", err))
 	}
 
-	var err error
-	if _genesisBlock, err = genGenesisBlock(); err != nil {
-		panic(fmt.Sprintf("on creating a genesis block: %v", err))
-	}
+	return hash, DefaultChainParams.Genesis
+}
 
-	if _genesisBlockHash, err = _genesisBlock.Header.Checksum(); err != nil {
-		panic(fmt.Sprintf("on hashing a genesis block: %v", err))
+func defaultGenesisBlock() Block {
+	block, err := genGenesisBlock()
+	if err != nil {
+		panic(fmt.Sprintf("on creating a genesis block: %v", err))
 	}
 
-	return _genesisBlockHash, _genesisBlock
+	return block
 }
 
 func genGenesisBlock() (Block, error) {
@@ -45,7 +42,7 @@ func genGenesisBlock() (Block, error) {
 		Timestamp:     time.Date(2021, time.February, 24, 0, 0, 0, 0, time.UTC).Unix(),
 		PrevBlockHash: ghash,
 		MerkleRoot:    mroot,
-		Nonce:         2068160, // difficalty = 21
+		Nonce:         131490, // difficalty = 21
 	}
 	// nonce, err := genPowNonce(header, getPowTarget())
 	// if err != nil {
@@ -59,3 +56,21 @@ func genGenesisBlock() (Block, error) {
 		Body:   Body{},
 	}, nil
 }
+
+func regtestGenesisBlock() Block {
+	mroot, err := merkleRoot(LatestBlockVersion, Body{})
+	if err != nil {
+		panic(fmt.Sprintf("on creating a regtest genesis block: %v", err))
+	}
+
+	return Block{
+		Header: Header{
+			Version:    LatestBlockVersion,
+			Timestamp:  time.Date(2022, time.January, 1, 0, 0, 0, 0, time.UTC).Unix(),
+			MerkleRoot: mroot,
+			Bits:       Difficulty(1).Bits(),
+			Nonce:      0,
+		},
+		Body: Body{},
+	}
+}
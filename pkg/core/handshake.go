@@ -0,0 +1,197 @@
+package core
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/meddion/pkg/crypto"
+)
+
+const (
+	// ProtocolVersion is the version of the peer protocol this node speaks
+	ProtocolVersion uint32 = 1
+	// MinProtocolVersion is the oldest version this node still talks to
+	MinProtocolVersion uint32 = 1
+)
+
+var (
+	ErrIncompatiblePeer = errors.New("incompatible peer")
+	// All match ErrIncompatiblePeer with errors.Is
+	ErrProtocolVersion = fmt.Errorf("%w: unsupported protocol version", ErrIncompatiblePeer)
+	ErrChainMismatch   = fmt.Errorf("%w: different chain ID", ErrIncompatiblePeer)
+	ErrPeerGenesis     = fmt.Errorf("%w: different genesis block", ErrIncompatiblePeer)
+	ErrSelfConnection  = fmt.Errorf("%w: connected to self", ErrIncompatiblePeer)
+
+	ErrPeerRejected = errors.New("rejected by peer")
+)
+
+// Services are the optional parts of the protocol a node serves
+type Services uint64
+
+const (
+	// Serves blocks and headers to the syncing peers
+	ServiceBlocks Services = 1 << iota
+	// Serves the transaction inclusion proofs
+	ServiceTxProofs
+)
+
+// Has reports whether all the services of s are provided.
+func (s Services) Has(services Services) bool {
+	return s&services == services
+}
+
+// NodeID tells the nodes apart regardless of their addresses.
+// It is generated anew on every start.
+type NodeID uint64
+
+func (id NodeID) String() string {
+	return fmt.Sprintf("%016x", uint64(id))
+}
+
+// NodeInfo is what the nodes tell about themselves during the handshake
+type NodeInfo struct {
+	Version     uint32
+	ID          NodeID
+	ListenAddr  Addr
+	Services    Services
+	ChainID     uint32
+	GenesisHash crypto.HashValue
+	BestHeight  int
+	Timestamp   int64
+}
+
+type (
+	HandshakeReq struct {
+		Info NodeInfo
+	}
+
+	// HandshakeResp carries the info of the responding node.
+	// Reject holds the reason the handshake was refused for.
+	HandshakeResp struct {
+		Info   NodeInfo
+		Reject string
+	}
+)
+
+// Err returns the rejection reason as an error matching ErrPeerRejected.
+func (r HandshakeResp) Err() error {
+	if r.Reject == "" {
+		return nil
+	}
+
+	return fmt.Errorf("%w: %s", ErrPeerRejected, r.Reject)
+}
+
+// LocalNode describes this node to its peers and checks what they tell
+// about themselves.
+type LocalNode struct {
+	ID         NodeID
+	ListenAddr Addr
+	Services   Services
+	blkchain   *Blockchain
+}
+
+func NewLocalNode(blkchain *Blockchain, listenAddr Addr) *LocalNode {
+	return &LocalNode{
+		ID:         newNodeID(),
+		ListenAddr: listenAddr,
+		Services:   ServiceBlocks | ServiceTxProofs,
+		blkchain:   blkchain,
+	}
+}
+
+func newNodeID() NodeID {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(fmt.Sprintf("on generating a node ID: %v", err))
+	}
+
+	return NodeID(binary.BigEndian.Uint64(b[:]))
+}
+
+// Info returns the current state of the node.
+func (n *LocalNode) Info() NodeInfo {
+	_, height := n.blkchain.BestBlock()
+
+	return NodeInfo{
+		Version:     ProtocolVersion,
+		ID:          n.ID,
+		ListenAddr:  n.ListenAddr,
+		Services:    n.Services,
+		ChainID:     n.blkchain.params.ChainID,
+		GenesisHash: n.blkchain.genesisHash,
+		BestHeight:  height,
+		Timestamp:   time.Now().Unix(),
+	}
+}
+
+// Check returns the reason the remote node can't be talked to, if any.
+func (n *LocalNode) Check(remote NodeInfo) error {
+	local := n.Info()
+
+	switch {
+	case remote.ID == local.ID:
+		return ErrSelfConnection
+	case remote.Version < MinProtocolVersion:
+		return fmt.Errorf("%w: %d is older than %d", ErrProtocolVersion, remote.Version, MinProtocolVersion)
+	case remote.ChainID != local.ChainID:
+		return fmt.Errorf("%w: %d instead of %d", ErrChainMismatch, remote.ChainID, local.ChainID)
+	case remote.GenesisHash != local.GenesisHash:
+		return fmt.Errorf("%w: %x instead of %x", ErrPeerGenesis, remote.GenesisHash, local.GenesisHash)
+	}
+
+	return nil
+}
+
+// addTimeSample records the clock of a compatible peer dialed at addr.
+// The samples are keyed by the network group of the address rather than
+// by the node ID the peer picks, so reconnecting can't add more of them.
+func (n *LocalNode) addTimeSample(addr Addr, remote NodeInfo) {
+	n.blkchain.timeSource.AddTimeSample(addrGroup(addr), time.Unix(remote.Timestamp, 0))
+}
+
+// negotiate returns the version both nodes speak.
+func negotiate(local, remote NodeInfo) uint32 {
+	if remote.Version < local.Version {
+		return remote.Version
+	}
+
+	return local.Version
+}
+
+// handshake introduces the local node to the remote one dialed at addr and
+// checks the reply. The remote info is returned along with the negotiated
+// version. Only the clocks of the dialed nodes are sampled.
+func handshake(s Sender, addr Addr, local *LocalNode) (NodeInfo, uint32, error) {
+	info := local.Info()
+
+	resp, err := s.SendHandshake(HandshakeReq{Info: info})
+	if err != nil {
+		return NodeInfo{}, 0, err
+	}
+
+	if err := local.Check(resp.Info); err != nil {
+		return NodeInfo{}, 0, err
+	}
+	local.addTimeSample(addr, resp.Info)
+
+	return resp.Info, negotiate(info, resp.Info), nil
+}
+
+// HandleHandshake checks the dialing node and replies with the info of
+// this node. A refusal isn't an RPC error: it is reported through
+// resp.Reject, see SenderRPC.SendHandshake.
+func (r *ReceiverRPC) HandleHandshake(req HandshakeReq, resp *HandshakeResp) error {
+	resp.Info = r.node.Info()
+
+	if err := r.node.Check(req.Info); err != nil {
+		r.logger.Printf("On a handshake with %s (%s): %s", req.Info.ListenAddr, req.Info.ID, err)
+		resp.Reject = err.Error()
+		return nil
+	}
+
+	return nil
+}
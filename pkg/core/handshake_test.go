@@ -0,0 +1,68 @@
+package core
+
+import (
+	"io"
+	"log"
+	"testing"
+
+	"github.com/meddion/pkg/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandshake(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	remoteChain := newTestBlockchain(t)
+	require.NoError(t, remoteChain.ProcessBlock(mineTestBlock(t, DefaultChainParams.Genesis, 1)))
+	remote := NewReceiverRPC(remoteChain, NewMempool(DefaultMempoolConfig, logger), NewPeerPool(logger, 0), Addr{IP: "127.0.0.1", Port: "8090"}, logger)
+
+	local := NewLocalNode(newTestBlockchain(t), Addr{IP: "127.0.0.1", Port: "8091"})
+
+	info, version, err := handshake(localSender{rcv: remote}, Addr{IP: "127.0.0.1", Port: "8090"}, local)
+	require.NoError(t, err)
+	assert.Equal(t, ProtocolVersion, version)
+	assert.Equal(t, remote.LocalNode().ID, info.ID)
+	assert.Equal(t, Addr{IP: "127.0.0.1", Port: "8090"}, info.ListenAddr)
+	assert.Equal(t, 1, info.BestHeight)
+
+	assert.Contains(t, local.blkchain.timeSource.samples, addrGroup(Addr{IP: "127.0.0.1", Port: "8090"}),
+		"the clock of the dialed node should be sampled by its address group")
+	assert.Empty(t, remoteChain.timeSource.samples, "the clocks of the inbound peers shouldn't be sampled")
+
+	t.Run("incompatible", func(t *testing.T) {
+		for _, c := range []struct {
+			change func(*NodeInfo)
+			err    error
+		}{
+			{func(i *NodeInfo) { i.ID = local.ID }, ErrSelfConnection},
+			{func(i *NodeInfo) { i.Version = MinProtocolVersion - 1 }, ErrProtocolVersion},
+			{func(i *NodeInfo) { i.ChainID++ }, ErrChainMismatch},
+			{func(i *NodeInfo) { i.GenesisHash = crypto.HashValue{1} }, ErrPeerGenesis},
+		} {
+			remoteInfo := info
+			c.change(&remoteInfo)
+
+			err := local.Check(remoteInfo)
+			assert.ErrorIs(t, err, c.err)
+			assert.ErrorIs(t, err, ErrIncompatiblePeer)
+
+			if c.err == ErrSelfConnection {
+				continue
+			}
+
+			localInfo := local.Info()
+			c.change(&localInfo)
+
+			var resp HandshakeResp
+			require.NoError(t, remote.HandleHandshake(HandshakeReq{Info: localInfo}, &resp))
+			assert.ErrorIs(t, resp.Err(), ErrPeerRejected, "the remote side should reject the peer too")
+			assert.Contains(t, resp.Reject, c.err.Error())
+		}
+	})
+
+	newer := info
+	newer.Version = ProtocolVersion + 1
+	assert.NoError(t, local.Check(newer), "newer peers should be accepted")
+	assert.Equal(t, ProtocolVersion, negotiate(local.Info(), newer))
+}
@@ -0,0 +1,423 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"time"
+)
+
+var (
+	ErrTooManyPeers       = errors.New("too many inbound peers")
+	ErrNoHandshake        = errors.New("no handshake made")
+	ErrDuplicateHandshake = errors.New("handshake is already made")
+)
+
+const (
+	// The inbound peers protected from the eviction by each of the criteria,
+	// see selectEviction
+	_protectedByBlocks = 4
+	_protectedByTxs    = 4
+	// Connections making no handshake in that time are closed
+	_handshakeTimeout = time.Second * 10
+	// Lets a rejected peer get the reason before the connection is closed
+	_rejectLinger = time.Second
+)
+
+// inboundSession is a connection made to this node.
+type inboundSession struct {
+	conn      io.Closer
+	remote    Addr
+	connected time.Time
+	// The outbound peer that made the connection back, if any.
+	// Such connections don't take the inbound slots.
+	outbound Addr
+
+	// Set by the handshake
+	info       NodeInfo
+	handshaked bool
+	// When the peer last relayed a novel block or transaction
+	lastBlock, lastTx time.Time
+	// Set once the peer is dialed back and added to the pool
+	peer bool
+}
+
+// serveConn returns the Receiver serving the connection and the func
+// to call once the connection is closed. An error is returned if
+// the connection is to be refused.
+func (r *ReceiverRPC) serveConn(conn net.Conn) (Receiver, func(), error) {
+	if r.connMgr == nil {
+		return r, func() {}, nil
+	}
+
+	session, err := r.connMgr.acceptInbound(conn)
+	if err != nil {
+		r.logger.Printf("On accepting a connection from %s: %s", conn.RemoteAddr(), err)
+		return nil, nil, err
+	}
+
+	return &inboundReceiver{ReceiverRPC: r, session: session}, func() { r.connMgr.inboundClosed(session) }, nil
+}
+
+// inboundReceiver serves a single inbound connection. Nothing but
+// the handshake is served until the handshake succeeds. It tells
+// the ConnManager about the handshake and the relays made over it.
+type inboundReceiver struct {
+	*ReceiverRPC
+	session *inboundSession
+}
+
+var _ Receiver = &inboundReceiver{}
+
+// HandleHandshake closes the connection if the peer is rejected. Only one
+// handshake is made per connection. The listen address the peer advertises
+// is passed to the ConnManager, the address the connection comes from is its source.
+func (r *inboundReceiver) HandleHandshake(req HandshakeReq, resp *HandshakeResp) error {
+	if r.checkHandshake() == nil {
+		return ErrDuplicateHandshake
+	}
+
+	if err := r.ReceiverRPC.HandleHandshake(req, resp); err != nil {
+		return err
+	}
+
+	if resp.Reject != "" {
+		time.AfterFunc(_rejectLinger, func() { r.session.conn.Close() })
+		return nil
+	}
+
+	// Concurrent handshakes might have passed the check above
+	if !r.connMgr.handshake(r.session, req.Info) {
+		return ErrDuplicateHandshake
+	}
+	r.connMgr.AddAddrs([]KnownAddr{{Addr: req.Info.ListenAddr, LastSeen: time.Now().Unix()}}, r.session.remote)
+
+	return nil
+}
+
+func (r *inboundReceiver) HandleTransaction(req TransactionReq, resp *TransactionResp) error {
+	if err := r.checkHandshake(); err != nil {
+		return err
+	}
+
+	err := r.ReceiverRPC.HandleTransaction(req, resp)
+	if err == nil && resp.Status && resp.Msg != ErrTxAlreadyKnown.Error() {
+		r.connMgr.touch(r.session, func(s *inboundSession, now time.Time) { s.lastTx = now })
+	}
+
+	return err
+}
+
+func (r *inboundReceiver) HandleBlock(req BlockReq, resp *Empty) error {
+	if err := r.checkHandshake(); err != nil {
+		return err
+	}
+
+	err := r.ReceiverRPC.handleBlock(req.Block, r.connMgr.poolAddr(r.session))
+	if err == nil {
+		r.connMgr.touch(r.session, func(s *inboundSession, now time.Time) { s.lastBlock = now })
+	}
+
+	return err
+}
+
+func (r *inboundReceiver) HandleIsAlive(req Empty, resp *Empty) error {
+	if err := r.checkHandshake(); err != nil {
+		return err
+	}
+
+	return r.ReceiverRPC.HandleIsAlive(req, resp)
+}
+
+func (r *inboundReceiver) HandlePeersDiscovery(req Empty, resp *PeersDiscoveryResp) error {
+	if err := r.checkHandshake(); err != nil {
+		return err
+	}
+
+	return r.ReceiverRPC.HandlePeersDiscovery(req, resp)
+}
+
+func (r *inboundReceiver) HandleGetBlocks(req GetBlocksReq, resp *BlocksResp) error {
+	if err := r.checkHandshake(); err != nil {
+		return err
+	}
+
+	return r.ReceiverRPC.HandleGetBlocks(req, resp)
+}
+
+func (r *inboundReceiver) HandleGetHeaders(req GetHeadersReq, resp *HeadersResp) error {
+	if err := r.checkHandshake(); err != nil {
+		return err
+	}
+
+	return r.ReceiverRPC.HandleGetHeaders(req, resp)
+}
+
+func (r *inboundReceiver) HandleGetTxProof(req GetTxProofReq, resp *TxProofResp) error {
+	if err := r.checkHandshake(); err != nil {
+		return err
+	}
+
+	return r.ReceiverRPC.HandleGetTxProof(req, resp)
+}
+
+func (r *inboundReceiver) checkHandshake() error {
+	r.connMgr.mtx.Lock()
+	defer r.connMgr.mtx.Unlock()
+
+	if !r.session.handshaked {
+		return ErrNoHandshake
+	}
+
+	return nil
+}
+
+// acceptInbound takes an inbound slot for the connection, evicting another
+// inbound peer if there is none left. The connections made back by
+// the outbound peers are told by the address they come from, one per
+// outbound peer, and don't take the slots.
+func (c *ConnManager) acceptInbound(conn net.Conn) (*inboundSession, error) {
+	session := &inboundSession{
+		conn:      conn,
+		remote:    remoteAddr(conn),
+		connected: c.book.now(),
+	}
+
+	var outbound []Addr
+	for _, p := range c.pool.Peers() {
+		if !p.Inbound() {
+			outbound = append(outbound, p.Addr())
+		}
+	}
+
+	c.mtx.Lock()
+	var victim *inboundSession
+	if addr, isReverse := c.reverseOf(session.remote, outbound); isReverse {
+		session.outbound = addr
+		c.reverse[addr] = session
+	} else {
+		if len(c.inbound) >= c.limits.MaxInbound {
+			candidates := make([]*inboundSession, 0, len(c.inbound))
+			for s := range c.inbound {
+				if _, isPersistent := c.persistent[s.info.ListenAddr]; !isPersistent {
+					candidates = append(candidates, s)
+				}
+			}
+
+			if victim = selectEviction(candidates); victim == nil {
+				c.mtx.Unlock()
+				return nil, ErrTooManyPeers
+			}
+			delete(c.inbound, victim)
+		}
+		c.inbound[session] = struct{}{}
+	}
+	c.mtx.Unlock()
+
+	if victim != nil {
+		c.logger.Printf("Evicting the inbound peer %s (node %s)", victim.remote, victim.info.ID)
+		c.drop(victim)
+	}
+
+	time.AfterFunc(_handshakeTimeout, func() {
+		c.mtx.Lock()
+		handshaked := session.handshaked
+		c.mtx.Unlock()
+
+		if !handshaked {
+			session.conn.Close()
+		}
+	})
+
+	return session, nil
+}
+
+// reverseOf returns the outbound peer or the address being dialed with
+// the IP of remote, unless a connection back from it is made already.
+func (c *ConnManager) reverseOf(remote Addr, outbound []Addr) (Addr, bool) {
+	remoteIP := net.ParseIP(remote.IP)
+	if remoteIP == nil {
+		return Addr{}, false
+	}
+
+	for addr := range c.dialing {
+		outbound = append(outbound, addr)
+	}
+
+	for _, addr := range outbound {
+		if _, taken := c.reverse[addr]; !taken && remoteIP.Equal(net.ParseIP(addr.IP)) {
+			return addr, true
+		}
+	}
+
+	return Addr{}, false
+}
+
+// handshake records the info of the peer. The inbound peer is dialed back
+// so that it is gossiped to as well. False is returned if the session
+// has made a handshake already.
+func (c *ConnManager) handshake(s *inboundSession, info NodeInfo) bool {
+	c.mtx.Lock()
+	if s.handshaked {
+		c.mtx.Unlock()
+		return false
+	}
+	s.info, s.handshaked = info, true
+	_, isInbound := c.inbound[s]
+	c.mtx.Unlock()
+
+	if isInbound && info.ListenAddr.IsRoutable() {
+		go c.dialBack(s)
+	}
+
+	return true
+}
+
+// dialBack connects to the listen address of the inbound peer and adds
+// it to the pool unless the session is closed by then.
+func (c *ConnManager) dialBack(s *inboundSession) {
+	addr := s.info.ListenAddr
+	for _, p := range c.pool.Peers() {
+		if p.Addr() == addr {
+			return
+		}
+	}
+
+	peer, err := c.dial(addr, c.local)
+	if err != nil {
+		c.logger.Printf("On dialing back %s: %s", addr, err)
+		return
+	}
+	if peer.Info().ID != s.info.ID {
+		peer.close()
+		c.logger.Printf("On dialing back %s: %s", addr,
+			fmt.Errorf("%w: node %s instead of %s", ErrPeerRejected, peer.Info().ID, s.info.ID))
+		return
+	}
+	peer.inbound = true
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if _, exists := c.inbound[s]; !exists || !c.pool.Add(peer) {
+		peer.close()
+		return
+	}
+	s.peer = true
+}
+
+// poolAddr returns the address of the pool peer the session belongs to:
+// the outbound peer that made the connection or the peer it's dialed back as.
+func (c *ConnManager) poolAddr(s *inboundSession) Addr {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if s.outbound != (Addr{}) {
+		return s.outbound
+	}
+
+	return s.info.ListenAddr
+}
+
+// touch updates the inbound session if it's still open.
+func (c *ConnManager) touch(s *inboundSession, mark func(*inboundSession, time.Time)) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if _, exists := c.inbound[s]; exists {
+		mark(s, c.book.now())
+	}
+}
+
+// inboundClosed frees the slot of the session.
+func (c *ConnManager) inboundClosed(s *inboundSession) {
+	c.mtx.Lock()
+	if c.reverse[s.outbound] == s {
+		delete(c.reverse, s.outbound)
+	}
+	_, exists := c.inbound[s]
+	delete(c.inbound, s)
+	c.mtx.Unlock()
+
+	if exists {
+		c.drop(s)
+	}
+}
+
+// drop closes the connection of the session removed from the inbound ones
+// and removes the peer it was dialed back as.
+func (c *ConnManager) drop(s *inboundSession) {
+	c.mtx.Lock()
+	isPeer := s.peer
+	s.peer = false
+	c.mtx.Unlock()
+
+	if isPeer {
+		c.pool.Remove(s.info.ListenAddr)
+	}
+	s.conn.Close()
+}
+
+// selectEviction picks the inbound peer to make room for a new one, nil if
+// all of them are protected. The peers that relayed the latest blocks and
+// transactions and the longest connected half are protected, so that an
+// attacker can't take over all the inbound slots by making connections.
+// The newest peer of the network group most of the rest come from is picked.
+func selectEviction(sessions []*inboundSession) *inboundSession {
+	candidates := append([]*inboundSession(nil), sessions...)
+
+	protect := func(n int, less func(a, b *inboundSession) bool, eligible func(*inboundSession) bool) {
+		sort.SliceStable(candidates, func(i, j int) bool {
+			return less(candidates[i], candidates[j])
+		})
+
+		protected := 0
+		for protected < n && protected < len(candidates) && eligible(candidates[protected]) {
+			protected++
+		}
+		candidates = candidates[protected:]
+	}
+
+	protect(_protectedByBlocks,
+		func(a, b *inboundSession) bool { return a.lastBlock.After(b.lastBlock) },
+		func(s *inboundSession) bool { return !s.lastBlock.IsZero() })
+	protect(_protectedByTxs,
+		func(a, b *inboundSession) bool { return a.lastTx.After(b.lastTx) },
+		func(s *inboundSession) bool { return !s.lastTx.IsZero() })
+	protect(len(candidates)/2,
+		func(a, b *inboundSession) bool { return a.connected.Before(b.connected) },
+		func(*inboundSession) bool { return true })
+
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	// The candidates are sorted from the oldest to the newest
+	groups := make(map[string][]*inboundSession)
+	for _, s := range candidates {
+		group := addrGroup(s.remote)
+		groups[group] = append(groups[group], s)
+	}
+
+	var largest []*inboundSession
+	for _, s := range candidates {
+		group := groups[addrGroup(s.remote)]
+		if len(group) > len(largest) ||
+			len(group) == len(largest) && group[len(group)-1].connected.After(largest[len(largest)-1].connected) {
+			largest = group
+		}
+	}
+
+	return largest[len(largest)-1]
+}
+
+func remoteAddr(conn net.Conn) Addr {
+	host, port, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return Addr{}
+	}
+
+	return Addr{IP: host, Port: port}
+}
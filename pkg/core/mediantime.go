@@ -0,0 +1,71 @@
+package core
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	_maxTimeSamples = 200
+	// The offset isn't applied until enough peers have reported their time
+	_minTimeSamples = 5
+	// Larger median offsets mean the local clock or the peers are broken
+	_maxTimeOffset = time.Minute * 70
+)
+
+// MedianTimeSource adjusts the local clock by the median of the clock
+// offsets reported by peers, giving the network-adjusted time.
+type MedianTimeSource struct {
+	mtx     sync.RWMutex
+	samples map[string]time.Duration
+	offset  time.Duration
+
+	now func() time.Time
+}
+
+func NewMedianTimeSource() *MedianTimeSource {
+	return &MedianTimeSource{
+		samples: make(map[string]time.Duration),
+		now:     time.Now,
+	}
+}
+
+// AddTimeSample records the time a peer has reported. Only the first
+// sample from each source is taken into account.
+func (m *MedianTimeSource) AddTimeSample(source string, remote time.Time) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	if _, exists := m.samples[source]; exists || len(m.samples) >= _maxTimeSamples {
+		return
+	}
+	m.samples[source] = remote.Sub(m.now()).Truncate(time.Second)
+
+	if len(m.samples) < _minTimeSamples {
+		return
+	}
+
+	offsets := make([]time.Duration, 0, len(m.samples))
+	for _, o := range m.samples {
+		offsets = append(offsets, o)
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+
+	median := offsets[len(offsets)/2]
+	if median > _maxTimeOffset || median < -_maxTimeOffset {
+		median = 0
+	}
+	m.offset = median
+}
+
+func (m *MedianTimeSource) Offset() time.Duration {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+
+	return m.offset
+}
+
+func (m *MedianTimeSource) AdjustedTime() time.Time {
+	return m.now().Add(m.Offset())
+}
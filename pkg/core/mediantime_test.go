@@ -0,0 +1,60 @@
+package core
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMedianTimeSource(t *testing.T) {
+	now := time.Unix(1000, 0)
+	src := NewMedianTimeSource()
+	src.now = func() time.Time { return now }
+
+	offsets := []time.Duration{time.Second * 30, -time.Second * 10, time.Minute, time.Second * 20}
+	for i, o := range offsets {
+		src.AddTimeSample(fmt.Sprint("peer", i), now.Add(o))
+	}
+	assert.Zero(t, src.Offset(), "not enough samples")
+
+	src.AddTimeSample("peer0", now.Add(time.Hour))
+	assert.Zero(t, src.Offset(), "repeated samples are ignored")
+
+	src.AddTimeSample("peer4", now.Add(time.Second*40))
+	assert.Equal(t, time.Second*30, src.Offset())
+	assert.Equal(t, now.Add(time.Second*30), src.AdjustedTime())
+
+	for i := 5; i < 12; i++ {
+		src.AddTimeSample(fmt.Sprint("peer", i), now.Add(time.Hour*2))
+	}
+	assert.Zero(t, src.Offset(), "too large offsets are discarded")
+}
+
+func TestTimestampRules(t *testing.T) {
+	blkchain := newTestBlockchain(t)
+
+	_, genesis := getGenesisPair()
+	a1 := mineTestBlock(t, genesis, 10)
+	a2 := mineTestBlock(t, a1, 10)
+	a3 := mineTestBlock(t, a2, 10)
+	for _, block := range []Block{a1, a2, a3} {
+		require.NoError(t, blkchain.ProcessBlock(block))
+	}
+	require.Equal(t, a2.Timestamp, blkchain.MedianTimePast())
+
+	tooOld := mineTestBlock(t, a3, a2.Timestamp-a3.Timestamp)
+	err := blkchain.ProcessBlock(tooOld)
+	assert.ErrorIs(t, err, ErrTimestampTooOld)
+	assert.ErrorIs(t, err, ErrInvalidTimestamp)
+
+	tooFarAhead := mineTestBlock(t, a3, time.Now().Add(time.Hour*3).Unix()-a3.Timestamp)
+	err = blkchain.ProcessBlock(tooFarAhead)
+	assert.ErrorIs(t, err, ErrTimestampTooFarAhead)
+	assert.ErrorIs(t, err, ErrInvalidTimestamp)
+
+	olderThanParent := mineTestBlock(t, a3, a2.Timestamp+1-a3.Timestamp)
+	assert.NoError(t, blkchain.ProcessBlock(olderThanParent), "only the median time past matters")
+}
@@ -0,0 +1,429 @@
+package core
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/meddion/pkg/crypto"
+)
+
+var (
+	ErrTxAlreadyKnown = errors.New("transaction is already in the mempool")
+	ErrTxTooLarge     = errors.New("transaction doesn't fit into the mempool")
+)
+
+type MempoolConfig struct {
+	MaxTxs   int
+	MaxBytes int
+	// Transactions not mined for that long are dropped
+	TTL time.Duration
+}
+
+var DefaultMempoolConfig = MempoolConfig{
+	MaxTxs:   5000,
+	MaxBytes: 16 << 20,
+	TTL:      time.Hour * 24,
+}
+
+type MempoolEventType uint8
+
+const (
+	TxAdded MempoolEventType = iota + 1
+	TxRemoved
+)
+
+type RemovalReason uint8
+
+const (
+	// The transaction was included into a connected block
+	RemovedIncluded RemovalReason = iota + 1
+	// The transaction has outlived the TTL
+	RemovedExpired
+	// The transaction was pushed out by newer ones on overflow
+	RemovedEvicted
+	RemovedByCaller
+	// A connected block spends the same outputs, or the outputs
+	// the transaction spends are created by such a transaction
+	RemovedConflict
+)
+
+type MempoolEvent struct {
+	Type MempoolEventType
+	Tx   Transaction
+	// Set for TxRemoved
+	Reason RemovalReason
+}
+
+type mempoolTx struct {
+	tx    Transaction
+	size  int
+	added time.Time
+}
+
+// Mempool keeps valid transactions until they are mined. When it is full,
+// the oldest transactions are evicted first.
+type Mempool struct {
+	cfg    MempoolConfig
+	logger *log.Logger
+
+	mtx   sync.RWMutex
+	txs   map[crypto.HashValue]*list.Element
+	order *list.List // of *mempoolTx, from the oldest to the newest
+	bytes int
+	// The outputs spent by the UTXO transactions, mapped to the spending ones
+	spent map[OutPoint]crypto.HashValue
+	// The transactions in order, with the indexes of the validators.
+	// Dropped when a transaction is removed, nil until it's rebuilt.
+	preceding *PrecedingTxs
+	// The chain the returned transactions are verified against, see Follow
+	blkchain *Blockchain
+
+	subsMtx     sync.RWMutex
+	subscribers []func(MempoolEvent)
+
+	now func() time.Time
+}
+
+func NewMempool(cfg MempoolConfig, logger *log.Logger) *Mempool {
+	return &Mempool{
+		cfg:    cfg,
+		logger: logger,
+		txs:    make(map[crypto.HashValue]*list.Element),
+		order:  list.New(),
+		spent:  make(map[OutPoint]crypto.HashValue),
+		now:    time.Now,
+	}
+}
+
+// Subscribe registers a callback for the mempool changes. Callbacks are
+// called outside of the mempool lock.
+func (m *Mempool) Subscribe(f func(MempoolEvent)) {
+	m.subsMtx.Lock()
+	m.subscribers = append(m.subscribers, f)
+	m.subsMtx.Unlock()
+}
+
+func (m *Mempool) notify(events []MempoolEvent) {
+	m.subsMtx.RLock()
+	defer m.subsMtx.RUnlock()
+
+	for _, e := range events {
+		for _, f := range m.subscribers {
+			f(e)
+		}
+	}
+}
+
+// Add puts a verified transaction into the pool, evicting the oldest
+// ones if the limits are exceeded.
+func (m *Mempool) Add(tx Transaction) error {
+	m.mtx.Lock()
+	events, err := m.add(tx)
+	m.mtx.Unlock()
+
+	m.notify(events)
+
+	return err
+}
+
+// AddVerified puts the transaction into the pool if it passes verify given
+// the pending transactions. Checking the transaction and putting it into
+// the pool is atomic, so that no conflicting transaction gets in between.
+// The pending transactions must not be used after verify returns.
+func (m *Mempool) AddVerified(tx Transaction, verify func(pending *PrecedingTxs) error) error {
+	m.mtx.Lock()
+	events, err := m.addVerified(tx, verify)
+	m.mtx.Unlock()
+
+	m.notify(events)
+
+	return err
+}
+
+// Must be called with m.mtx held.
+func (m *Mempool) addVerified(tx Transaction, verify func(pending *PrecedingTxs) error) ([]MempoolEvent, error) {
+	if _, exists := m.txs[tx.Hash]; exists {
+		return nil, ErrTxAlreadyKnown
+	}
+
+	if m.preceding == nil {
+		m.preceding = NewPrecedingTxs()
+		for e := m.order.Front(); e != nil; e = e.Next() {
+			m.preceding.Add(e.Value.(*mempoolTx).tx)
+		}
+	}
+
+	if err := verify(m.preceding); err != nil {
+		return nil, err
+	}
+
+	return m.add(tx)
+}
+
+// Must be called with m.mtx held.
+func (m *Mempool) add(tx Transaction) ([]MempoolEvent, error) {
+	if _, exists := m.txs[tx.Hash]; exists {
+		return nil, ErrTxAlreadyKnown
+	}
+
+	u, isUTXO, err := decodeUTXOTx(tx)
+	if err != nil {
+		return nil, err
+	}
+	for _, in := range u.Inputs {
+		if by, exists := m.spent[in.Prev]; exists {
+			return nil, fmt.Errorf("%w: %s is spent by pending %x", ErrDoubleSpend, in.Prev, by)
+		}
+	}
+
+	b, err := tx.Bytes()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(b) > m.cfg.MaxBytes || m.cfg.MaxTxs <= 0 {
+		return nil, ErrTxTooLarge
+	}
+
+	events := m.expire()
+	for m.order.Len() >= m.cfg.MaxTxs || m.bytes+len(b) > m.cfg.MaxBytes {
+		oldest := m.order.Front().Value.(*mempoolTx)
+		m.remove(oldest.tx.Hash)
+		events = append(events, MempoolEvent{Type: TxRemoved, Tx: oldest.tx, Reason: RemovedEvicted})
+	}
+
+	m.txs[tx.Hash] = m.order.PushBack(&mempoolTx{tx: tx, size: len(b), added: m.now()})
+	m.bytes += len(b)
+	if m.preceding != nil {
+		m.preceding.Add(tx)
+	}
+	if isUTXO {
+		for _, in := range u.Inputs {
+			m.spent[in.Prev] = tx.Hash
+		}
+	}
+
+	return append(events, MempoolEvent{Type: TxAdded, Tx: tx}), nil
+}
+
+// Must be called with m.mtx held.
+func (m *Mempool) remove(hash crypto.HashValue) (Transaction, bool) {
+	elem, exists := m.txs[hash]
+	if !exists {
+		return Transaction{}, false
+	}
+
+	mtx := m.order.Remove(elem).(*mempoolTx)
+	delete(m.txs, hash)
+	m.bytes -= mtx.size
+	m.preceding = nil
+	if u, isUTXO, err := decodeUTXOTx(mtx.tx); isUTXO && err == nil {
+		for _, in := range u.Inputs {
+			delete(m.spent, in.Prev)
+		}
+	}
+
+	return mtx.tx, true
+}
+
+// Must be called with m.mtx held.
+func (m *Mempool) expire() []MempoolEvent {
+	if m.cfg.TTL <= 0 {
+		return nil
+	}
+
+	var (
+		events   []MempoolEvent
+		deadline = m.now().Add(-m.cfg.TTL)
+	)
+
+	for e := m.order.Front(); e != nil; e = m.order.Front() {
+		mtx := e.Value.(*mempoolTx)
+		if mtx.added.After(deadline) {
+			break
+		}
+
+		m.remove(mtx.tx.Hash)
+		events = append(events, MempoolEvent{Type: TxRemoved, Tx: mtx.tx, Reason: RemovedExpired})
+	}
+
+	return events
+}
+
+// Expire drops the transactions that have outlived the TTL.
+func (m *Mempool) Expire() {
+	m.mtx.Lock()
+	events := m.expire()
+	m.mtx.Unlock()
+
+	m.notify(events)
+}
+
+func (m *Mempool) Remove(hash crypto.HashValue) {
+	m.mtx.Lock()
+	tx, removed := m.remove(hash)
+	m.mtx.Unlock()
+
+	if removed {
+		m.notify([]MempoolEvent{{Type: TxRemoved, Tx: tx, Reason: RemovedByCaller}})
+	}
+}
+
+func (m *Mempool) Has(hash crypto.HashValue) bool {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+
+	_, exists := m.txs[hash]
+	return exists
+}
+
+func (m *Mempool) Get(hash crypto.HashValue) (Transaction, bool) {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+
+	elem, exists := m.txs[hash]
+	if !exists {
+		return Transaction{}, false
+	}
+
+	return elem.Value.(*mempoolTx).tx, true
+}
+
+func (m *Mempool) Len() int {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+
+	return m.order.Len()
+}
+
+// Size returns the number of bytes taken by the transactions.
+func (m *Mempool) Size() int {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+
+	return m.bytes
+}
+
+// Transactions returns all the transactions from the oldest to the newest.
+func (m *Mempool) Transactions() []Transaction {
+	return m.PendingTransactions(m.Len())
+}
+
+// PendingTransactions returns up to max of the oldest transactions.
+func (m *Mempool) PendingTransactions(max int) []Transaction {
+	m.Expire()
+
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+
+	txs := make([]Transaction, 0, max)
+	for e := m.order.Front(); e != nil && len(txs) < max; e = e.Next() {
+		txs = append(txs, e.Value.(*mempoolTx).tx)
+	}
+
+	return txs
+}
+
+// Follow subscribes the pool to the main chain changes of blkchain, see
+// HandleNotification. The transactions of disconnected blocks are verified
+// against the new tip before they are returned to the pool.
+func (m *Mempool) Follow(blkchain *Blockchain) {
+	m.mtx.Lock()
+	m.blkchain = blkchain
+	m.mtx.Unlock()
+
+	blkchain.Subscribe(m.HandleNotification)
+}
+
+// HandleNotification keeps the pool in line with the main chain: transactions
+// of connected blocks are removed along with the ones conflicting with them,
+// the ones of disconnected blocks are returned.
+func (m *Mempool) HandleNotification(n Notification) {
+	var events []MempoolEvent
+
+	m.mtx.Lock()
+	switch n.Type {
+	case NTBlockConnected:
+		for _, tx := range n.Block.Body {
+			if _, removed := m.remove(tx.Hash); removed {
+				events = append(events, MempoolEvent{Type: TxRemoved, Tx: tx, Reason: RemovedIncluded})
+			}
+		}
+		events = append(events, m.removeConflicts(n.Block.Body)...)
+	case NTBlockDisconnected:
+		var ctx ChainContext
+		if m.blkchain != nil {
+			ctx = m.blkchain.nextChainContext()
+		}
+
+		for _, tx := range n.Block.Body {
+			// A coinbase is only valid in its own block
+			if IsCoinbase(tx) {
+				continue
+			}
+
+			var (
+				e   []MempoolEvent
+				err error
+			)
+			if m.blkchain == nil {
+				e, err = m.add(tx)
+			} else {
+				e, err = m.addVerified(tx, func(pending *PrecedingTxs) error {
+					ctx.Preceding = pending
+					return tx.Verify(ctx)
+				})
+			}
+			if err != nil && !errors.Is(err, ErrTxAlreadyKnown) {
+				m.logger.Printf("On returning transaction %x to the mempool: %s", tx.Hash, err)
+			}
+			events = append(events, e...)
+		}
+	}
+	m.mtx.Unlock()
+
+	m.notify(events)
+}
+
+// removeConflicts drops the transactions spending the outputs the UTXO
+// transactions of the body spend, then the ones spending their outputs.
+// Must be called with m.mtx held.
+func (m *Mempool) removeConflicts(body Body) []MempoolEvent {
+	var conflicts []crypto.HashValue
+	for _, tx := range body {
+		u, isUTXO, err := decodeUTXOTx(tx)
+		if !isUTXO || err != nil {
+			continue
+		}
+
+		for _, in := range u.Inputs {
+			if by, exists := m.spent[in.Prev]; exists {
+				conflicts = append(conflicts, by)
+			}
+		}
+	}
+
+	var events []MempoolEvent
+	for len(conflicts) > 0 {
+		hash := conflicts[0]
+		conflicts = conflicts[1:]
+
+		tx, removed := m.remove(hash)
+		if !removed {
+			continue
+		}
+		events = append(events, MempoolEvent{Type: TxRemoved, Tx: tx, Reason: RemovedConflict})
+
+		for out, by := range m.spent {
+			if out.TxHash == hash {
+				conflicts = append(conflicts, by)
+			}
+		}
+	}
+
+	return events
+}
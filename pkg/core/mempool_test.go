@@ -0,0 +1,159 @@
+package core
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/meddion/pkg/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestMempool(t *testing.T, cfg MempoolConfig) (*Mempool, *[]MempoolEvent, *time.Time) {
+	t.Helper()
+
+	now := time.Unix(1000, 0)
+	m := NewMempool(cfg, log.Default())
+	m.now = func() time.Time { return now }
+
+	var events []MempoolEvent
+	m.Subscribe(func(e MempoolEvent) { events = append(events, e) })
+
+	return m, &events, &now
+}
+
+func TestMempool(t *testing.T) {
+	txs, err := genRandTransactions(4)
+	require.NoError(t, err)
+
+	txSize := func(tx Transaction) int {
+		b, err := tx.Bytes()
+		require.NoError(t, err)
+		return len(b)
+	}
+
+	t.Run("add and query", func(t *testing.T) {
+		m, events, _ := newTestMempool(t, DefaultMempoolConfig)
+
+		require.NoError(t, m.Add(txs[0]))
+		require.NoError(t, m.Add(txs[1]))
+		assert.ErrorIs(t, m.Add(txs[0]), ErrTxAlreadyKnown)
+
+		assert.Equal(t, 2, m.Len())
+		assert.Equal(t, txSize(txs[0])+txSize(txs[1]), m.Size())
+		assert.True(t, m.Has(txs[1].Hash))
+
+		tx, ok := m.Get(txs[0].Hash)
+		assert.True(t, ok)
+		assert.Equal(t, txs[0].Hash, tx.Hash)
+
+		assert.Equal(t, []Transaction{txs[0]}, m.PendingTransactions(1))
+		assert.Len(t, m.Transactions(), 2)
+
+		m.Remove(txs[0].Hash)
+		assert.False(t, m.Has(txs[0].Hash))
+		assert.Equal(t, txSize(txs[1]), m.Size())
+
+		require.Len(t, *events, 3)
+		assert.Equal(t, MempoolEvent{Type: TxRemoved, Tx: txs[0], Reason: RemovedByCaller}, (*events)[2])
+	})
+
+	t.Run("eviction", func(t *testing.T) {
+		cfg := DefaultMempoolConfig
+		cfg.MaxTxs = 2
+		m, events, _ := newTestMempool(t, cfg)
+
+		for _, tx := range txs[:3] {
+			require.NoError(t, m.Add(tx))
+		}
+
+		assert.Equal(t, 2, m.Len())
+		assert.False(t, m.Has(txs[0].Hash), "the oldest transaction should be evicted")
+		assert.Contains(t, *events, MempoolEvent{Type: TxRemoved, Tx: txs[0], Reason: RemovedEvicted})
+
+		cfg.MaxTxs = DefaultMempoolConfig.MaxTxs
+		cfg.MaxBytes = txSize(txs[0]) - 1
+		m, _, _ = newTestMempool(t, cfg)
+		assert.ErrorIs(t, m.Add(txs[0]), ErrTxTooLarge)
+	})
+
+	t.Run("expiry", func(t *testing.T) {
+		cfg := DefaultMempoolConfig
+		cfg.TTL = time.Minute
+		m, events, now := newTestMempool(t, cfg)
+
+		require.NoError(t, m.Add(txs[0]))
+		*now = now.Add(time.Second * 30)
+		require.NoError(t, m.Add(txs[1]))
+		*now = now.Add(time.Second * 31)
+
+		assert.Equal(t, []Transaction{txs[1]}, m.PendingTransactions(len(txs)))
+		assert.Contains(t, *events, MempoolEvent{Type: TxRemoved, Tx: txs[0], Reason: RemovedExpired})
+	})
+
+	t.Run("chain notifications", func(t *testing.T) {
+		m, events, _ := newTestMempool(t, DefaultMempoolConfig)
+
+		require.NoError(t, m.Add(txs[0]))
+		require.NoError(t, m.Add(txs[1]))
+
+		block := Block{Body: Body{txs[0], txs[2]}}
+		m.HandleNotification(Notification{Type: NTBlockConnected, Block: block})
+		assert.Equal(t, []Transaction{txs[1]}, m.Transactions())
+		assert.Contains(t, *events, MempoolEvent{Type: TxRemoved, Tx: txs[0], Reason: RemovedIncluded})
+
+		m.HandleNotification(Notification{Type: NTBlockDisconnected, Block: block})
+		assert.Equal(t, 3, m.Len(), "transactions of a disconnected block should return")
+		assert.True(t, m.Has(txs[0].Hash))
+		assert.True(t, m.Has(txs[2].Hash))
+	})
+	t.Run("conflicts", func(t *testing.T) {
+		m, _, _ := newTestMempool(t, DefaultMempoolConfig)
+		alice := newTestSigner(t)
+		out := TxOut{Amount: 1, To: alice.Address()}
+		prev := OutPoint{TxHash: crypto.HashValue{1}}
+
+		// Each spends prev, only one of them can get in
+		spends := make([]Transaction, 8)
+		for i := range spends {
+			out.Amount = uint64(i + 1)
+			spends[i] = spendTestTx(t, alice, []OutPoint{prev}, out)
+		}
+
+		var (
+			wg       sync.WaitGroup
+			admitted int32
+		)
+		for _, tx := range spends {
+			wg.Add(1)
+			go func(tx Transaction) {
+				defer wg.Done()
+
+				err := m.AddVerified(tx, func(*PrecedingTxs) error { return nil })
+				if err == nil {
+					atomic.AddInt32(&admitted, 1)
+				} else {
+					assert.ErrorIs(t, err, ErrDoubleSpend)
+				}
+			}(tx)
+		}
+		wg.Wait()
+		assert.EqualValues(t, 1, admitted, "the conflicting transactions shouldn't get in together")
+
+		pending := m.Transactions()
+		require.Len(t, pending, 1)
+		m.Remove(pending[0].Hash)
+		assert.NoError(t, m.Add(spends[0]), "the output should be freed with the spending transaction")
+
+		errRejected := errors.New("rejected")
+		assert.ErrorIs(t, m.AddVerified(txs[0], func(p *PrecedingTxs) error {
+			assert.Equal(t, 1, p.Len(), "the pending transactions should be passed")
+			return errRejected
+		}), errRejected)
+		assert.False(t, m.Has(txs[0].Hash))
+	})
+}
@@ -0,0 +1,338 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/meddion/pkg/crypto"
+)
+
+// How many nonces a worker tries between checks for cancellation
+const _nonceBatch = 1 << 12
+
+var ErrStaleTemplate = errors.New("block template is stale")
+
+// TxSource provides the transactions to include into new blocks
+type TxSource interface {
+	PendingTransactions(max int) []Transaction
+}
+
+// Miner assembles blocks on top of the main chain and searches for their
+// nonces on several goroutines. The work is abandoned as soon as the tip changes.
+type Miner struct {
+	blkchain *Blockchain
+	txSource TxSource
+	peerPool PeerPool
+	workers  int
+	logger   *log.Logger
+
+	// Size of the nonce space split between workers
+	nonceSpace uint64
+
+	mtx        sync.Mutex
+	cancelWork context.CancelFunc
+	// The blocks pay the subsidy and the fees to this key, if it's set
+	coinbaseKey *crypto.SignerECDSA
+}
+
+func NewMiner(blkchain *Blockchain, txSource TxSource, peerPool PeerPool, workers int, logger *log.Logger) *Miner {
+	if workers < 1 {
+		workers = 1
+	}
+
+	m := &Miner{
+		blkchain:   blkchain,
+		txSource:   txSource,
+		peerPool:   peerPool,
+		workers:    workers,
+		logger:     logger,
+		nonceSpace: uint64(NonceMaxValue) + 1,
+	}
+	blkchain.Subscribe(m.handleNotification)
+
+	return m
+}
+
+// SetCoinbaseKey makes the mined blocks start with a coinbase transaction
+// paying the block subsidy and the fees to the key.
+func (m *Miner) SetCoinbaseKey(key crypto.SignerECDSA) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	m.coinbaseKey = &key
+}
+
+func (m *Miner) handleNotification(n Notification) {
+	if n.Type != NTBlockConnected && n.Type != NTBlockDisconnected {
+		return
+	}
+
+	m.mtx.Lock()
+	if m.cancelWork != nil {
+		m.cancelWork()
+	}
+	m.mtx.Unlock()
+}
+
+// Run mines blocks one after another until ctx is done.
+func (m *Miner) Run(ctx context.Context) {
+	m.logger.Printf("Starting to mine on %d workers...", m.workers)
+
+	for ctx.Err() == nil {
+		block, err := m.MineBlock(ctx)
+		switch {
+		case err == nil:
+			hash, _ := block.Header.Checksum()
+			m.logger.Printf("Mined block %x with %d transactions", hash, len(block.Body))
+		case errors.Is(err, ErrStaleTemplate), ctx.Err() != nil:
+		default:
+			m.logger.Printf("On mining a block: %s", err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Second):
+			}
+		}
+	}
+}
+
+// MineBlock mines a single block on top of the main chain, adds it to
+// the chain and sends it to peers. ErrStaleTemplate is returned if
+// the tip has changed before the block was found.
+func (m *Miner) MineBlock(ctx context.Context) (Block, error) {
+	template, err := m.NewBlockTemplate()
+	if err != nil {
+		return Block{}, fmt.Errorf("on creating a block template: %w", err)
+	}
+
+	block, err := m.solve(ctx, template)
+	if err != nil {
+		return Block{}, err
+	}
+
+	if err := m.blkchain.ProcessBlock(block); err != nil {
+		return Block{}, fmt.Errorf("on processing a mined block: %w", err)
+	}
+
+	if m.peerPool != nil {
+		req := BlockReq{Block: block}
+		for err := range m.peerPool.SendToPeers(func(p Peer) error { return p.SendBlock(req) }) {
+			m.logger.Printf("On sending a mined block: %s", err)
+		}
+	}
+
+	return block, nil
+}
+
+// NewBlockTemplate assembles a block on top of the main chain from
+// the pending transactions. The nonce of the block is not set.
+func (m *Miner) NewBlockTemplate() (Block, error) {
+	tip := m.blkchain.tipNode()
+
+	m.mtx.Lock()
+	key := m.coinbaseKey
+	m.mtx.Unlock()
+
+	var (
+		params = m.blkchain.params
+		ctx    = m.blkchain.pendingContext(tip)
+		body   Body
+		size   = HeaderSize + 4
+		maxTxs = params.MaxBlockTxs
+		seen   = make(map[crypto.HashValue]struct{})
+	)
+
+	// Room for the coinbase. Its size doesn't depend on the amount.
+	if key != nil {
+		coinbase, err := NewCoinbaseTx(*key, ctx.Height, 0)
+		if err != nil {
+			return Block{}, fmt.Errorf("on creating a coinbase: %w", err)
+		}
+
+		txSize, err := encodedTxSize(coinbase)
+		if err != nil {
+			return Block{}, err
+		}
+
+		size += txSize
+		maxTxs--
+	}
+
+	if m.txSource != nil && maxTxs > 0 {
+		ctx.Preceding = NewPrecedingTxs()
+		for _, tx := range m.txSource.PendingTransactions(maxTxs) {
+			if _, exists := seen[tx.Hash]; exists {
+				continue
+			}
+
+			if err := tx.Verify(ctx); err != nil {
+				continue
+			}
+
+			txSize, err := encodedTxSize(tx)
+			if err != nil || size+txSize > params.MaxBlockSize {
+				continue
+			}
+
+			size += txSize
+			seen[tx.Hash] = struct{}{}
+			body = append(body, tx)
+			ctx.Preceding.Add(tx)
+		}
+	}
+
+	if key != nil {
+		coinbase, err := m.newCoinbase(*key, ctx, body)
+		if err != nil {
+			return Block{}, err
+		}
+
+		body = append(Body{coinbase}, body...)
+	}
+
+	version := params.blockVersion()
+	mroot, err := merkleRoot(version, body)
+	if err != nil {
+		return Block{}, err
+	}
+
+	timestamp := m.blkchain.timeSource.AdjustedTime().Unix()
+	if mtp := tip.MedianTimePast(m.blkchain.params.MedianTimeBlocks); timestamp <= mtp {
+		timestamp = mtp + 1
+	}
+
+	header := Header{
+		Version:       version,
+		Timestamp:     timestamp,
+		PrevBlockHash: tip.Hash,
+		MerkleRoot:    mroot,
+	}
+	if version < _compactBitsVersion {
+		header.Difficulty = m.blkchain.params.nextDifficulty(tip)
+	} else {
+		header.Bits = m.blkchain.params.nextBits(tip)
+	}
+
+	return Block{Header: header, Body: body}, nil
+}
+
+// newCoinbase pays the subsidy and the fees of the body to the key.
+func (m *Miner) newCoinbase(key crypto.SignerECDSA, ctx ChainContext, body Body) (Transaction, error) {
+	fees, err := m.blkchain.pendingFees(ctx, body)
+	if err != nil {
+		return Transaction{}, fmt.Errorf("on calculating the block fees: %w", err)
+	}
+
+	subsidy := m.blkchain.params.BlockSubsidy(ctx.Height)
+	if fees > math.MaxUint64-subsidy {
+		return Transaction{}, ErrAmountOverflow
+	}
+
+	coinbase, err := NewCoinbaseTx(key, ctx.Height, subsidy+fees)
+	if err != nil {
+		return Transaction{}, fmt.Errorf("on creating a coinbase: %w", err)
+	}
+
+	return coinbase, nil
+}
+
+// solve splits the nonce space between the workers. A worker that has
+// exhausted its part rolls the timestamp of its header forward and starts
+// over, up to the max timestamp the network accepts. The search stops when
+// ctx is done, the chain tip changes or all the timestamps are tried,
+// ErrStaleTemplate is returned in the latter cases.
+func (m *Miner) solve(parent context.Context, template Block) (Block, error) {
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+
+	m.mtx.Lock()
+	m.cancelWork = cancel
+	m.mtx.Unlock()
+
+	defer func() {
+		m.mtx.Lock()
+		m.cancelWork = nil
+		m.mtx.Unlock()
+	}()
+
+	// The tip might have changed before the work could be cancelled
+	if tip, _ := m.blkchain.BestBlock(); tip != template.PrevBlockHash {
+		return Block{}, ErrStaleTemplate
+	}
+
+	var (
+		wg     sync.WaitGroup
+		found  = make(chan Header, 1)
+		errs   = make(chan error, m.workers)
+		target = template.Header.Target()
+		span   = m.nonceSpace / uint64(m.workers)
+		// Adjusted time only moves forward, so the headers stay valid
+		maxTimestamp = m.blkchain.timeSource.AdjustedTime().Add(m.blkchain.params.MaxFutureDrift).Unix()
+	)
+
+	for i := 0; i < m.workers; i++ {
+		start, end := uint64(i)*span, uint64(i+1)*span
+		if i == m.workers-1 {
+			end = m.nonceSpace
+		}
+
+		wg.Add(1)
+		go func(h Header) {
+			defer wg.Done()
+
+			var tempInt big.Int
+			for n := start; ; n++ {
+				if n == end {
+					if h.Timestamp >= maxTimestamp {
+						return
+					}
+					n = start
+					h.Timestamp++
+				}
+
+				if (n-start)%_nonceBatch == 0 && ctx.Err() != nil {
+					return
+				}
+
+				h.Nonce = Nonce(n)
+				ok, err := isBelowTarget(h, target, &tempInt)
+				if err != nil {
+					errs <- err
+					cancel()
+					return
+				}
+
+				if ok {
+					select {
+					case found <- h:
+					default:
+					}
+					cancel()
+					return
+				}
+			}
+		}(template.Header)
+	}
+	wg.Wait()
+
+	select {
+	case h := <-found:
+		template.Header = h
+		return template, nil
+	case err := <-errs:
+		return Block{}, err
+	default:
+	}
+
+	if err := parent.Err(); err != nil {
+		return Block{}, err
+	}
+
+	// Cancelled because of the chain tip change, or the timestamps are used up
+	return Block{}, ErrStaleTemplate
+}
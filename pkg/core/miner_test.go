@@ -0,0 +1,116 @@
+package core
+
+import (
+	"context"
+	"io"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type txSourceFunc func(int) []Transaction
+
+func (f txSourceFunc) PendingTransactions(max int) []Transaction {
+	return f(max)
+}
+
+func newTestMiner(t *testing.T, blkchain *Blockchain, workers int) *Miner {
+	txs, err := genRandTransactions(3)
+	require.NoError(t, err, "on generating transactions")
+
+	source := txSourceFunc(func(int) []Transaction { return txs })
+
+	return NewMiner(blkchain, source, nil, workers, log.New(io.Discard, "", 0))
+}
+
+func TestMineBlock(t *testing.T) {
+	blkchain := newTestBlockchain(t)
+	miner := newTestMiner(t, blkchain, 4)
+
+	for i := 1; i <= 3; i++ {
+		block, err := miner.MineBlock(context.Background())
+		require.NoError(t, err, "on mining a block")
+
+		assert.Len(t, block.Body, 3, "pending transactions should be included")
+		assert.Equal(t, LatestBlockVersion, block.Version)
+
+		tip, height := blkchain.BestBlock()
+		assert.Equal(t, blockHash(t, block), tip, "mined block should become the tip")
+		assert.Equal(t, i, height)
+	}
+}
+
+func TestSolveRollsTimestamp(t *testing.T) {
+	params := DefaultChainParams
+	// Leaves enough timestamps to find a nonce in the tiny nonce space
+	params.MaxFutureDrift = time.Hour * 24 * 365
+	blkchain := newTestBlockchainWithParams(t, &params)
+	miner := newTestMiner(t, blkchain, 2)
+	miner.nonceSpace = 4
+
+	template, err := miner.NewBlockTemplate()
+	require.NoError(t, err)
+
+	block, err := miner.solve(context.Background(), template)
+	require.NoError(t, err)
+
+	assert.Less(t, uint64(block.Nonce), miner.nonceSpace)
+	assert.Greater(t, block.Timestamp, template.Timestamp, "the timestamp should be rolled")
+	assert.NoError(t, block.Header.VerifyNonce())
+}
+
+func TestSolveStopsAtMaxTimestamp(t *testing.T) {
+	params := DefaultChainParams
+	params.MaxFutureDrift = time.Second * 2
+	blkchain := newTestBlockchainWithParams(t, &params)
+	miner := newTestMiner(t, blkchain, 2)
+	miner.nonceSpace = 4
+
+	template, err := miner.NewBlockTemplate()
+	require.NoError(t, err)
+	// Practically impossible to solve
+	template.Bits = 0x03000001
+
+	_, err = miner.solve(context.Background(), template)
+	assert.ErrorIs(t, err, ErrStaleTemplate, "the timestamp shouldn't be rolled too far ahead")
+}
+
+func TestSolveAbandonsStaleWork(t *testing.T) {
+	blkchain := newTestBlockchain(t)
+	miner := newTestMiner(t, blkchain, 2)
+
+	template, err := miner.NewBlockTemplate()
+	require.NoError(t, err)
+	// Practically impossible to solve
+	template.Bits = 0x03000001
+
+	result := make(chan error, 1)
+	go func() {
+		_, err := miner.solve(context.Background(), template)
+		result <- err
+	}()
+
+	_, genesis := getGenesisPair()
+	// Waiting for the workers to start
+	time.Sleep(time.Millisecond * 100)
+	require.NoError(t, blkchain.ProcessBlock(mineTestBlock(t, genesis, 1)))
+
+	select {
+	case err := <-result:
+		assert.ErrorIs(t, err, ErrStaleTemplate)
+	case <-time.After(time.Second * 5):
+		t.Fatal("the work wasn't abandoned on a new tip")
+	}
+
+	template, err = miner.NewBlockTemplate()
+	require.NoError(t, err)
+	template.Bits = 0x03000001
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	_, err = miner.solve(ctx, template)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
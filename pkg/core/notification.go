@@ -0,0 +1,106 @@
+package core
+
+import "github.com/meddion/pkg/crypto"
+
+type NotificationType uint8
+
+const (
+	// NTBlockConnected is sent when a block becomes the tip of the main chain
+	NTBlockConnected NotificationType = iota + 1
+	// NTBlockDisconnected is sent when a block stops being the tip of the main chain
+	NTBlockDisconnected
+	// NTReorganization is sent after the main chain has switched to another branch
+	NTReorganization
+)
+
+func (t NotificationType) String() string {
+	switch t {
+	case NTBlockConnected:
+		return "block connected"
+	case NTBlockDisconnected:
+		return "block disconnected"
+	case NTReorganization:
+		return "reorganization"
+	}
+
+	return "unknown notification"
+}
+
+type Notification struct {
+	Type NotificationType
+
+	// Set for NTBlockConnected and NTBlockDisconnected
+	Block  Block
+	Height int
+	// The application state hash after the connected block,
+	// zero without an application
+	AppHash crypto.HashValue
+
+	// Set for NTReorganization
+	Reorg Reorg
+}
+
+// Reorg describes a switch of the main chain to a branch with more work.
+type Reorg struct {
+	OldTip, NewTip crypto.HashValue
+	ForkHeight     int
+
+	// Detached are ordered from the old tip down to the fork point,
+	// Attached -- from the fork point up to the new tip
+	Detached, Attached []crypto.HashValue
+}
+
+// Subscribe registers a callback for the main chain changes.
+// Callbacks are called in order of the changes, one at a time and outside
+// of the chain lock. They must not process blocks themselves.
+func (b *Blockchain) Subscribe(f func(Notification)) {
+	b.subsMtx.Lock()
+	b.subscribers = append(b.subscribers, f)
+	b.subsMtx.Unlock()
+}
+
+func (b *Blockchain) notify(notifications []Notification) {
+	if len(notifications) == 0 {
+		return
+	}
+
+	b.subsMtx.RLock()
+	defer b.subsMtx.RUnlock()
+
+	for _, n := range notifications {
+		for _, f := range b.subscribers {
+			f(n)
+		}
+	}
+}
+
+// Must be called with b.mtx held.
+func (b *Blockchain) queueNotifications(notifications []Notification) {
+	if len(notifications) == 0 {
+		return
+	}
+
+	b.queueMtx.Lock()
+	b.queue = append(b.queue, notifications...)
+	b.queueMtx.Unlock()
+}
+
+// deliverNotifications passes the queued notifications to the subscribers
+// until the queue is empty. The notifications queued by a concurrent call
+// are delivered by whichever call gets notifyMtx first, in the queue order.
+func (b *Blockchain) deliverNotifications() {
+	b.notifyMtx.Lock()
+	defer b.notifyMtx.Unlock()
+
+	for {
+		b.queueMtx.Lock()
+		notifications := b.queue
+		b.queue = nil
+		b.queueMtx.Unlock()
+
+		if len(notifications) == 0 {
+			return
+		}
+		b.notify(notifications)
+	}
+}
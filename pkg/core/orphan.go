@@ -0,0 +1,142 @@
+package core
+
+import (
+	"sync"
+	"time"
+
+	"github.com/meddion/pkg/crypto"
+)
+
+const (
+	_maxOrphanBlocks = 100
+	_orphanTTL       = time.Minute * 15
+)
+
+// orphanBlock is a block whose parent is not in the block index yet
+type orphanBlock struct {
+	block      Block
+	hash       crypto.HashValue
+	expiration time.Time
+}
+
+// orphanPool is a bounded set of orphan blocks keyed by their PrevBlockHash
+type orphanPool struct {
+	mtx     sync.Mutex
+	orphans map[crypto.HashValue]*orphanBlock
+	byPrev  map[crypto.HashValue][]*orphanBlock
+	limit   int
+	ttl     time.Duration
+
+	now func() time.Time
+}
+
+func newOrphanPool(limit int, ttl time.Duration) *orphanPool {
+	return &orphanPool{
+		orphans: make(map[crypto.HashValue]*orphanBlock),
+		byPrev:  make(map[crypto.HashValue][]*orphanBlock),
+		limit:   limit,
+		ttl:     ttl,
+		now:     time.Now,
+	}
+}
+
+func (p *orphanPool) Has(hash crypto.HashValue) bool {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	_, exists := p.orphans[hash]
+	return exists
+}
+
+func (p *orphanPool) Len() int {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	return len(p.orphans)
+}
+
+// Add puts a block into the pool, evicting expired orphans first and
+// the one closest to expiration if the pool is still full.
+func (p *orphanPool) Add(hash crypto.HashValue, block Block) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if _, exists := p.orphans[hash]; exists {
+		return
+	}
+
+	now := p.now()
+	var oldest *orphanBlock
+	for _, o := range p.orphans {
+		if now.After(o.expiration) {
+			p.remove(o)
+			continue
+		}
+
+		if oldest == nil || o.expiration.Before(oldest.expiration) {
+			oldest = o
+		}
+	}
+
+	if len(p.orphans) >= p.limit && oldest != nil {
+		p.remove(oldest)
+	}
+
+	o := &orphanBlock{block: block, hash: hash, expiration: now.Add(p.ttl)}
+	p.orphans[hash] = o
+	p.byPrev[block.PrevBlockHash] = append(p.byPrev[block.PrevBlockHash], o)
+}
+
+// TakeChildren removes and returns the orphans that reference
+// the given block as their parent.
+func (p *orphanPool) TakeChildren(parent crypto.HashValue) []*orphanBlock {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	children := p.byPrev[parent]
+	for _, o := range children {
+		delete(p.orphans, o.hash)
+	}
+	delete(p.byPrev, parent)
+
+	return children
+}
+
+// Root walks the orphan chain down from hash and returns
+// the hash of its first ancestor that is not in the pool.
+func (p *orphanPool) Root(hash crypto.HashValue) (crypto.HashValue, bool) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	o, exists := p.orphans[hash]
+	if !exists {
+		return crypto.ZeroHashValue, false
+	}
+
+	for {
+		prev, exists := p.orphans[o.block.PrevBlockHash]
+		if !exists {
+			return o.block.PrevBlockHash, true
+		}
+		o = prev
+	}
+}
+
+// Must be called with p.mtx held.
+func (p *orphanPool) remove(o *orphanBlock) {
+	delete(p.orphans, o.hash)
+
+	siblings := p.byPrev[o.block.PrevBlockHash]
+	for i, s := range siblings {
+		if s == o {
+			siblings = append(siblings[:i], siblings[i+1:]...)
+			break
+		}
+	}
+
+	if len(siblings) == 0 {
+		delete(p.byPrev, o.block.PrevBlockHash)
+	} else {
+		p.byPrev[o.block.PrevBlockHash] = siblings
+	}
+}
@@ -0,0 +1,146 @@
+package core
+
+import (
+	"io"
+	"log"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/meddion/pkg/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOrphanPool(t *testing.T) {
+	now := time.Unix(1000, 0)
+	pool := newOrphanPool(2, time.Minute)
+	pool.now = func() time.Time { return now }
+
+	orphan := func(id, prev byte) (crypto.HashValue, Block) {
+		var block Block
+		block.PrevBlockHash[0] = prev
+		return crypto.HashValue{id}, block
+	}
+
+	pool.Add(orphan(2, 1))
+	now = now.Add(time.Second)
+	pool.Add(orphan(3, 2))
+
+	root, isOrphan := pool.Root(crypto.HashValue{3})
+	assert.True(t, isOrphan)
+	assert.Equal(t, crypto.HashValue{1}, root, "should point to the missing ancestor")
+
+	_, isOrphan = pool.Root(crypto.HashValue{1})
+	assert.False(t, isOrphan)
+
+	t.Run("eviction", func(t *testing.T) {
+		pool.Add(orphan(4, 1))
+		assert.Equal(t, 2, pool.Len())
+		assert.False(t, pool.Has(crypto.HashValue{2}), "the oldest orphan should be evicted")
+	})
+
+	t.Run("expiry", func(t *testing.T) {
+		now = now.Add(time.Minute * 2)
+		pool.Add(orphan(5, 4))
+		assert.Equal(t, 1, pool.Len())
+		assert.True(t, pool.Has(crypto.HashValue{5}))
+	})
+
+	t.Run("children", func(t *testing.T) {
+		children := pool.TakeChildren(crypto.HashValue{4})
+		require.Len(t, children, 1)
+		assert.Equal(t, crypto.HashValue{5}, children[0].hash)
+		assert.Equal(t, 0, pool.Len())
+	})
+}
+
+func TestProcessOrphans(t *testing.T) {
+	blkchain := newTestBlockchain(t)
+
+	_, genesis := getGenesisPair()
+	b1 := mineTestBlock(t, genesis, 1)
+	b2 := mineTestBlock(t, b1, 1)
+	b3 := mineTestBlock(t, b2, 1)
+
+	assert.ErrorIs(t, blkchain.ProcessBlock(b3), ErrOrphanBlock)
+	assert.ErrorIs(t, blkchain.ProcessBlock(b2), ErrOrphanBlock)
+	assert.ErrorIs(t, blkchain.ProcessBlock(b3), ErrDuplicateBlock)
+
+	missing, isOrphan := blkchain.OrphanRoot(blockHash(t, b3))
+	assert.True(t, isOrphan)
+	assert.Equal(t, blockHash(t, b1), missing)
+
+	require.NoError(t, blkchain.ProcessBlock(b1), "on processing the missing parent")
+
+	tip, height := blkchain.BestBlock()
+	assert.Equal(t, blockHash(t, b3), tip, "waiting descendants should be connected")
+	assert.Equal(t, 3, height)
+	assert.Equal(t, 0, blkchain.orphans.Len())
+
+	t.Run("unbounded target", func(t *testing.T) {
+		for _, h := range []Header{
+			{Version: 1, Difficulty: 256},
+			{Version: _compactBitsVersion, Bits: 0x2100ffff},
+		} {
+			h.PrevBlockHash = crypto.HashValue{1}
+			junk := Block{Header: h}
+
+			assert.ErrorIs(t, blkchain.ProcessBlock(junk), ErrInvalidDifficulty)
+			assert.False(t, blkchain.orphans.Has(blockHash(t, junk)), "the block shouldn't be pooled")
+		}
+	})
+}
+
+// gatedSender counts the block requests and holds them until released.
+type gatedSender struct {
+	localSender
+	requests *int32
+	release  <-chan struct{}
+}
+
+func (g gatedSender) SendGetBlocks(req GetBlocksReq) (BlocksResp, error) {
+	atomic.AddInt32(g.requests, 1)
+	<-g.release
+	return g.localSender.SendGetBlocks(req)
+}
+
+func TestRequestOrphanParents(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	_, genesis := getGenesisPair()
+	b1 := mineTestBlock(t, genesis, 1)
+	b2 := mineTestBlock(t, b1, 1)
+	b3 := mineTestBlock(t, b2, 1)
+
+	remoteChain := newTestBlockchain(t)
+	for _, b := range []Block{b1, b2, b3} {
+		require.NoError(t, remoteChain.ProcessBlock(b))
+	}
+	remote := NewReceiverRPC(remoteChain, NewMempool(DefaultMempoolConfig, logger), &mockPeerPool{}, Addr{}, logger)
+	empty := NewReceiverRPC(newTestBlockchain(t), NewMempool(DefaultMempoolConfig, logger), &mockPeerPool{}, Addr{}, logger)
+
+	var sourceReqs, otherReqs int32
+	release := make(chan struct{})
+	source := Addr{IP: "203.0.113.1", Port: "8090"}
+	pool := &mockPeerPool{peers: []Peer{
+		{addr: Addr{IP: "203.0.113.2", Port: "8090"}, Sender: gatedSender{localSender{empty}, &otherReqs, release}},
+		{addr: source, Sender: gatedSender{localSender{remote}, &sourceReqs, release}},
+	}}
+
+	blkchain := newTestBlockchain(t)
+	local := NewReceiverRPC(blkchain, NewMempool(DefaultMempoolConfig, logger), pool, Addr{}, logger)
+
+	// Both orphans miss b1
+	require.NoError(t, local.handleBlock(b2, source))
+	require.NoError(t, local.handleBlock(b3, source))
+	close(release)
+
+	require.Eventually(t, func() bool {
+		_, height := blkchain.BestBlock()
+		return height == 3
+	}, time.Second*5, time.Millisecond*10, "the orphans should be connected")
+
+	assert.EqualValues(t, 1, atomic.LoadInt32(&sourceReqs), "the missing block should be requested once")
+	assert.Zero(t, atomic.LoadInt32(&otherReqs), "the relaying peer should be asked first")
+}
@@ -0,0 +1,358 @@
+package core
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/meddion/pkg/crypto"
+)
+
+var (
+	ErrInvalidChainParams = errors.New("invalid chain params")
+	ErrUnknownNetwork     = errors.New("unknown network")
+)
+
+// ChainParams are the consensus rules a network agrees upon
+type ChainParams struct {
+	// Name of the network, e.g. "devnet"
+	Network string
+	// Distinguishes the networks that might share a genesis block
+	ChainID uint32
+	Genesis Block
+
+	// Blocks are expected to be found once per TargetBlockTime on average
+	TargetBlockTime time.Duration
+	// Difficulty is recalculated every RetargetWindow blocks. Zero keeps
+	// the difficulty of the genesis block.
+	RetargetWindow int
+	// Also sets the largest target for the compact Bits
+	MinDifficulty Difficulty
+	// Limits the difficulty change on a single retarget. Each step
+	// doubles (or halves) the amount of work needed for a block.
+	MaxRetargetStep Difficulty
+	// A block must be newer than the median timestamp of that many last blocks
+	MedianTimeBlocks int
+	// How far ahead of the network-adjusted time a block can be
+	MaxFutureDrift time.Duration
+
+	// Max number of transactions in a block body
+	MaxBlockTxs int
+	// Max size of the encoded block in bytes
+	MaxBlockSize int
+	// Max size of the encoded transaction in bytes
+	MaxTxSize int
+	// Block versions accepted by the network. Blocks are produced with the highest one.
+	BlockVersions []uint8
+
+	// The subsidy of a coinbase transaction starts at InitialSubsidy and
+	// halves every HalvingInterval blocks. Zero HalvingInterval never halves it.
+	InitialSubsidy  uint64
+	HalvingInterval int
+	// Coinbase outputs can be spent that many blocks after their block
+	CoinbaseMaturity int
+
+	// Allows the blocks to be mined on request. See ControlRPC.HandleGenerate.
+	MineBlocksOnDemand bool
+}
+
+var DefaultChainParams = ChainParams{
+	Network:          "devnet",
+	ChainID:          1,
+	Genesis:          defaultGenesisBlock(),
+	TargetBlockTime:  time.Minute,
+	RetargetWindow:   60,
+	MinDifficulty:    _minDifficulty,
+	MaxRetargetStep:  2,
+	MedianTimeBlocks: 11,
+	MaxFutureDrift:   time.Hour * 2,
+	MaxBlockTxs:      64,
+	MaxBlockSize:     128 << 10,
+	MaxTxSize:        2048,
+	BlockVersions:    []uint8{1, _compactBitsVersion, _taggedMerkleVersion},
+	InitialSubsidy:   50 * _coin,
+	HalvingInterval:  210000,
+	CoinbaseMaturity: 100,
+}
+
+// RegtestChainParams describe a local network for tests: any block takes
+// a couple of hashes to mine, the difficulty never changes, and blocks can be
+// generated on request.
+var RegtestChainParams = ChainParams{
+	Network:            "regtest",
+	ChainID:            2,
+	Genesis:            regtestGenesisBlock(),
+	TargetBlockTime:    time.Minute,
+	RetargetWindow:     0,
+	MinDifficulty:      1,
+	MaxRetargetStep:    2,
+	MedianTimeBlocks:   11,
+	MaxFutureDrift:     time.Hour * 2,
+	MaxBlockTxs:        64,
+	MaxBlockSize:       128 << 10,
+	MaxTxSize:          2048,
+	BlockVersions:      []uint8{LatestBlockVersion},
+	InitialSubsidy:     50 * _coin,
+	HalvingInterval:    150,
+	CoinbaseMaturity:   100,
+	MineBlocksOnDemand: true,
+}
+
+// NetworkParams returns the params of a predefined network by its name.
+func NetworkParams(name string) (*ChainParams, error) {
+	for _, p := range []*ChainParams{&DefaultChainParams, &RegtestChainParams} {
+		if p.Network == name {
+			return p, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%w: %q", ErrUnknownNetwork, name)
+}
+
+func (p *ChainParams) GenesisHash() (crypto.HashValue, error) {
+	return p.Genesis.Header.Checksum()
+}
+
+func (p *ChainParams) isVersionAllowed(ver uint8) bool {
+	for _, v := range p.BlockVersions {
+		if v == ver {
+			return true
+		}
+	}
+
+	return false
+}
+
+// blockVersion returns the version of the blocks produced on the network.
+func (p *ChainParams) blockVersion() uint8 {
+	var latest uint8
+	for _, v := range p.BlockVersions {
+		if v > latest {
+			latest = v
+		}
+	}
+
+	return latest
+}
+
+// Validate checks that the params are consistent and supported by this node.
+func (p *ChainParams) Validate() error {
+	switch {
+	case p.Network == "":
+		return fmt.Errorf("%w: empty network name", ErrInvalidChainParams)
+	case p.TargetBlockTime <= 0, p.MaxFutureDrift <= 0:
+		return fmt.Errorf("%w: durations must be positive", ErrInvalidChainParams)
+	case p.RetargetWindow < 0, p.RetargetWindow == 1, p.MedianTimeBlocks < 1:
+		return fmt.Errorf("%w: windows are too short", ErrInvalidChainParams)
+	case p.MinDifficulty > MaxDifficulty, p.MaxRetargetStep < 1:
+		return fmt.Errorf("%w: difficulty out of range", ErrInvalidChainParams)
+	case p.MaxBlockTxs < 1, p.MaxTxSize < 1:
+		return fmt.Errorf("%w: limits must be positive", ErrInvalidChainParams)
+	case p.MaxBlockSize < HeaderSize+4:
+		return fmt.Errorf("%w: max block size can't fit a header", ErrInvalidChainParams)
+	case p.HalvingInterval < 0, p.CoinbaseMaturity < 0:
+		return fmt.Errorf("%w: reward schedule can't be negative", ErrInvalidChainParams)
+	case len(p.BlockVersions) == 0:
+		return fmt.Errorf("%w: no block versions", ErrInvalidChainParams)
+	}
+
+	for _, v := range p.BlockVersions {
+		if v < 1 || v > LatestBlockVersion {
+			return fmt.Errorf("%w: block version %d isn't supported", ErrInvalidChainParams, v)
+		}
+	}
+
+	if !p.isVersionAllowed(p.Genesis.Version) {
+		return fmt.Errorf("%w: genesis version %d isn't allowed", ErrInvalidChainParams, p.Genesis.Version)
+	}
+
+	if err := verifyBodyLimits(p, p.Genesis); err != nil {
+		return fmt.Errorf("%w: genesis %s", ErrInvalidChainParams, err)
+	}
+
+	root, err := merkleRoot(p.Genesis.Version, p.Genesis.Body)
+	if err != nil {
+		return fmt.Errorf("%w: on generating the genesis merkle root: %s", ErrInvalidChainParams, err)
+	}
+	if root != p.Genesis.MerkleRoot {
+		return fmt.Errorf("%w: genesis %s", ErrInvalidChainParams, ErrInvalidMerkleRoot)
+	}
+
+	return nil
+}
+
+// LoadChainParams reads the params of a network from a JSON genesis file.
+// The fields missing in the file are taken from DefaultChainParams, except
+// for the network name and the genesis block which are required.
+func LoadChainParams(path string) (*ChainParams, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("on reading the genesis file: %w", err)
+	}
+
+	return ParseChainParams(data)
+}
+
+type (
+	genesisFile struct {
+		Network          string         `json:"network"`
+		ChainID          *uint32        `json:"chain_id"`
+		Genesis          *genesisConfig `json:"genesis"`
+		TargetBlockTime  *duration      `json:"target_block_time"`
+		RetargetWindow   *int           `json:"retarget_window"`
+		MinDifficulty    *Difficulty    `json:"min_difficulty"`
+		MaxRetargetStep  *Difficulty    `json:"max_retarget_step"`
+		MedianTimeBlocks *int           `json:"median_time_blocks"`
+		MaxFutureDrift   *duration      `json:"max_future_drift"`
+		MaxBlockTxs      *int           `json:"max_block_txs"`
+		MaxBlockSize     *int           `json:"max_block_size"`
+		MaxTxSize        *int           `json:"max_tx_size"`
+		BlockVersions    []uint8        `json:"block_versions"`
+		InitialSubsidy   *uint64        `json:"initial_subsidy"`
+		HalvingInterval  *int           `json:"halving_interval"`
+		CoinbaseMaturity *int           `json:"coinbase_maturity"`
+		// Only meant for the test networks
+		MineBlocksOnDemand bool `json:"mine_blocks_on_demand"`
+	}
+
+	genesisConfig struct {
+		Version       uint8      `json:"version"`
+		Timestamp     int64      `json:"timestamp"`
+		PrevBlockHash string     `json:"prev_block_hash"`
+		Difficulty    Difficulty `json:"difficulty"`
+		Bits          Bits       `json:"bits"`
+		Nonce         Nonce      `json:"nonce"`
+		// Canonically encoded transactions in hex
+		Transactions []string `json:"transactions"`
+	}
+
+	// duration is a time.Duration written as "1m30s" in JSON
+	duration time.Duration
+)
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+
+	return nil
+}
+
+// ParseChainParams is LoadChainParams for the contents of a genesis file.
+func ParseChainParams(data []byte) (*ChainParams, error) {
+	var f genesisFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidChainParams, err)
+	}
+
+	if f.Genesis == nil {
+		return nil, fmt.Errorf("%w: genesis block is missing", ErrInvalidChainParams)
+	}
+
+	genesis, err := f.Genesis.block()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidChainParams, err)
+	}
+
+	params := DefaultChainParams
+	params.Network = f.Network
+	params.Genesis = genesis
+	if f.ChainID != nil {
+		params.ChainID = *f.ChainID
+	}
+	if f.TargetBlockTime != nil {
+		params.TargetBlockTime = time.Duration(*f.TargetBlockTime)
+	}
+	if f.RetargetWindow != nil {
+		params.RetargetWindow = *f.RetargetWindow
+	}
+	if f.MinDifficulty != nil {
+		params.MinDifficulty = *f.MinDifficulty
+	}
+	if f.MaxRetargetStep != nil {
+		params.MaxRetargetStep = *f.MaxRetargetStep
+	}
+	if f.MedianTimeBlocks != nil {
+		params.MedianTimeBlocks = *f.MedianTimeBlocks
+	}
+	if f.MaxFutureDrift != nil {
+		params.MaxFutureDrift = time.Duration(*f.MaxFutureDrift)
+	}
+	if f.MaxBlockTxs != nil {
+		params.MaxBlockTxs = *f.MaxBlockTxs
+	}
+	if f.MaxBlockSize != nil {
+		params.MaxBlockSize = *f.MaxBlockSize
+	}
+	if f.MaxTxSize != nil {
+		params.MaxTxSize = *f.MaxTxSize
+	}
+	if f.BlockVersions != nil {
+		params.BlockVersions = f.BlockVersions
+	} else {
+		params.BlockVersions = append([]uint8(nil), DefaultChainParams.BlockVersions...)
+	}
+
+	if f.InitialSubsidy != nil {
+		params.InitialSubsidy = *f.InitialSubsidy
+	}
+	if f.HalvingInterval != nil {
+		params.HalvingInterval = *f.HalvingInterval
+	}
+	if f.CoinbaseMaturity != nil {
+		params.CoinbaseMaturity = *f.CoinbaseMaturity
+	}
+
+	params.MineBlocksOnDemand = f.MineBlocksOnDemand
+
+	if err := params.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &params, nil
+}
+
+// block assembles the genesis block. Its merkle root is computed from the transactions.
+func (g genesisConfig) block() (Block, error) {
+	header := Header{
+		Version:    g.Version,
+		Timestamp:  g.Timestamp,
+		Difficulty: g.Difficulty,
+		Bits:       g.Bits,
+		Nonce:      g.Nonce,
+	}
+
+	prev, err := hex.DecodeString(g.PrevBlockHash)
+	if err != nil || (len(prev) != 0 && len(prev) != len(header.PrevBlockHash)) {
+		return Block{}, fmt.Errorf("invalid prev block hash %q", g.PrevBlockHash)
+	}
+	copy(header.PrevBlockHash[:], prev)
+
+	body := make(Body, len(g.Transactions))
+	for i, s := range g.Transactions {
+		b, err := hex.DecodeString(s)
+		if err != nil {
+			return Block{}, fmt.Errorf("on decoding genesis transaction #%d: %w", i, err)
+		}
+
+		if err := body[i].FromBytes(b); err != nil {
+			return Block{}, fmt.Errorf("on decoding genesis transaction #%d: %w", i, err)
+		}
+	}
+
+	if header.MerkleRoot, err = merkleRoot(header.Version, body); err != nil {
+		return Block{}, fmt.Errorf("on generating the genesis merkle root: %w", err)
+	}
+
+	return Block{Header: header, Body: body}, nil
+}
@@ -0,0 +1,112 @@
+package core
+
+import (
+	"encoding/hex"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/meddion/pkg/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseChainParams(t *testing.T) {
+	txs, err := genRandTransactions(2)
+	require.NoError(t, err)
+
+	txHex := make([]string, len(txs))
+	for i, tx := range txs {
+		b, err := tx.Bytes()
+		require.NoError(t, err)
+		txHex[i] = `"` + hex.EncodeToString(b) + `"`
+	}
+
+	params, err := ParseChainParams([]byte(`{
+		"network": "testnet",
+		"chain_id": 7,
+		"target_block_time": "30s",
+		"max_block_txs": 16,
+		"block_versions": [2, 3],
+		"initial_subsidy": 1000,
+		"halving_interval": 500,
+		"genesis": {
+			"version": 3,
+			"timestamp": 1650000000,
+			"bits": 520159231,
+			"transactions": [` + txHex[0] + `, ` + txHex[1] + `]
+		}
+	}`))
+	require.NoError(t, err)
+
+	assert.Equal(t, "testnet", params.Network)
+	assert.Equal(t, uint32(7), params.ChainID)
+	assert.Equal(t, time.Second*30, params.TargetBlockTime)
+	assert.Equal(t, 16, params.MaxBlockTxs)
+	assert.Equal(t, DefaultChainParams.RetargetWindow, params.RetargetWindow, "missing fields should be taken from the defaults")
+	assert.Equal(t, []uint8{2, 3}, params.BlockVersions)
+	assert.Equal(t, uint8(3), params.blockVersion())
+	assert.Equal(t, uint64(1000), params.InitialSubsidy)
+	assert.Equal(t, 500, params.HalvingInterval)
+	assert.Equal(t, DefaultChainParams.CoinbaseMaturity, params.CoinbaseMaturity)
+
+	genesis := params.Genesis
+	assert.Equal(t, crypto.ZeroHashValue, genesis.PrevBlockHash)
+	assert.Equal(t, Bits(0x1f00ffff), genesis.Bits)
+	require.Len(t, genesis.Body, 2)
+	assert.Equal(t, txs[1].Hash, genesis.Body[1].Hash)
+
+	root, err := crypto.GenMerkleRootV2(txs)
+	require.NoError(t, err)
+	assert.Equal(t, root, genesis.MerkleRoot)
+
+	t.Run("invalid", func(t *testing.T) {
+		for _, data := range []string{
+			`{"network": "testnet"}`,
+			`{"genesis": {"version": 1}}`,
+			`{"network": "testnet", "genesis": {"version": 4}}`,
+			`{"network": "testnet", "block_versions": [2], "genesis": {"version": 1}}`,
+			`{"network": "testnet", "max_block_txs": 0, "genesis": {"version": 1}}`,
+			`{"network": "testnet", "coinbase_maturity": -1, "genesis": {"version": 1}}`,
+			`{"network": "testnet", "target_block_time": "1 minute", "genesis": {"version": 1}}`,
+			`{"network": "testnet", "genesis": {"version": 1, "prev_block_hash": "abcd"}}`,
+			`{"network": "testnet", "genesis": {"version": 1, "transactions": ["00"]}}`,
+		} {
+			_, err := ParseChainParams([]byte(data))
+			assert.ErrorIs(t, err, ErrInvalidChainParams, data)
+		}
+	})
+}
+
+func TestCustomGenesis(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "genesis.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{
+		"network": "localnet",
+		"genesis": {"version": 1, "timestamp": 1650000000}
+	}`), 0600))
+
+	params, err := LoadChainParams(path)
+	require.NoError(t, err)
+
+	db, err := NewBlockRepo(filepath.Join(t.TempDir(), "blocks.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	blkchain, err := NewBlockchain(db, params, log.New(io.Discard, "", 0))
+	require.NoError(t, err)
+
+	genesisHash, err := params.GenesisHash()
+	require.NoError(t, err)
+	tip, height := blkchain.BestBlock()
+	assert.Equal(t, genesisHash, tip)
+	assert.Equal(t, 0, height)
+
+	defaultHash, _ := getGenesisPair()
+	assert.NotEqual(t, defaultHash, genesisHash)
+
+	_, err = NewBlockchain(db, &DefaultChainParams, log.New(io.Discard, "", 0))
+	assert.ErrorIs(t, err, ErrGenesisMismatch, "the store belongs to another network")
+}
@@ -1,6 +1,8 @@
 package core
 
 import (
+	"fmt"
+	"io"
 	"log"
 	"sync"
 	"time"
@@ -9,23 +11,67 @@ import (
 type Peer struct {
 	addr Addr
 	Sender
+
+	// Learned during the handshake
+	info    NodeInfo
+	version uint32
+	// Set for the nodes that dialed this one, the Sender is dialed back
+	// to their listen address
+	inbound bool
 }
 
-func NewPeer(addr Addr) (Peer, error) {
+// NewPeer connects to the node and performs the handshake. The connection
+// is closed if the node turns out to be incompatible.
+func NewPeer(addr Addr, local *LocalNode) (Peer, error) {
 	s, err := NewSender(addr)
 	if err != nil {
 		return Peer{}, err
 	}
 
-	return Peer{Sender: s, addr: addr}, nil
+	info, version, err := handshake(s, addr, local)
+	if err != nil {
+		Peer{Sender: s}.close()
+		return Peer{}, fmt.Errorf("on a handshake with %s: %w", addr, err)
+	}
+
+	return Peer{Sender: s, addr: addr, info: info, version: version}, nil
 }
 
 func (p Peer) Addr() Addr {
 	return p.addr
 }
 
+// Info returns what the peer told about itself during the handshake.
+func (p Peer) Info() NodeInfo {
+	return p.info
+}
+
+// Version is the protocol version negotiated with the peer.
+func (p Peer) Version() uint32 {
+	return p.version
+}
+
+// Services returns the services the peer provides.
+func (p Peer) Services() Services {
+	return p.info.Services
+}
+
+// Inbound reports whether the peer has dialed this node.
+func (p Peer) Inbound() bool {
+	return p.inbound
+}
+
+func (p Peer) close() {
+	if c, ok := p.Sender.(io.Closer); ok {
+		c.Close()
+	}
+}
+
 var _ PeerPool = &peerPool{}
 
+// Limits the number of the peers a message is sent to at once
+const _broadcastWorkers = 8
+
 type peerPool struct {
 	logger *log.Logger
 	mtx    sync.RWMutex
@@ -35,13 +81,14 @@ type peerPool struct {
 	processCounter uint8
 }
 
-// Set time parameters to zero to disable it
-func NewPeerPool(logger *log.Logger, peerDiscoveryTime, isAliveTime time.Duration) *peerPool {
+// Set isAliveTime to zero to disable pinging the peers.
+// The new peers are found by the ConnManager.
+func NewPeerPool(logger *log.Logger, isAliveTime time.Duration) *peerPool {
 	p := &peerPool{
 		logger:   logger,
 		peers:    make(map[Addr]Peer),
 		shutdown: make(chan struct{}, 1),
-		done:     make(chan struct{}, 2),
+		done:     make(chan struct{}, 1),
 	}
 
 	job := func(f func(), freq time.Duration) {
@@ -58,12 +105,6 @@ func NewPeerPool(logger *log.Logger, peerDiscoveryTime, isAliveTime time.Duratio
 		}
 	}
 
-	// TODO: handle errors and resource leaks
-	if peerDiscoveryTime != 0 {
-		go job(p.discoverNewPeers, peerDiscoveryTime)
-		p.processCounter++
-	}
-
 	if isAliveTime != 0 {
 		go job(p.pingConnections, isAliveTime)
 		p.processCounter++
@@ -80,15 +121,32 @@ func (p *peerPool) Close() {
 	close(p.done)
 }
 
-func (p *peerPool) add(peer Peer) {
+// Add returns false if there is a peer with the same address already.
+func (p *peerPool) Add(peer Peer) bool {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if _, exists := p.peers[peer.addr]; exists {
+		return false
+	}
 	p.peers[peer.addr] = peer
+
+	return true
 }
 
-func (p *peerPool) Add(peer Peer) {
+// Remove closes the connection to the peer.
+func (p *peerPool) Remove(addr Addr) {
 	p.mtx.Lock()
 	defer p.mtx.Unlock()
 
-	p.add(peer)
+	p.remove(addr)
+}
+
+func (p *peerPool) remove(addr Addr) {
+	if peer, exists := p.peers[addr]; exists {
+		peer.close()
+		delete(p.peers, addr)
+	}
 }
 
 func (p *peerPool) pingConnections() {
@@ -120,57 +178,7 @@ func (p *peerPool) pingConnections() {
 
 	p.mtx.Lock()
 	for peer := range notAlivePeers {
-		delete(p.peers, peer.Addr())
-	}
-	p.mtx.Unlock()
-}
-
-func (p *peerPool) getNewAddresses() (addrs []Addr) {
-	newAddrs := make(chan Addr, 20)
-	errorsChan := p.SendToPeers(func(peer Peer) error {
-		resp, err := peer.SendPeersDiscovery()
-		if err != nil {
-			p.logger.Printf("On getting a peer list from %s", peer.addr)
-			return nil
-		}
-
-		p.mtx.RLock()
-		for _, addr := range resp.addrs {
-			if _, exists := p.peers[addr]; !exists {
-				newAddrs <- addr
-			}
-		}
-		p.mtx.RUnlock()
-
-		return nil
-	})
-
-	go func() {
-		for err := range errorsChan {
-			if err != nil {
-				p.logger.Printf("On sending a msg to a peer: %s", err)
-			}
-		}
-		close(newAddrs)
-	}()
-
-	for addr := range newAddrs {
-		addrs = append(addrs, addr)
-	}
-
-	return addrs
-}
-
-func (p *peerPool) discoverNewPeers() {
-	newAddrs := p.getNewAddresses()
-	p.mtx.Lock()
-	for _, addr := range newAddrs {
-		peer, err := NewPeer(addr)
-		if err != nil {
-			p.logger.Printf("On creating a peer connection: %s", err)
-		}
-
-		p.add(peer)
+		p.remove(peer.Addr())
 	}
 	p.mtx.Unlock()
 }
@@ -179,7 +187,7 @@ func (p *peerPool) Peers() []Peer {
 	p.mtx.RLock()
 	defer p.mtx.RUnlock()
 
-	copyPeers := make([]Peer, len(p.peers))
+	copyPeers := make([]Peer, 0, len(p.peers))
 	for _, peer := range p.peers {
 		copyPeers = append(copyPeers, peer)
 	}
@@ -194,25 +202,39 @@ func (p *peerPool) NumberOfPeers() int {
 	return len(p.peers)
 }
 
+// SendToPeers calls fun for every peer, at most _broadcastWorkers at once.
+// The channel is closed once all the calls return.
 func (p *peerPool) SendToPeers(fun func(Peer) error) <-chan error {
+	peers := p.Peers()
+
 	var (
 		wg      sync.WaitGroup
-		errChan = make(chan error, len(p.peers))
+		errChan = make(chan error, len(peers))
+		jobs    = make(chan Peer, len(peers))
 	)
 
-	wg.Add(len(p.peers))
+	for _, peer := range peers {
+		jobs <- peer
+	}
+	close(jobs)
 
-	p.mtx.RLock()
-	for _, s := range p.peers {
-		go func(p Peer) {
+	workers := _broadcastWorkers
+	if len(peers) < workers {
+		workers = len(peers)
+	}
+
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
 			defer wg.Done()
 
-			if err := fun(p); err != nil {
-				errChan <- err
+			for peer := range jobs {
+				if err := fun(peer); err != nil {
+					errChan <- err
+				}
 			}
-		}(s)
+		}()
 	}
-	p.mtx.RUnlock()
 
 	go func() {
 		wg.Wait()
@@ -3,15 +3,18 @@ package core
 import (
 	"errors"
 	"fmt"
+	"io"
 	"log"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestPingConnections(t *testing.T) {
-	peerPool := NewPeerPool(log.Default(), 0, 0)
+	peerPool := NewPeerPool(log.Default(), 0)
 	defer peerPool.Close()
 	assert.Equal(t, 0, peerPool.NumberOfPeers())
 
@@ -39,3 +42,48 @@ func TestPingConnections(t *testing.T) {
 
 	assert.Equal(t, 2, peerPool.NumberOfPeers(), "should be equal to the active peer number")
 }
+
+func TestSendToPeers(t *testing.T) {
+	peerPool := NewPeerPool(log.New(io.Discard, "", 0), 0)
+
+	for i := 0; i < _broadcastWorkers*3; i++ {
+		addr := Addr{IP: "127.0.0.1", Port: fmt.Sprint(8090 + i)}
+		assert.True(t, peerPool.Add(Peer{addr: addr}))
+		assert.False(t, peerPool.Add(Peer{addr: addr}), "a connected peer shouldn't be replaced")
+	}
+
+	var (
+		mtx                sync.Mutex
+		called             = make(map[Addr]int)
+		running, maxAtOnce int
+	)
+	errs := peerPool.SendToPeers(func(p Peer) error {
+		mtx.Lock()
+		called[p.Addr()]++
+		running++
+		if running > maxAtOnce {
+			maxAtOnce = running
+		}
+		mtx.Unlock()
+
+		time.Sleep(time.Millisecond * 10)
+
+		mtx.Lock()
+		running--
+		mtx.Unlock()
+
+		return errors.New("not alive")
+	})
+
+	var failed int
+	for range errs {
+		failed++
+	}
+
+	assert.Equal(t, _broadcastWorkers*3, failed)
+	assert.Len(t, called, _broadcastWorkers*3)
+	for addr, n := range called {
+		assert.Equal(t, 1, n, "%s should be sent to once", addr)
+	}
+	assert.LessOrEqual(t, maxAtOnce, _broadcastWorkers, "the number of the concurrent sends should be bounded")
+}
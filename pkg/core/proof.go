@@ -7,7 +7,12 @@ import (
 	"github.com/meddion/pkg/crypto"
 )
 
-const _blockDifficalty = 21
+// Headers of this version and above carry a compact PoW target in Bits
+// instead of the Difficulty exponent
+const _compactBitsVersion = 2
+
+// MaxDifficulty is the hardest difficulty, its target is 1
+const MaxDifficulty Difficulty = 255
 
 var (
 	_bigOne    = big.NewInt(1)
@@ -17,40 +22,139 @@ var (
 type (
 	Nonce      uint32
 	Difficulty uint32
+	// Bits is a compact encoding of a 256-bit PoW target: the most significant
+	// byte is the length of the target in bytes and the lower 3 bytes are its
+	// most significant digits. The 0x00800000 bit is a sign and must be unset.
+	Bits uint32
 )
 
+// DifficultyBits returns the target of the difficulty, which is 2^(255-d).
+// The target of a difficulty above MaxDifficulty is 0, no hash meets it.
 func (d Difficulty) DifficultyBits() *big.Int {
+	if d > MaxDifficulty {
+		return new(big.Int)
+	}
+
 	i := big.NewInt(1)
 	i.Lsh(i, uint(255-d))
 
 	return i
 }
 
-func (d Difficulty) WorkAmount() *big.Int {
-	denominator := new(big.Int).Add(d.DifficultyBits(), _bigOne)
+// Bits returns the compact encoding of the difficulty target.
+func (d Difficulty) Bits() Bits {
+	return TargetToBits(d.DifficultyBits())
+}
 
-	return new(big.Int).Div(_oneLsh256, denominator)
+func (d Difficulty) WorkAmount() *big.Int {
+	return workAmount(d.DifficultyBits())
 }
 
 func (d Difficulty) GenNonce(header Header) (Nonce, error) {
+	return genNonce(header, d.DifficultyBits())
+}
+
+func (d Difficulty) VerifyNonce(header Header) error {
+	return verifyNonce(header, d.DifficultyBits())
+}
+
+func (b Bits) Target() *big.Int {
+	if b&0x00800000 != 0 {
+		return new(big.Int)
+	}
+
 	var (
-		tempInt big.Int
-		target  = d.DifficultyBits()
+		mantissa = int64(b & 0x007fffff)
+		exponent = uint(b >> 24)
 	)
 
+	if exponent <= 3 {
+		return big.NewInt(mantissa >> (8 * (3 - exponent)))
+	}
+
+	t := big.NewInt(mantissa)
+	return t.Lsh(t, 8*(exponent-3))
+}
+
+// TargetToBits returns the compact encoding of a target, rounding it down
+// to the 3 most significant bytes.
+func TargetToBits(target *big.Int) Bits {
+	if target.Sign() <= 0 {
+		return 0
+	}
+
+	var (
+		exponent = uint(len(target.Bytes()))
+		mantissa uint64
+	)
+
+	if exponent <= 3 {
+		mantissa = target.Uint64() << (8 * (3 - exponent))
+	} else {
+		mantissa = new(big.Int).Rsh(target, 8*(exponent-3)).Uint64()
+	}
+
+	// The sign bit can't be set, so the mantissa is shifted into the next byte
+	if mantissa&0x00800000 != 0 {
+		mantissa >>= 8
+		exponent++
+	}
+
+	return Bits(uint64(exponent)<<24 | mantissa)
+}
+
+func (b Bits) WorkAmount() *big.Int {
+	return workAmount(b.Target())
+}
+
+func (b Bits) GenNonce(header Header) (Nonce, error) {
+	return genNonce(header, b.Target())
+}
+
+func (b Bits) VerifyNonce(header Header) error {
+	return verifyNonce(header, b.Target())
+}
+
+// Target returns the PoW target encoded by the header depending on its version.
+func (h Header) Target() *big.Int {
+	if h.Version < _compactBitsVersion {
+		return h.Difficulty.DifficultyBits()
+	}
+
+	return h.Bits.Target()
+}
+
+func (h Header) WorkAmount() *big.Int {
+	return workAmount(h.Target())
+}
+
+func (h Header) GenNonce() (Nonce, error) {
+	return genNonce(h, h.Target())
+}
+
+func (h Header) VerifyNonce() error {
+	return verifyNonce(h, h.Target())
+}
+
+// workAmount returns the expected number of hashes needed to find a nonce
+// for the target, which is 2^256 / (target+1).
+func workAmount(target *big.Int) *big.Int {
+	denominator := new(big.Int).Add(target, _bigOne)
+
+	return new(big.Int).Div(_oneLsh256, denominator)
+}
+
+func genNonce(header Header, target *big.Int) (Nonce, error) {
+	var tempInt big.Int
+
 	for i := Nonce(0); i < NonceMaxValue; i++ {
 		header.Nonce = i
-		hb, err := header.Bytes()
+		ok, err := isBelowTarget(header, target, &tempInt)
 		if err != nil {
 			return 0, err
 		}
-		hash, err := crypto.Hash256(hb)
-		if err != nil {
-			return 0, err
-		}
-		tempInt.SetBytes(hash[:])
 
-		if tempInt.Cmp(target) == -1 {
+		if ok {
 			return i, nil
 		}
 	}
@@ -58,22 +162,33 @@ func (d Difficulty) GenNonce(header Header) (Nonce, error) {
 	return 0, errors.New("pow not found")
 }
 
-func (d Difficulty) VerifyNonce(header Header) error {
-	hb, err := header.Bytes()
+func verifyNonce(header Header, target *big.Int) error {
+	var tempInt big.Int
+	ok, err := isBelowTarget(header, target, &tempInt)
 	if err != nil {
 		return err
 	}
 
-	hash, err := crypto.Hash256(hb)
+	if ok {
+		return nil
+	}
+
+	return errors.New("verifying nonce againts target")
+}
+
+// isBelowTarget reports whether the header hash is below the target.
+// tempInt is a scratch space to avoid allocations in loops.
+func isBelowTarget(header Header, target, tempInt *big.Int) (bool, error) {
+	hb, err := header.Bytes()
 	if err != nil {
-		return err
+		return false, err
 	}
 
-	var tempInt big.Int
-	tempInt.SetBytes(hash[:])
-	if tempInt.Cmp(d.DifficultyBits()) == -1 {
-		return nil
+	hash, err := crypto.Hash256(hb)
+	if err != nil {
+		return false, err
 	}
+	tempInt.SetBytes(hash[:])
 
-	return errors.New("verifying nonce againts target")
+	return tempInt.Cmp(target) == -1, nil
 }
@@ -1,6 +1,7 @@
 package core
 
 import (
+	"math/big"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -15,3 +16,62 @@ func TestPowGenesis(t *testing.T) {
 	h.Nonce = nonce
 	assert.NoError(t, pow.VerifyNonce(h))
 }
+
+func TestCompactBits(t *testing.T) {
+	target := func(hex string) *big.Int {
+		i, ok := new(big.Int).SetString(hex, 16)
+		assert.True(t, ok)
+		return i
+	}
+
+	testTable := []struct {
+		bits   Bits
+		target *big.Int
+	}{
+		{0x1d00ffff, target("ffff0000000000000000000000000000000000000000000000000000")},
+		{0x1f010000, Difficulty(15).DifficultyBits()},
+		{0x02008000, big.NewInt(0x80)},
+		{0x01120000, big.NewInt(0x12)},
+		{0x05009234, big.NewInt(0x92340000)},
+	}
+
+	for _, testCase := range testTable {
+		assert.Zero(t, testCase.target.Cmp(testCase.bits.Target()), "target of %08x", testCase.bits)
+		assert.Equal(t, testCase.bits, TargetToBits(testCase.target), "bits of %x", testCase.target)
+	}
+
+	assert.Equal(t, Bits(0x1f010000), Difficulty(15).Bits())
+	assert.Zero(t, Bits(0x04923456).Target().Sign(), "negative targets are invalid")
+	assert.Equal(t, Bits(0x1d00ffff), TargetToBits(target("ffff0100000000000000000000000000000000000000000000000000")),
+		"should round down to 3 significant bytes")
+}
+
+func TestPowCompactBits(t *testing.T) {
+	h := Header{Version: _compactBitsVersion, Bits: 0x1f00ffff}
+	nonce, err := h.GenNonce()
+	assert.NoError(t, err)
+
+	h.Nonce = nonce
+	assert.NoError(t, h.VerifyNonce())
+	assert.NoError(t, h.Verify(&DefaultChainParams))
+
+	assert.Zero(t, h.WorkAmount().Cmp(h.Bits.WorkAmount()))
+	assert.Equal(t, 1, h.WorkAmount().Cmp(Difficulty(15).WorkAmount()),
+		"a lower target requires more work")
+
+	h.Bits = 0x1f010000
+	assert.Equal(t, ErrInvalidNonce, h.Verify(&DefaultChainParams))
+
+	h.Bits = 0x2000ffff
+	assert.Equal(t, ErrInvalidDifficulty, h.Verify(&DefaultChainParams), "targets above the limit are invalid")
+}
+
+func TestDifficultyBounds(t *testing.T) {
+	assert.Zero(t, MaxDifficulty.DifficultyBits().Cmp(big.NewInt(1)))
+	assert.Zero(t, Difficulty(256).DifficultyBits().Sign(), "difficulties above the max have no target")
+
+	for _, diff := range []Difficulty{256, 511, 1 << 31} {
+		h := Header{Version: 1, Difficulty: diff}
+		assert.Equal(t, ErrInvalidDifficulty, h.Verify(&DefaultChainParams), "difficulty %d", diff)
+	}
+}
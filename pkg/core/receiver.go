@@ -1,31 +1,61 @@
 package core
 
 import (
+	"errors"
 	"log"
+	"sync"
 
 	"github.com/meddion/pkg/crypto"
 )
 
+var ErrNoBlockSource = errors.New("no peer to request the block from")
+
+// Limits the number of parent requests made for a single orphan block
+const _maxOrphanParentRequests = 32
+
 type ReceiverRPC struct {
 	blkchain *Blockchain
 	peerPool PeerPool
-	txPool   map[crypto.HashValue]Transaction
+	mempool  *Mempool
+	node     *LocalNode
+	connMgr  *ConnManager
 	logger   *log.Logger
+
+	orphanMtx sync.Mutex
+	// The missing blocks being requested for the orphans
+	orphanReqs map[crypto.HashValue]struct{}
 }
 
-func NewReceiverRPC(blkchain *Blockchain, senderPool PeerPool, logger *log.Logger) Receiver {
+// listenAddr is the address this node is reachable at, it is advertised
+// in the handshakes.
+func NewReceiverRPC(blkchain *Blockchain, mempool *Mempool, senderPool PeerPool, listenAddr Addr, logger *log.Logger) *ReceiverRPC {
 	return &ReceiverRPC{
-		blkchain: blkchain,
-		txPool:   make(map[crypto.HashValue]Transaction),
-		peerPool: senderPool,
-		logger:   logger,
+		blkchain:   blkchain,
+		mempool:    mempool,
+		peerPool:   senderPool,
+		node:       NewLocalNode(blkchain, listenAddr),
+		logger:     logger,
+		orphanReqs: make(map[crypto.HashValue]struct{}),
 	}
 }
 
+// LocalNode returns the description of this node used in the handshakes.
+func (r *ReceiverRPC) LocalNode() *LocalNode {
+	return r.node
+}
+
+// SetConnManager makes the node learn the addresses of the dialing nodes
+// and share the known addresses with its peers. Must be called before
+// the node starts serving.
+func (r *ReceiverRPC) SetConnManager(c *ConnManager) {
+	r.connMgr = c
+}
+
 type PeerPool interface {
 	NumberOfPeers() int
 	SendToPeers(func(Peer) error) <-chan error
-	Add(Peer)
+	Add(Peer) bool
+	Remove(Addr)
 	Peers() []Peer
 	Close()
 }
@@ -36,16 +66,26 @@ func (r *ReceiverRPC) propagateToPeers(f func(s Peer) error) {
 	}
 }
 
+// HandleTransaction verifies a transaction and puts it into the mempool.
+// A rejection isn't an RPC error: it is reported through resp.Msg with
+// resp.Status unset, see SenderRPC.SendTransaction.
 func (r *ReceiverRPC) HandleTransaction(req TransactionReq, resp *TransactionResp) error {
-	if _, exists := r.txPool[req.Hash]; exists {
+	if r.mempool.Has(req.Hash) {
+		resp.Status, resp.Msg = true, ErrTxAlreadyKnown.Error()
 		return nil
 	}
 
-	if err := req.Verify(); err != nil {
-		return err
+	ctx := r.blkchain.nextChainContext()
+	err := r.mempool.AddVerified(req.Transaction, func(pending *PrecedingTxs) error {
+		// The pending transactions go before this one in the next block
+		ctx.Preceding = pending
+		return req.Verify(ctx)
+	})
+	if err != nil {
+		resp.Status, resp.Msg = errors.Is(err, ErrTxAlreadyKnown), err.Error()
+		return nil
 	}
-
-	r.txPool[req.Hash] = req.Transaction
+	resp.Status = true
 
 	r.propagateToPeers(func(p Peer) error {
 		_, err := p.SendTransaction(req)
@@ -56,28 +96,165 @@ func (r *ReceiverRPC) HandleTransaction(req TransactionReq, resp *TransactionRes
 }
 
 func (r *ReceiverRPC) HandleBlock(req BlockReq, resp *Empty) error {
-	if err := r.blkchain.ProcessBlock(req.Block); err != nil {
+	return r.handleBlock(req.Block, Addr{})
+}
+
+// handleBlock processes the block relayed by the pool peer at source,
+// if it is known. The missing parents of an orphan block are requested
+// from that peer first.
+func (r *ReceiverRPC) handleBlock(block Block, source Addr) error {
+	err := r.blkchain.ProcessBlock(block)
+	if errors.Is(err, ErrOrphanBlock) {
+		hash, err := block.Header.Checksum()
+		if err != nil {
+			return err
+		}
+
+		r.fetchOrphanParents(source, hash)
+		return nil
+	}
+	if err != nil {
 		return err
 	}
 
 	r.propagateToPeers(func(p Peer) error {
-		return p.SendBlock(req)
+		return p.SendBlock(BlockReq{Block: block})
 	})
 
 	return nil
 }
 
+// fetchOrphanParents starts requesting the missing ancestors of the orphan
+// unless the missing block is being requested already.
+func (r *ReceiverRPC) fetchOrphanParents(source Addr, orphan crypto.HashValue) {
+	missing, isOrphan := r.blkchain.OrphanRoot(orphan)
+	if !isOrphan {
+		return
+	}
+
+	r.orphanMtx.Lock()
+	_, inFlight := r.orphanReqs[missing]
+	r.orphanReqs[missing] = struct{}{}
+	r.orphanMtx.Unlock()
+
+	if !inFlight {
+		go r.requestOrphanParents(source, missing)
+	}
+}
+
+// requestOrphanParents asks the pool peers for the missing ancestors one by one
+// until the orphan gets connected. Only the pool peers are asked, the peer
+// at source goes first.
+func (r *ReceiverRPC) requestOrphanParents(source Addr, missing crypto.HashValue) {
+	defer func() {
+		r.orphanMtx.Lock()
+		delete(r.orphanReqs, missing)
+		r.orphanMtx.Unlock()
+	}()
+
+	peers := r.peerPool.Peers()
+	for i, p := range peers {
+		if p.Addr() == source {
+			peers[0], peers[i] = peers[i], peers[0]
+			break
+		}
+	}
+
+	for i := 0; i < _maxOrphanParentRequests; i++ {
+		block, err := requestBlock(peers, missing)
+		if err != nil {
+			r.logger.Printf("On requesting block %x: %s", missing, err)
+			return
+		}
+
+		err = r.blkchain.ProcessBlock(block)
+		if err != nil && !errors.Is(err, ErrOrphanBlock) {
+			r.logger.Printf("On processing block %x: %s", missing, err)
+			return
+		}
+
+		next, isOrphan := r.blkchain.OrphanRoot(missing)
+		if !isOrphan {
+			return
+		}
+
+		// Another request may be waiting for the same block
+		r.orphanMtx.Lock()
+		delete(r.orphanReqs, missing)
+		_, inFlight := r.orphanReqs[next]
+		r.orphanReqs[next] = struct{}{}
+		r.orphanMtx.Unlock()
+
+		if inFlight {
+			return
+		}
+		missing = next
+	}
+}
+
+// requestBlock asks the peers for the block one after another until one
+// of them has it.
+func requestBlock(peers []Peer, hash crypto.HashValue) (Block, error) {
+	for _, p := range peers {
+		resp, err := p.SendGetBlocks(GetBlocksReq{Hashes: []crypto.HashValue{hash}})
+		if err != nil || len(resp.Blocks) == 0 {
+			continue
+		}
+
+		if got, err := resp.Blocks[0].Header.Checksum(); err == nil && got == hash {
+			return resp.Blocks[0], nil
+		}
+	}
+
+	return Block{}, ErrNoBlockSource
+}
+
+func (r *ReceiverRPC) HandleGetBlocks(req GetBlocksReq, resp *BlocksResp) error {
+	if len(req.Hashes) > BlocksPerReq {
+		req.Hashes = req.Hashes[:BlocksPerReq]
+	}
+
+	for _, hash := range req.Hashes {
+		block, err := r.blkchain.Block(hash)
+		if errors.Is(err, ErrMissingBlock) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		resp.Blocks = append(resp.Blocks, block)
+	}
+
+	return nil
+}
+
+func (r *ReceiverRPC) HandleGetTxProof(req GetTxProofReq, resp *TxProofResp) error {
+	proof, err := r.blkchain.TxProof(req.BlockHash, req.TxHash)
+	if err != nil {
+		return err
+	}
+	*resp = proof
+
+	return nil
+}
+
 func (r *ReceiverRPC) HandleIsAlive(_ Empty, _ *Empty) error {
 	return nil
 }
 
+// HandlePeersDiscovery replies with up to MaxAddrsPerReply addresses
+// known to the ConnManager.
 func (r *ReceiverRPC) HandlePeersDiscovery(_ Empty, knownPeers *PeersDiscoveryResp) error {
-	peers := r.peerPool.Peers()
-	addrs := make([]Addr, len(peers))
-	for i, p := range peers {
-		addrs[i] = p.Addr()
+	if r.connMgr != nil {
+		knownPeers.Addrs = r.connMgr.KnownAddrs(MaxAddrsPerReply)
 	}
-	knownPeers.addrs = addrs
+
+	return nil
+}
+
+func (r *ReceiverRPC) HandleGetHeaders(req GetHeadersReq, resp *HeadersResp) error {
+	resp.Headers = r.blkchain.HeadersAfter(req.Locator, req.StopHash, HeadersPerReq)
 
 	return nil
 }
@@ -0,0 +1,108 @@
+package core
+
+import (
+	"math/big"
+	"time"
+)
+
+// nextDifficulty returns the difficulty a block following parent must have.
+// It only changes on the window boundaries: if the blocks of the previous
+// window were found more than twice as fast (slow) as targeted, the difficulty
+// goes up (down) by a step for each factor of 2, limited by MaxRetargetStep.
+func (p *ChainParams) nextDifficulty(parent *blockNode) Difficulty {
+	diff := parent.Difficulty
+	if diff < p.MinDifficulty {
+		diff = p.MinDifficulty
+	}
+
+	actual, expected, isBoundary := p.retargetTimespan(parent)
+	if !isBoundary {
+		return diff
+	}
+
+	var step Difficulty
+	switch {
+	case actual < expected/2:
+		for step = 1; step < p.MaxRetargetStep && actual < expected>>(step+1); step++ {
+		}
+		if MaxDifficulty-diff < step {
+			step = MaxDifficulty - diff
+		}
+		diff += step
+	case actual > expected*2:
+		for step = 1; step < p.MaxRetargetStep && actual > expected<<(step+1); step++ {
+		}
+		if diff-p.MinDifficulty < step {
+			step = diff - p.MinDifficulty
+		}
+		diff -= step
+	}
+
+	return diff
+}
+
+// nextBits returns the compact target a block following parent must have.
+// On the window boundaries the target is scaled by the ratio of the actual
+// window timespan to the targeted one, limited by 2^MaxRetargetStep.
+func (p *ChainParams) nextBits(parent *blockNode) Bits {
+	var (
+		powLimit = p.MinDifficulty.DifficultyBits()
+		target   = parentTarget(parent)
+	)
+
+	actual, expected, isBoundary := p.retargetTimespan(parent)
+	if isBoundary && expected > 0 {
+		if min := expected >> p.MaxRetargetStep; actual < min {
+			actual = min
+		}
+		if max := expected << p.MaxRetargetStep; actual > max {
+			actual = max
+		}
+
+		target.Mul(target, big.NewInt(actual))
+		target.Div(target, big.NewInt(expected))
+	}
+
+	if target.Cmp(powLimit) > 0 {
+		target = powLimit
+	}
+
+	return TargetToBits(target)
+}
+
+func parentTarget(parent *blockNode) *big.Int {
+	if parent.Version < _compactBitsVersion {
+		return parent.Difficulty.DifficultyBits()
+	}
+
+	return parent.Bits.Target()
+}
+
+// retargetTimespan returns the actual and the targeted timespans (in seconds)
+// of the window ending with parent if the next block starts a new window.
+func (p *ChainParams) retargetTimespan(parent *blockNode) (actual, expected int64, isBoundary bool) {
+	if p.RetargetWindow <= 0 || (parent.Height+1)%p.RetargetWindow != 0 {
+		return 0, 0, false
+	}
+
+	firstHeight := parent.Height - p.RetargetWindow + 1
+	if firstHeight < 0 {
+		firstHeight = 0
+	}
+	first := parent.Ancestor(firstHeight)
+
+	actual = parent.Timestamp - first.Timestamp
+	expected = int64(parent.Height-first.Height) * int64(p.TargetBlockTime/time.Second)
+
+	return actual, expected, true
+}
+
+// NextDifficulty returns the difficulty required for a block on top of the main chain.
+func (b *Blockchain) NextDifficulty() Difficulty {
+	return b.params.nextDifficulty(b.tipNode())
+}
+
+// NextBits returns the compact target required for a block on top of the main chain.
+func (b *Blockchain) NextBits() Bits {
+	return b.params.nextBits(b.tipNode())
+}
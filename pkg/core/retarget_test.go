@@ -0,0 +1,138 @@
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNextDifficulty(t *testing.T) {
+	params := &ChainParams{
+		TargetBlockTime: time.Second * 10,
+		RetargetWindow:  10,
+		MinDifficulty:   15,
+		MaxRetargetStep: 2,
+	}
+
+	_, genesis := getGenesisPair()
+	tip, err := newBlockNode(nil, genesis.Header)
+	require.NoError(t, err)
+
+	// mine appends blocks found every interval seconds,
+	// as a network with a constant hashrate would do
+	mine := func(blocks int, interval int64) {
+		for i := 0; i < blocks; i++ {
+			h := tip.Header()
+			h.PrevBlockHash = tip.Hash
+			h.Timestamp += interval
+			h.Difficulty = params.nextDifficulty(tip)
+
+			tip, err = newBlockNode(tip, h)
+			require.NoError(t, err)
+		}
+	}
+
+	testTable := []struct {
+		name     string
+		interval int64
+		expected Difficulty
+	}{
+		{"on_target", 10, 15},
+		{"hashrate_x5", 2, 17},
+		{"hashrate_x2.5", 4, 18},
+		{"hashrate_x2", 5, 18},
+		{"hashrate_dropped_x6", 60, 16},
+		{"hashrate_dropped_x3", 30, 15},
+		{"below_min_difficulty", 100, 15},
+	}
+
+	for _, testCase := range testTable {
+		mine(params.RetargetWindow, testCase.interval)
+		assert.Equal(t, testCase.expected, params.nextDifficulty(tip), testCase.name)
+	}
+}
+
+func TestRejectUnexpectedDifficulty(t *testing.T) {
+	blkchain := newTestBlockchain(t)
+	assert.Equal(t, DefaultChainParams.MinDifficulty, blkchain.NextDifficulty())
+
+	_, genesis := getGenesisPair()
+	block := mineTestBlock(t, genesis, 1)
+	block.Difficulty = blkchain.NextDifficulty() + 1
+	block.Nonce, _ = block.Difficulty.GenNonce(block.Header)
+
+	assert.ErrorIs(t, blkchain.ProcessBlock(block), ErrInvalidDifficulty)
+}
+
+func TestNextBits(t *testing.T) {
+	params := &ChainParams{
+		TargetBlockTime: time.Second * 10,
+		RetargetWindow:  10,
+		MinDifficulty:   15,
+		MaxRetargetStep: 2,
+	}
+	powLimit := params.MinDifficulty.Bits()
+
+	_, genesis := getGenesisPair()
+	tip, err := newBlockNode(nil, genesis.Header)
+	require.NoError(t, err)
+
+	mine := func(blocks int, interval int64) {
+		for i := 0; i < blocks; i++ {
+			h := tip.Header()
+			h.Version = _compactBitsVersion
+			h.PrevBlockHash = tip.Hash
+			h.Timestamp += interval
+			h.Difficulty = 0
+			h.Bits = params.nextBits(tip)
+
+			tip, err = newBlockNode(tip, h)
+			require.NoError(t, err)
+		}
+	}
+
+	assert.Equal(t, powLimit, params.nextBits(tip), "v1 parents below the min difficulty are capped")
+
+	// The target is scaled by actual/expected timespans of 9 intervals
+	testTable := []struct {
+		name     string
+		interval int64
+		expected Bits
+	}{
+		{"on_target", 10, powLimit},
+		{"hashrate_x2", 5, 0x1f008000},
+		{"hashrate_x1.5", 7, 0x1e599999},
+		{"hashrate_x10_limited", 1, 0x1e15e6f7},
+		{"hashrate_dropped_x10_limited", 100, 0x1e579bdc},
+		{"below_min_difficulty", 100, powLimit},
+	}
+
+	for _, testCase := range testTable {
+		mine(params.RetargetWindow, testCase.interval)
+		assert.Equal(t, testCase.expected, params.nextBits(tip), testCase.name)
+	}
+}
+
+func TestCompactBitsUpgrade(t *testing.T) {
+	blkchain := newTestBlockchain(t)
+
+	_, genesis := getGenesisPair()
+	v2 := mineTestBlock(t, genesis, 1)
+	v2.Version = _compactBitsVersion
+	v2.Difficulty = 0
+	v2.Bits = blkchain.NextBits()
+	v2.Nonce, _ = v2.Header.GenNonce()
+	require.NoError(t, blkchain.ProcessBlock(v2), "on upgrading to compact bits")
+
+	v1 := mineTestBlock(t, v2, 1)
+	assert.ErrorIs(t, blkchain.ProcessBlock(v1), ErrUnsupportedVer, "versions can't go down")
+
+	wrongBits := mineTestBlock(t, v2, 1)
+	wrongBits.Version = _compactBitsVersion
+	wrongBits.Difficulty = 0
+	wrongBits.Bits = 0x1f008000
+	wrongBits.Nonce, _ = wrongBits.Header.GenNonce()
+	assert.ErrorIs(t, blkchain.ProcessBlock(wrongBits), ErrInvalidDifficulty)
+}
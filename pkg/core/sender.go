@@ -1,21 +1,35 @@
 package core
 
 import (
+	"bufio"
 	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
 	"net/rpc"
 	"time"
 )
 
-const _isAliveWaitDuration = time.Second * 5
+const (
+	_isAliveWaitDuration = time.Second * 5
+	_dialTimeout         = time.Second * 10
+	_callTimeout         = time.Second * 30
+	// The status net/rpc replies to the HTTP CONNECT with
+	_rpcConnected = "200 Connected to Go RPC"
+)
 
-var ErrIsAliveTimeout = errors.New("timeout for peer")
+var (
+	ErrIsAliveTimeout = errors.New("timeout for peer")
+	ErrCallTimeout    = errors.New("peer didn't reply in time")
+)
 
 type SenderRPC struct {
 	client *rpc.Client
 }
 
 func NewSender(addr Addr) (Sender, error) {
-	c, err := rpc.DialHTTPPath("tcp", addr.String(), _rpcPath)
+	c, err := dialRPC(addr, _dialTimeout)
 	if err != nil {
 		return SenderRPC{}, err
 	}
@@ -23,16 +37,74 @@ func NewSender(addr Addr) (Sender, error) {
 	return SenderRPC{client: c}, nil
 }
 
+// dialRPC works like rpc.DialHTTPPath but gives up on the nodes that
+// don't reply in time.
+func dialRPC(addr Addr, timeout time.Duration) (*rpc.Client, error) {
+	conn, err := net.DialTimeout("tcp", addr.String(), timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	var resp *http.Response
+	if _, err = io.WriteString(conn, "CONNECT "+_rpcPath+" HTTP/1.0\n\n"); err == nil {
+		resp, err = http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
+	}
+	if err == nil && resp.Status != _rpcConnected {
+		err = fmt.Errorf("unexpected HTTP response: %s", resp.Status)
+	}
+	if err == nil {
+		err = conn.SetDeadline(time.Time{})
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("on connecting to %s: %w", addr, err)
+	}
+
+	return rpc.NewClient(conn), nil
+}
+
+func (s SenderRPC) Close() error {
+	return s.client.Close()
+}
+
+// call works like rpc.Client.Call but gives up on the peers that don't
+// reply in time.
+func (s SenderRPC) call(method string, args, reply interface{}) error {
+	call := s.client.Go(method, args, reply, make(chan *rpc.Call, 1))
+
+	select {
+	case c := <-call.Done:
+		return c.Error
+	case <-time.After(_callTimeout):
+	}
+
+	return fmt.Errorf("%w: %s", ErrCallTimeout, method)
+}
+
+func (s SenderRPC) SendHandshake(req HandshakeReq) (HandshakeResp, error) {
+	var resp HandshakeResp
+	if err := s.call("ReceiverRPC.HandleHandshake", req, &resp); err != nil {
+		return HandshakeResp{}, err
+	}
+
+	return resp, resp.Err()
+}
+
 func (s SenderRPC) SendTransaction(req TransactionReq) (TransactionResp, error) {
 	var resp TransactionResp
 
-	err := s.client.Call("ReceiverRPC.HandleTransaction", &req, &resp)
+	err := s.call("ReceiverRPC.HandleTransaction", &req, &resp)
 
 	if err != nil {
 		return TransactionResp{}, err
 	}
 
-	return resp, nil
+	return resp, resp.Err()
 }
 
 func (s SenderRPC) SendIsAlive() error {
@@ -48,7 +120,7 @@ func (s SenderRPC) SendIsAlive() error {
 }
 
 func (s SenderRPC) SendBlock(blockReq BlockReq) error {
-	err := s.client.Call("ReceiverRPC.HandleBlock", blockReq, &Empty{})
+	err := s.call("ReceiverRPC.HandleBlock", blockReq, &Empty{})
 	if err != nil {
 		return err
 	}
@@ -58,10 +130,40 @@ func (s SenderRPC) SendBlock(blockReq BlockReq) error {
 
 func (s SenderRPC) SendPeersDiscovery() (PeersDiscoveryResp, error) {
 	var knownPeers PeersDiscoveryResp
-	err := s.client.Call("ReceiverRPC.HandleBlock", Empty{}, &knownPeers)
+	err := s.call("ReceiverRPC.HandlePeersDiscovery", Empty{}, &knownPeers)
 	if err != nil {
 		return PeersDiscoveryResp{}, err
 	}
 
 	return knownPeers, nil
 }
+
+func (s SenderRPC) SendGetBlocks(req GetBlocksReq) (BlocksResp, error) {
+	var resp BlocksResp
+	err := s.call("ReceiverRPC.HandleGetBlocks", req, &resp)
+	if err != nil {
+		return BlocksResp{}, err
+	}
+
+	return resp, nil
+}
+
+func (s SenderRPC) SendGetHeaders(req GetHeadersReq) (HeadersResp, error) {
+	var resp HeadersResp
+	err := s.call("ReceiverRPC.HandleGetHeaders", req, &resp)
+	if err != nil {
+		return HeadersResp{}, err
+	}
+
+	return resp, nil
+}
+
+func (s SenderRPC) SendGetTxProof(req GetTxProofReq) (TxProofResp, error) {
+	var resp TxProofResp
+	err := s.call("ReceiverRPC.HandleGetTxProof", req, &resp)
+	if err != nil {
+		return TxProofResp{}, err
+	}
+
+	return resp, nil
+}
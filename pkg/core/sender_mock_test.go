@@ -47,6 +47,66 @@ func (mr *MockSenderMockRecorder) SendBlock(arg0 interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SendBlock", reflect.TypeOf((*MockSender)(nil).SendBlock), arg0)
 }
 
+// SendGetBlocks mocks base method.
+func (m *MockSender) SendGetBlocks(arg0 GetBlocksReq) (BlocksResp, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SendGetBlocks", arg0)
+	ret0, _ := ret[0].(BlocksResp)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// SendGetBlocks indicates an expected call of SendGetBlocks.
+func (mr *MockSenderMockRecorder) SendGetBlocks(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SendGetBlocks", reflect.TypeOf((*MockSender)(nil).SendGetBlocks), arg0)
+}
+
+// SendGetHeaders mocks base method.
+func (m *MockSender) SendGetHeaders(arg0 GetHeadersReq) (HeadersResp, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SendGetHeaders", arg0)
+	ret0, _ := ret[0].(HeadersResp)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// SendGetHeaders indicates an expected call of SendGetHeaders.
+func (mr *MockSenderMockRecorder) SendGetHeaders(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SendGetHeaders", reflect.TypeOf((*MockSender)(nil).SendGetHeaders), arg0)
+}
+
+// SendGetTxProof mocks base method.
+func (m *MockSender) SendGetTxProof(arg0 GetTxProofReq) (TxProofResp, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SendGetTxProof", arg0)
+	ret0, _ := ret[0].(TxProofResp)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// SendGetTxProof indicates an expected call of SendGetTxProof.
+func (mr *MockSenderMockRecorder) SendGetTxProof(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SendGetTxProof", reflect.TypeOf((*MockSender)(nil).SendGetTxProof), arg0)
+}
+
+// SendHandshake mocks base method.
+func (m *MockSender) SendHandshake(arg0 HandshakeReq) (HandshakeResp, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SendHandshake", arg0)
+	ret0, _ := ret[0].(HandshakeResp)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// SendHandshake indicates an expected call of SendHandshake.
+func (mr *MockSenderMockRecorder) SendHandshake(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SendHandshake", reflect.TypeOf((*MockSender)(nil).SendHandshake), arg0)
+}
+
 // SendIsAlive mocks base method.
 func (m *MockSender) SendIsAlive() error {
 	m.ctrl.T.Helper()
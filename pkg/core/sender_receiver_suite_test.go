@@ -5,6 +5,7 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"sync"
 	"testing"
 	"time"
 
@@ -20,30 +21,47 @@ const (
 
 type mockPeerPool struct {
 	PeerPool
+
+	mtx   sync.Mutex
+	peers []Peer
 }
 
-func (m mockPeerPool) Peers() []Peer {
-	addr := Addr{_testAddr, _testPort}
-	s, err := NewSender(addr)
+// connect makes the handshake with the node at addr and adds it to the pool.
+func (m *mockPeerPool) connect(addr Addr, local *LocalNode) error {
+	peer, err := NewPeer(addr, local)
 	if err != nil {
-		log.Fatalf("on creating a test sender: %v", err)
+		return err
 	}
 
-	return []Peer{{Sender: s, addr: addr}}
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	m.peers = append(m.peers, peer)
+	return nil
+}
+
+func (m *mockPeerPool) Peers() []Peer {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	return append([]Peer(nil), m.peers...)
 }
 
-func (m mockPeerPool) NumberOfPeers() int {
-	return 1
+func (m *mockPeerPool) NumberOfPeers() int {
+	return len(m.Peers())
 }
 
-func (m mockPeerPool) SendToPeers(_ func(Peer) error) <-chan error {
+func (m *mockPeerPool) SendToPeers(_ func(Peer) error) <-chan error {
 	c := make(chan error)
 	close(c)
 
 	return c
 }
 
-func (m mockPeerPool) Close() {
+func (m *mockPeerPool) Close() {
+	for _, p := range m.Peers() {
+		p.close()
+	}
 }
 
 type senderReceiverSuite struct {
@@ -60,13 +78,17 @@ func (s *senderReceiverSuite) SetupSuite() {
 	s.NoError(err, "on creating a block repo")
 
 	logger := log.Default()
-	s.blkchain, err = NewBlockchain(db, logger)
+	s.blkchain, err = NewBlockchain(db, &DefaultChainParams, logger)
 
 	s.NoError(err, "on creating the Blockchain instance")
 
-	s.peerPool = mockPeerPool{}
+	pool := &mockPeerPool{}
+	s.peerPool = pool
 
-	rcv := NewReceiverRPC(s.blkchain, s.peerPool, logger)
+	rcv := NewReceiverRPC(s.blkchain, NewMempool(DefaultMempoolConfig, logger), s.peerPool, Addr{_testAddr, _testPort}, logger)
+	book, err := NewAddrBook(db)
+	s.NoError(err, "on loading the address book")
+	rcv.SetConnManager(NewConnManager(s.peerPool, rcv.LocalNode(), book, DefaultConnLimits, logger))
 
 	s.signer, err = crypto.NewSignerECDSA()
 	s.NoError(err, "on creating a signer")
@@ -78,6 +100,8 @@ func (s *senderReceiverSuite) SetupSuite() {
 		s.Equal(http.ErrServerClosed, s.serv.Start(_testAddr, _testPort), "on closing a server")
 	}()
 	<-time.After(time.Millisecond * 500)
+
+	s.NoError(pool.connect(Addr{_testAddr, _testPort}, NewLocalNode(s.blkchain, Addr{})), "on connecting to the server")
 }
 
 func (s *senderReceiverSuite) TearDownSuite() {
@@ -119,6 +143,7 @@ func (s *senderReceiverSuite) TestTransactions() {
 	}
 }
 func (s *senderReceiverSuite) TestBlocks() {
+	genesisHash, _ := getGenesisPair()
 	c := s.peerPool.Peers()[0]
 
 	txs, err := genRandTransactions(25)
@@ -130,7 +155,7 @@ func (s *senderReceiverSuite) TestBlocks() {
 	h := Header{
 		Version:       1,
 		Timestamp:     time.Now().Unix(),
-		PrevBlockHash: _genesisBlockHash,
+		PrevBlockHash: genesisHash,
 		MerkleRoot:    merkleRoot,
 		Difficulty:    Difficulty(15),
 	}
@@ -140,7 +165,7 @@ func (s *senderReceiverSuite) TestBlocks() {
 	h.Nonce = nonce
 
 	newBlockReq := BlockReq{
-		Block{
+		Block: Block{
 			Header: h,
 			Body:   txs,
 		},
@@ -148,6 +173,84 @@ func (s *senderReceiverSuite) TestBlocks() {
 
 	s.NoError(c.SendBlock(newBlockReq), "on commiting a new block")
 }
+
+func (s *senderReceiverSuite) TestGetBlocks() {
+	c := s.peerPool.Peers()[0]
+
+	genesisHash, genesis := getGenesisPair()
+	resp, err := c.SendGetBlocks(GetBlocksReq{
+		Hashes: []crypto.HashValue{genesisHash, {0x1}},
+	})
+	s.NoError(err, "on requesting blocks")
+
+	s.Len(resp.Blocks, 1, "unknown blocks should be skipped")
+	s.Equal(genesis.Header, resp.Blocks[0].Header)
+}
+
+func (s *senderReceiverSuite) TestGetTxProof() {
+	genesisHash, _ := getGenesisPair()
+	c := s.peerPool.Peers()[0]
+
+	txs, err := genRandTransactions(5)
+	s.NoError(err, "generating random txs")
+
+	merkleRoot, err := crypto.GenMerkleRoot(txs)
+	s.NoError(err, "on generating merkle root")
+
+	h := Header{
+		Version:       1,
+		Timestamp:     time.Now().Unix() + 1,
+		PrevBlockHash: genesisHash,
+		MerkleRoot:    merkleRoot,
+		Difficulty:    Difficulty(15),
+	}
+	h.Nonce, err = h.Difficulty.GenNonce(h)
+	s.NoError(err, "on generating nonce for header")
+	s.NoError(c.SendBlock(BlockReq{Block: Block{Header: h, Body: txs}}), "on commiting a new block")
+
+	blockHash, err := h.Checksum()
+	s.NoError(err, "on hashing a header")
+
+	resp, err := c.SendGetTxProof(GetTxProofReq{BlockHash: blockHash, TxHash: txs[3].Hash})
+	s.NoError(err, "on requesting a proof")
+	s.Equal(h, resp.Header)
+	s.Equal(1, resp.Height)
+	s.NoError(VerifyTxProof(resp.Header, txs[3], resp.Proof))
+	s.Error(VerifyTxProof(resp.Header, txs[2], resp.Proof))
+
+	_, err = c.SendGetTxProof(GetTxProofReq{BlockHash: blockHash, TxHash: crypto.HashValue{0x1}})
+	s.EqualError(err, ErrTxNotInBlock.Error())
+}
+
 func TestSuite(t *testing.T) {
 	suite.Run(t, new(senderReceiverSuite))
 }
+
+func (s *senderReceiverSuite) TestHandshake() {
+	addr := Addr{_testAddr, _testPort}
+
+	peer, err := NewPeer(addr, NewLocalNode(s.blkchain, Addr{}))
+	s.NoError(err, "on connecting to a peer")
+	s.Equal(ProtocolVersion, peer.Version())
+	s.True(peer.Services().Has(ServiceBlocks | ServiceTxProofs))
+	s.Equal(addr, peer.Info().ListenAddr)
+
+	params := DefaultChainParams
+	params.ChainID++
+	_, err = NewPeer(addr, NewLocalNode(newTestBlockchainWithParams(s.T(), &params), Addr{}))
+	s.ErrorIs(err, ErrPeerRejected)
+	s.Contains(err.Error(), ErrChainMismatch.Error(), "the reason should be reported")
+}
+
+func (s *senderReceiverSuite) TestPeersDiscovery() {
+	advertised := Addr{IP: "203.0.113.9", Port: "9999"}
+
+	peer, err := NewPeer(Addr{_testAddr, _testPort}, NewLocalNode(newTestBlockchain(s.T()), advertised))
+	s.NoError(err, "on connecting to a peer")
+
+	resp, err := peer.SendPeersDiscovery()
+	s.NoError(err, "on asking for the addresses")
+	s.Len(resp.Addrs, 1)
+	s.Equal(advertised, resp.Addrs[0].Addr, "the advertised listen address should be shared")
+	s.InDelta(time.Now().Unix(), resp.Addrs[0].LastSeen, 5)
+}
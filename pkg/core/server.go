@@ -2,6 +2,8 @@ package core
 
 import (
 	"context"
+	"io"
+	"log"
 	"net"
 	"net/http"
 	"net/rpc"
@@ -9,18 +11,40 @@ import (
 )
 
 type Server struct {
-	serv *http.Server
+	serv     *http.Server
+	rcv      Receiver
+	services []interface{}
 }
 
+// connReceiver is implemented by the receivers that track the connections
+// they serve, see ReceiverRPC.serveConn.
+type connReceiver interface {
+	serveConn(net.Conn) (Receiver, func(), error)
+}
+
+// NewServer serves the Receiver to the peers.
 func NewServer(rcv Receiver) (*Server, error) {
-	s := Server{}
-	rpcServer := rpc.NewServer()
-	if err := rpcServer.Register(rcv); err != nil {
+	return newServer(rcv)
+}
+
+// NewControlServer serves the ControlRPC to the node operator. It must
+// listen apart from the peers, on a loopback address.
+func NewControlServer(ctl *ControlRPC) (*Server, error) {
+	return newServer(nil, ctl)
+}
+
+// newServer serves the Receiver, if any, and the services over
+// the same RPC path.
+func newServer(rcv Receiver, services ...interface{}) (*Server, error) {
+	s := Server{rcv: rcv, services: services}
+	// The services are registered anew for every connection,
+	// this checks them once
+	if _, err := s.rpcServer(rcv); err != nil {
 		return nil, err
 	}
 
 	mux := http.NewServeMux()
-	mux.Handle(_rpcPath, rpcServer)
+	mux.HandleFunc(_rpcPath, s.serveRPC)
 	s.serv = &http.Server{
 		Handler: mux,
 	}
@@ -28,6 +52,56 @@ func NewServer(rcv Receiver) (*Server, error) {
 	return &s, nil
 }
 
+func (s *Server) rpcServer(rcv Receiver) (*rpc.Server, error) {
+	rpcServer := rpc.NewServer()
+	if rcv != nil {
+		if err := rpcServer.RegisterName("ReceiverRPC", rcv); err != nil {
+			return nil, err
+		}
+	}
+	for _, service := range s.services {
+		if err := rpcServer.Register(service); err != nil {
+			return nil, err
+		}
+	}
+
+	return rpcServer, nil
+}
+
+// serveRPC works as rpc.Server.ServeHTTP, but every connection gets its
+// own Receiver so that the inbound peers can be told apart.
+func (s *Server) serveRPC(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodConnect {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		io.WriteString(w, "405 must CONNECT\n")
+		return
+	}
+
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		log.Printf("On hijacking the connection from %s: %s", req.RemoteAddr, err)
+		return
+	}
+	io.WriteString(conn, "HTTP/1.0 "+_rpcConnected+"\n\n")
+
+	rcv, done := s.rcv, func() {}
+	if c, ok := s.rcv.(connReceiver); ok {
+		if rcv, done, err = c.serveConn(conn); err != nil {
+			conn.Close()
+			return
+		}
+	}
+	defer done()
+
+	rpcServer, err := s.rpcServer(rcv)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	rpcServer.ServeConn(conn)
+}
+
 func (s *Server) Start(addr, port string) error {
 	l, err := net.Listen("tcp", addr+":"+port)
 	if err != nil {
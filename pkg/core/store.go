@@ -10,16 +10,23 @@ import (
 )
 
 const (
-	_dbPath   = "./blocks.db"
-	_dbBucket = "blocks"
+	_dbPath             = "./blocks.db"
+	_dbBucket           = "blocks"
+	_dbChainStateBucket = "chainstate"
+	// Keys the blocks rejected on connecting, see StoreInvalid
+	_dbInvalidBucket = "invalid"
 )
 
-var _lastCommitedBlockNodeKey = []byte("lastCommited")
+var (
+	_lastCommitedBlockNodeKey = []byte("lastCommited")
+	_genesisBlockKey          = []byte("genesis")
+)
 
 var (
 	ErrBucketNotFound    = errors.New("bucket not found")
 	ErrMissingBlock      = errors.New("block is missing")
 	ErrMissingParentNode = errors.New("parent node is missing")
+	ErrMissingChainState = errors.New("chain state is missing")
 )
 
 type BlockRepo struct {
@@ -37,9 +44,11 @@ func NewBlockRepo(dbFile string) (*BlockRepo, error) {
 	}
 
 	if err := db.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucket([]byte(_dbBucket))
-		if err != nil && err != bolt.ErrBucketExists {
-			return fmt.Errorf("create bucket: %s", err)
+		for _, bucket := range []string{_dbBucket, _dbChainStateBucket, _dbInvalidBucket, _dbUTXOBucket, _dbUTXOUndoBucket, _dbAddrBookBucket} {
+			_, err := tx.CreateBucket([]byte(bucket))
+			if err != nil && err != bolt.ErrBucketExists {
+				return fmt.Errorf("create bucket: %s", err)
+			}
 		}
 
 		return nil
@@ -102,6 +111,119 @@ func (b *BlockRepo) Store(hashKey []byte, block bytesConverter) error {
 	})
 }
 
+// ForEach calls f for every stored block. Stops on the first error.
+func (b *BlockRepo) ForEach(f func(crypto.HashValue, Block) error) error {
+	return b.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(_dbBucket))
+		if bucket == nil {
+			return ErrBucketNotFound
+		}
+
+		return bucket.ForEach(func(k, v []byte) error {
+			// Skip the records that aren't blocks
+			if len(k) != int(crypto.HashLen) {
+				return nil
+			}
+
+			var (
+				hash  crypto.HashValue
+				block Block
+			)
+			copy(hash[:], k)
+			if err := block.FromBytes(v); err != nil {
+				return fmt.Errorf("on decoding block %x: %w", k, err)
+			}
+
+			return f(hash, block)
+		})
+	})
+}
+
+// StoreTip remembers the hash of the main chain tip.
+func (b *BlockRepo) StoreTip(hash crypto.HashValue) error {
+	return b.putChainState(_lastCommitedBlockNodeKey, hash)
+}
+
+func (b *BlockRepo) Tip() (crypto.HashValue, error) {
+	return b.getChainState(_lastCommitedBlockNodeKey)
+}
+
+// StoreInvalid remembers the block failed to connect to the main chain.
+func (b *BlockRepo) StoreInvalid(hash crypto.HashValue) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(_dbInvalidBucket))
+		if bucket == nil {
+			return ErrBucketNotFound
+		}
+
+		return bucket.Put(hash[:], []byte{1})
+	})
+}
+
+// InvalidBlocks returns the hashes of the blocks remembered by StoreInvalid.
+func (b *BlockRepo) InvalidBlocks() ([]crypto.HashValue, error) {
+	var hashes []crypto.HashValue
+	if err := b.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(_dbInvalidBucket))
+		if bucket == nil {
+			return ErrBucketNotFound
+		}
+
+		return bucket.ForEach(func(k, _ []byte) error {
+			var hash crypto.HashValue
+			copy(hash[:], k)
+			hashes = append(hashes, hash)
+			return nil
+		})
+	}); err != nil {
+		return nil, err
+	}
+
+	return hashes, nil
+}
+
+// StoreGenesis remembers the hash of the genesis block the stored chain is built upon.
+func (b *BlockRepo) StoreGenesis(hash crypto.HashValue) error {
+	return b.putChainState(_genesisBlockKey, hash)
+}
+
+func (b *BlockRepo) Genesis() (crypto.HashValue, error) {
+	return b.getChainState(_genesisBlockKey)
+}
+
+func (b *BlockRepo) putChainState(key []byte, hash crypto.HashValue) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(_dbChainStateBucket))
+		if bucket == nil {
+			return ErrBucketNotFound
+		}
+
+		return bucket.Put(key, hash[:])
+	})
+}
+
+func (b *BlockRepo) getChainState(key []byte) (crypto.HashValue, error) {
+	var hash crypto.HashValue
+	if err := b.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(_dbChainStateBucket))
+		if bucket == nil {
+			return ErrBucketNotFound
+		}
+
+		val := bucket.Get(key)
+		if len(val) != len(hash) {
+			return ErrMissingChainState
+		}
+		copy(hash[:], val)
+
+		return nil
+	}); err != nil {
+		return crypto.ZeroHashValue, err
+	}
+
+	return hash, nil
+}
+
 func (b *BlockRepo) Close() error {
 	return b.db.Close()
 }
@@ -0,0 +1,328 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/meddion/pkg/crypto"
+)
+
+const (
+	// Number of blocks downloaded before they are processed
+	_blockDownloadWindow     = 128
+	_maxBlockRequestAttempts = 3
+	// Limits the headers downloaded from a peer in a sync round,
+	// the rest of them are downloaded in the next rounds
+	_maxSyncHeaders = HeadersPerReq * 20
+)
+
+var (
+	ErrUnconnectedHeaders = errors.New("headers don't connect to the known chain")
+	ErrStalledHeaders     = errors.New("headers don't advance the chain")
+	ErrTooManyHeaders     = errors.New("too many headers in a reply")
+	ErrBlocksUnavailable  = errors.New("blocks are unavailable from peers")
+)
+
+// SyncProgress reports how far the local chain is from the best chain known to peers.
+type SyncProgress struct {
+	Height         int
+	BestPeerHeight int
+	// Synced is set once a sync round has found nothing more to download
+	Synced bool
+}
+
+// Syncer downloads the best chain from peers: headers are fetched and
+// validated first, then blocks are requested from several peers in parallel.
+type Syncer struct {
+	blkchain *Blockchain
+	peerPool PeerPool
+	logger   *log.Logger
+
+	mtx            sync.RWMutex
+	bestPeerHeight int
+	synced         bool
+}
+
+func NewSyncer(blkchain *Blockchain, peerPool PeerPool, logger *log.Logger) *Syncer {
+	return &Syncer{
+		blkchain: blkchain,
+		peerPool: peerPool,
+		logger:   logger,
+	}
+}
+
+func (s *Syncer) Progress() SyncProgress {
+	_, height := s.blkchain.BestBlock()
+
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	best := s.bestPeerHeight
+	if height > best {
+		best = height
+	}
+
+	return SyncProgress{
+		Height:         height,
+		BestPeerHeight: best,
+		Synced:         s.synced && height >= s.bestPeerHeight,
+	}
+}
+
+// Run keeps the chain in sync with peers until ctx is done.
+func (s *Syncer) Run(ctx context.Context, interval time.Duration) {
+	s.logger.Print("Starting to sync the Blockchain...")
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for wasSynced := false; ; {
+		if err := s.Sync(ctx); err != nil {
+			s.logger.Printf("On syncing the Blockchain: %s", err)
+		}
+
+		if p := s.Progress(); p.Synced && !wasSynced {
+			s.logger.Printf("All relevant blocks have been downloaded. The Blockchain is synced at height %d :)", p.Height)
+			wasSynced = true
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// Sync performs a single sync round. The headers are downloaded from all
+// the peers at once, the peers failing to serve them are dropped.
+func (s *Syncer) Sync(ctx context.Context) error {
+	var (
+		wg     sync.WaitGroup
+		peers  = s.peerPool.Peers()
+		chains = make([][]*blockNode, len(peers))
+	)
+
+	for i, p := range peers {
+		wg.Add(1)
+		go func(i int, p Peer) {
+			defer wg.Done()
+
+			chain, err := s.downloadHeaders(ctx, p)
+			if err != nil && ctx.Err() == nil {
+				s.logger.Printf("On downloading headers from %s, dropping the peer: %s", p.Addr(), err)
+				s.peerPool.Remove(p.Addr())
+			}
+			// The valid headers received before the error are still used
+			chains[i] = chain
+		}(i, p)
+	}
+	wg.Wait()
+
+	var best []*blockNode
+	for _, chain := range chains {
+		if len(chain) == 0 {
+			continue
+		}
+
+		s.updateBestPeerHeight(chain[len(chain)-1].Height)
+		if best == nil || chain[len(chain)-1].WorkAmount.Cmp(best[len(best)-1].WorkAmount) > 0 {
+			best = chain
+		}
+	}
+
+	if len(best) == 0 || best[len(best)-1].WorkAmount.Cmp(s.blkchain.tipNode().WorkAmount) <= 0 {
+		s.setSynced(true)
+		return nil
+	}
+
+	s.setSynced(false)
+	s.logger.Printf("Downloading %d blocks up to height %d", len(best), best[len(best)-1].Height)
+
+	return s.downloadBlocks(ctx, s.peerPool.Peers(), best)
+}
+
+func (s *Syncer) updateBestPeerHeight(height int) {
+	s.mtx.Lock()
+	if height > s.bestPeerHeight {
+		s.bestPeerHeight = height
+	}
+	s.mtx.Unlock()
+}
+
+func (s *Syncer) setSynced(synced bool) {
+	s.mtx.Lock()
+	s.synced = synced
+	s.mtx.Unlock()
+}
+
+// downloadHeaders fetches and validates up to _maxSyncHeaders headers a peer
+// has beyond the local main chain. The returned nodes aren't added to
+// the block index, they only link to it. A valid prefix is returned along
+// with an error. Every full reply after the first one must lead further
+// up the chain, so that a peer can't keep the node requesting forever.
+func (s *Syncer) downloadHeaders(ctx context.Context, peer Peer) ([]*blockNode, error) {
+	var (
+		chain []*blockNode
+		last  = s.blkchain.tipNode()
+		// The first reply may go back to the fork point
+		prevHeight = -1
+	)
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return chain, err
+		}
+
+		resp, err := peer.SendGetHeaders(GetHeadersReq{Locator: blockLocator(last)})
+		if err != nil {
+			return chain, err
+		}
+		if len(resp.Headers) > HeadersPerReq {
+			return chain, fmt.Errorf("%w: %d", ErrTooManyHeaders, len(resp.Headers))
+		}
+
+		for _, h := range resp.Headers {
+			parent := last
+			if h.PrevBlockHash != last.Hash {
+				// Only the first header may fork off the known chain
+				if parent = s.blkchain.index.GetNode(h.PrevBlockHash); parent == nil || len(chain) > 0 {
+					return chain, ErrUnconnectedHeaders
+				}
+			}
+
+			// The expected target is checked before hashing the header
+			if err := checkHeaderContext(s.blkchain.params, parent, h, s.blkchain.timeSource.AdjustedTime()); err != nil {
+				return chain, fmt.Errorf("on verifying a header: %w", err)
+			}
+
+			if err := h.Verify(s.blkchain.params); err != nil {
+				return chain, fmt.Errorf("on verifying a header: %w", err)
+			}
+
+			node, err := newBlockNode(parent, h)
+			if err != nil {
+				return chain, err
+			}
+
+			if known := s.blkchain.index.GetNode(node.Hash); known != nil && len(chain) == 0 {
+				last = known
+				continue
+			}
+
+			chain = append(chain, node)
+			last = node
+		}
+
+		if len(resp.Headers) < HeadersPerReq || len(chain) >= _maxSyncHeaders {
+			return chain, nil
+		}
+
+		if last.Height <= prevHeight {
+			return chain, fmt.Errorf("%w: stuck at height %d", ErrStalledHeaders, last.Height)
+		}
+		prevHeight = last.Height
+	}
+}
+
+// downloadBlocks fetches the blocks of a header chain window by window
+// and processes them in order.
+func (s *Syncer) downloadBlocks(ctx context.Context, peers []Peer, chain []*blockNode) error {
+	for start := 0; start < len(chain); start += _blockDownloadWindow {
+		end := start + _blockDownloadWindow
+		if end > len(chain) {
+			end = len(chain)
+		}
+
+		hashes := make([]crypto.HashValue, 0, end-start)
+		for _, node := range chain[start:end] {
+			hashes = append(hashes, node.Hash)
+		}
+
+		blocks, err := fetchBlocks(ctx, peers, hashes)
+		if err != nil {
+			return err
+		}
+
+		for _, hash := range hashes {
+			if err := s.blkchain.ProcessBlock(blocks[hash]); err != nil && !errors.Is(err, ErrDuplicateBlock) {
+				return fmt.Errorf("on processing block %x: %w", hash, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// fetchBlocks requests blocks in batches spread over the peers. Batches
+// that fail are retried on other peers.
+func fetchBlocks(ctx context.Context, peers []Peer, hashes []crypto.HashValue) (map[crypto.HashValue]Block, error) {
+	if len(peers) == 0 {
+		return nil, ErrBlocksUnavailable
+	}
+
+	var (
+		mtx     sync.Mutex
+		blocks  = make(map[crypto.HashValue]Block, len(hashes))
+		missing = hashes
+	)
+
+	for attempt := 0; attempt < _maxBlockRequestAttempts && len(missing) > 0; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		var wg sync.WaitGroup
+		for i := 0; i*BlocksPerReq < len(missing); i++ {
+			end := (i + 1) * BlocksPerReq
+			if end > len(missing) {
+				end = len(missing)
+			}
+			batch := missing[i*BlocksPerReq : end]
+			peer := peers[(i+attempt)%len(peers)]
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				resp, err := peer.SendGetBlocks(GetBlocksReq{Hashes: batch})
+				if err != nil {
+					return
+				}
+
+				requested := make(map[crypto.HashValue]struct{}, len(batch))
+				for _, hash := range batch {
+					requested[hash] = struct{}{}
+				}
+
+				mtx.Lock()
+				defer mtx.Unlock()
+				for _, block := range resp.Blocks {
+					hash, err := block.Header.Checksum()
+					if _, ok := requested[hash]; err == nil && ok {
+						blocks[hash] = block
+					}
+				}
+			}()
+		}
+		wg.Wait()
+
+		var stillMissing []crypto.HashValue
+		for _, hash := range missing {
+			if _, ok := blocks[hash]; !ok {
+				stillMissing = append(stillMissing, hash)
+			}
+		}
+		missing = stillMissing
+	}
+
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("%w: %d of %d", ErrBlocksUnavailable, len(missing), len(hashes))
+	}
+
+	return blocks, nil
+}
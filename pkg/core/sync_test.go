@@ -0,0 +1,168 @@
+package core
+
+import (
+	"context"
+	"io"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/meddion/pkg/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// localSender delivers messages straight to a Receiver, bypassing the network
+type localSender struct {
+	rcv Receiver
+}
+
+func (l localSender) SendHandshake(req HandshakeReq) (HandshakeResp, error) {
+	var resp HandshakeResp
+	if err := l.rcv.HandleHandshake(req, &resp); err != nil {
+		return resp, err
+	}
+	return resp, resp.Err()
+}
+
+func (l localSender) SendTransaction(req TransactionReq) (TransactionResp, error) {
+	var resp TransactionResp
+	if err := l.rcv.HandleTransaction(req, &resp); err != nil {
+		return resp, err
+	}
+	return resp, resp.Err()
+}
+
+func (l localSender) SendIsAlive() error {
+	return l.rcv.HandleIsAlive(Empty{}, &Empty{})
+}
+
+func (l localSender) SendBlock(req BlockReq) error {
+	return l.rcv.HandleBlock(req, &Empty{})
+}
+
+func (l localSender) SendPeersDiscovery() (PeersDiscoveryResp, error) {
+	var resp PeersDiscoveryResp
+	err := l.rcv.HandlePeersDiscovery(Empty{}, &resp)
+	return resp, err
+}
+
+func (l localSender) SendGetBlocks(req GetBlocksReq) (BlocksResp, error) {
+	var resp BlocksResp
+	err := l.rcv.HandleGetBlocks(req, &resp)
+	return resp, err
+}
+
+func (l localSender) SendGetHeaders(req GetHeadersReq) (HeadersResp, error) {
+	var resp HeadersResp
+	err := l.rcv.HandleGetHeaders(req, &resp)
+	return resp, err
+}
+
+func (l localSender) SendGetTxProof(req GetTxProofReq) (TxProofResp, error) {
+	var resp TxProofResp
+	err := l.rcv.HandleGetTxProof(req, &resp)
+	return resp, err
+}
+
+func newLocalPeer(blkchain *Blockchain, port string) Peer {
+	logger := log.New(io.Discard, "", 0)
+	addr := Addr{IP: "127.0.0.1", Port: port}
+	rcv := NewReceiverRPC(blkchain, NewMempool(DefaultMempoolConfig, logger), NewPeerPool(logger, 0), addr, logger)
+
+	return Peer{Sender: localSender{rcv: rcv}, addr: addr}
+}
+
+func TestHeadersAfter(t *testing.T) {
+	blkchain := newTestBlockchain(t)
+
+	genesisHash, genesis := getGenesisPair()
+	blocks := []Block{genesis}
+	for i := 1; i < 5; i++ {
+		blocks = append(blocks, mineTestBlock(t, blocks[i-1], 1))
+		require.NoError(t, blkchain.ProcessBlock(blocks[i]))
+	}
+
+	locator := blkchain.BlockLocator()
+	assert.Equal(t, blockHash(t, blocks[4]), locator[0])
+	assert.Equal(t, genesisHash, locator[len(locator)-1])
+
+	headers := blkchain.HeadersAfter([]crypto.HashValue{{0x1}, blockHash(t, blocks[1])}, crypto.ZeroHashValue, 10)
+	assert.Equal(t, []Header{blocks[2].Header, blocks[3].Header, blocks[4].Header}, headers)
+
+	headers = blkchain.HeadersAfter(nil, blockHash(t, blocks[2]), 10)
+	assert.Equal(t, []Header{blocks[1].Header, blocks[2].Header}, headers, "should stop at the stop hash")
+
+	headers = blkchain.HeadersAfter(nil, crypto.ZeroHashValue, 1)
+	assert.Equal(t, []Header{blocks[1].Header}, headers, "should respect the limit")
+}
+
+func TestSync(t *testing.T) {
+	remote := newTestBlockchain(t)
+
+	_, prev := getGenesisPair()
+	for i := 0; i < 6; i++ {
+		prev = mineTestBlock(t, prev, 1)
+		require.NoError(t, remote.ProcessBlock(prev))
+	}
+
+	local := newTestBlockchain(t)
+	logger := log.New(io.Discard, "", 0)
+	peerPool := NewPeerPool(logger, 0)
+	peerPool.Add(newLocalPeer(remote, "8090"))
+	peerPool.Add(newLocalPeer(remote, "8091"))
+
+	syncer := NewSyncer(local, peerPool, logger)
+	assert.False(t, syncer.Progress().Synced)
+
+	require.NoError(t, syncer.Sync(context.Background()), "on syncing")
+
+	remoteTip, remoteHeight := remote.BestBlock()
+	localTip, localHeight := local.BestBlock()
+	assert.Equal(t, remoteTip, localTip)
+	assert.Equal(t, remoteHeight, localHeight)
+
+	require.NoError(t, syncer.Sync(context.Background()), "on syncing")
+	assert.Equal(t, SyncProgress{Height: 6, BestPeerHeight: 6, Synced: true}, syncer.Progress())
+}
+
+// repeatingSender replies with the same headers to every request.
+type repeatingSender struct {
+	localSender
+	headers []Header
+}
+
+func (r repeatingSender) SendGetHeaders(GetHeadersReq) (HeadersResp, error) {
+	return HeadersResp{Headers: r.headers}, nil
+}
+
+func TestSyncDropsMisbehavingPeers(t *testing.T) {
+	_, genesis := getGenesisPair()
+	b1 := mineTestBlock(t, genesis, 1)
+
+	local := newTestBlockchain(t)
+	require.NoError(t, local.ProcessBlock(b1))
+
+	repeated := make([]Header, HeadersPerReq)
+	for i := range repeated {
+		repeated[i] = b1.Header
+	}
+
+	logger := log.New(io.Discard, "", 0)
+	peerPool := NewPeerPool(logger, 0)
+	stalling := Addr{IP: "127.0.0.1", Port: "8090"}
+	flooding := Addr{IP: "127.0.0.1", Port: "8091"}
+	peerPool.Add(Peer{Sender: repeatingSender{headers: repeated}, addr: stalling})
+	peerPool.Add(Peer{Sender: repeatingSender{headers: append(repeated, b1.Header)}, addr: flooding})
+
+	done := make(chan error, 1)
+	go func() { done <- NewSyncer(local, peerPool, logger).Sync(context.Background()) }()
+
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(time.Second * 5):
+		t.Fatal("the sync doesn't stop on the same headers")
+	}
+	assert.Zero(t, peerPool.NumberOfPeers(), "the misbehaving peers should be dropped")
+}
@@ -0,0 +1,202 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+var (
+	ErrTxRejected      = errors.New("transaction rejected")
+	ErrValidatorExists = errors.New("payload type already has a validator")
+	ErrOpaquePayload   = errors.New("opaque payloads have no validators")
+)
+
+// PayloadType is carried by the typed transactions, see _typedTxFormat.
+// It selects the TxValidator that checks the transaction data. The node
+// treats the data of the types without a validator as opaque bytes,
+// except for PayloadCoinbase which is checked by the consensus rules.
+type PayloadType uint8
+
+// PayloadOpaque is the type of the untyped transactions, the ones made
+// before the typed format. Their data is never interpreted by the node.
+const PayloadOpaque PayloadType = 0
+
+// TxValidator checks the application payload of a transaction. A returned
+// error rejects the transaction, its text is reported back to the sender.
+type TxValidator interface {
+	ValidateTx(ctx ChainContext, tx Transaction, payload []byte) error
+}
+
+// TxValidatorFunc adapts a function to the TxValidator interface
+type TxValidatorFunc func(ctx ChainContext, tx Transaction, payload []byte) error
+
+func (f TxValidatorFunc) ValidateTx(ctx ChainContext, tx Transaction, payload []byte) error {
+	return f(ctx, tx, payload)
+}
+
+// ChainContext is what the transaction rules can see of the chain
+type ChainContext struct {
+	Params *ChainParams
+	// Height of the block the transactions belong to. The pending
+	// transactions are verified for the next block.
+	Height int
+	// Set when the transaction is verified for the next block on top of
+	// the main chain: on mempool admission and in block templates. Only then
+	// the state of an Application matches the chain the transaction is for.
+	Pending bool
+	// Transactions placed before this one in the same block, nil if none
+	Preceding *PrecedingTxs
+
+	// Nil skips the application payload checks
+	validators *txValidators
+}
+
+// TxIndex is what a TxValidator derives from the transactions preceding
+// the one it checks, e.g. the outputs they spend.
+type TxIndex interface {
+	// Add updates the index with the transaction following the indexed ones
+	Add(tx Transaction)
+}
+
+// PrecedingTxs are the transactions placed before the one being verified.
+// The validators look at them through the indexes kept per payload type.
+// An index is built once and then extended as the transactions are added,
+// instead of going through all of them for every transaction.
+type PrecedingTxs struct {
+	txs     []Transaction
+	indexes map[PayloadType]TxIndex
+}
+
+func NewPrecedingTxs(txs ...Transaction) *PrecedingTxs {
+	return &PrecedingTxs{
+		txs:     append([]Transaction(nil), txs...),
+		indexes: make(map[PayloadType]TxIndex),
+	}
+}
+
+// Add appends the transaction and updates the indexes with it.
+func (p *PrecedingTxs) Add(tx Transaction) {
+	p.txs = append(p.txs, tx)
+	for _, index := range p.indexes {
+		index.Add(tx)
+	}
+}
+
+// Len returns the number of the preceding transactions.
+func (p *PrecedingTxs) Len() int {
+	if p == nil {
+		return 0
+	}
+
+	return len(p.txs)
+}
+
+// Index returns the index of the payload type. It is made with newIndex
+// from the transactions added so far if there is none yet.
+func (p *PrecedingTxs) Index(t PayloadType, newIndex func() TxIndex) TxIndex {
+	if p == nil {
+		return newIndex()
+	}
+
+	index, exists := p.indexes[t]
+	if !exists {
+		index = newIndex()
+		for _, tx := range p.txs {
+			index.Add(tx)
+		}
+		p.indexes[t] = index
+	}
+
+	return index
+}
+
+// TxRejectedError is returned when a TxValidator rejects a transaction.
+// It matches ErrTxRejected with errors.Is and unwraps to the validator error.
+type TxRejectedError struct {
+	Type PayloadType
+	Err  error
+}
+
+func (e *TxRejectedError) Error() string {
+	return fmt.Sprintf("%s by payload type %d: %s", ErrTxRejected, e.Type, e.Err)
+}
+
+func (e *TxRejectedError) Unwrap() error {
+	return e.Err
+}
+
+func (e *TxRejectedError) Is(target error) bool {
+	return target == ErrTxRejected
+}
+
+type txValidators struct {
+	mtx    sync.RWMutex
+	byType map[PayloadType]TxValidator
+}
+
+func newTxValidators() *txValidators {
+	return &txValidators{byType: make(map[PayloadType]TxValidator)}
+}
+
+func (v *txValidators) register(t PayloadType, validator TxValidator) error {
+	if t == PayloadOpaque {
+		return ErrOpaquePayload
+	}
+
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+
+	if _, exists := v.byType[t]; exists {
+		return fmt.Errorf("%w: %d", ErrValidatorExists, t)
+	}
+	v.byType[t] = validator
+
+	return nil
+}
+
+func (v *txValidators) validate(ctx ChainContext, tx Transaction) error {
+	v.mtx.RLock()
+	validator, exists := v.byType[tx.Type]
+	v.mtx.RUnlock()
+
+	if !exists {
+		return nil
+	}
+
+	if err := validator.ValidateTx(ctx, tx, tx.Data); err != nil {
+		return &TxRejectedError{Type: tx.Type, Err: err}
+	}
+
+	return nil
+}
+
+// RegisterTxValidator makes the transactions of the payload type pass through
+// the validator before they get into the mempool or a block. The validators
+// are part of the consensus rules, so all nodes of a network should register
+// the same ones before processing any blocks.
+func (b *Blockchain) RegisterTxValidator(t PayloadType, validator TxValidator) error {
+	return b.validators.register(t, validator)
+}
+
+// chainContext returns the context of the block at the given height.
+func (b *Blockchain) chainContext(height int) ChainContext {
+	return ChainContext{
+		Params:     b.params,
+		Height:     height,
+		validators: b.validators,
+	}
+}
+
+// nextChainContext returns the context the pending transactions are verified in.
+func (b *Blockchain) nextChainContext() ChainContext {
+	return b.pendingContext(b.tipNode())
+}
+
+// pendingContext returns the context of the next block on top of the tip.
+func (b *Blockchain) pendingContext(tip *blockNode) ChainContext {
+	ctx := b.chainContext(tip.Height + 1)
+	ctx.Pending = true
+
+	return ctx
+}
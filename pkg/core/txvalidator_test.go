@@ -0,0 +1,141 @@
+package core
+
+import (
+	"errors"
+	"io"
+	"log"
+	"testing"
+
+	"github.com/meddion/pkg/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var errOddPayload = errors.New("odd payload length")
+
+func signTestTx(t *testing.T, typ PayloadType, data TxData) Transaction {
+	signer, err := crypto.NewSignerECDSA()
+	require.NoError(t, err, "on creating a signer")
+
+	tx, err := NewTx(signer, typ, data)
+	require.NoError(t, err, "on signing a transaction")
+
+	return tx
+}
+
+func TestTxValidators(t *testing.T) {
+	blkchain := newTestBlockchain(t)
+
+	var heights []int
+	require.NoError(t, blkchain.RegisterTxValidator(1, TxValidatorFunc(func(ctx ChainContext, tx Transaction, payload []byte) error {
+		heights = append(heights, ctx.Height)
+		if len(payload)%2 != 0 {
+			return errOddPayload
+		}
+		return nil
+	})))
+	require.NoError(t, blkchain.RegisterTxValidator(2, TxValidatorFunc(func(ChainContext, Transaction, []byte) error {
+		return errors.New("never valid")
+	})))
+	assert.ErrorIs(t, blkchain.RegisterTxValidator(2, TxValidatorFunc(nil)), ErrValidatorExists)
+	assert.ErrorIs(t, blkchain.RegisterTxValidator(PayloadOpaque, TxValidatorFunc(nil)), ErrOpaquePayload)
+
+	var (
+		even   = signTestTx(t, 1, []byte("ab"))
+		odd    = signTestTx(t, 1, []byte("abc"))
+		other  = signTestTx(t, 2, []byte("ab"))
+		opaque = signTestTx(t, 3, []byte("abc"))
+		// Would be taken for an odd payload of type 1 if the data were typed
+		untyped = signTestTx(t, PayloadOpaque, []byte{1, 'a'})
+		ctx     = blkchain.nextChainContext()
+	)
+
+	assert.NoError(t, even.Verify(ctx))
+	assert.NoError(t, opaque.Verify(ctx), "the payload types without a validator are opaque")
+	assert.NoError(t, untyped.Verify(ctx), "the data of the untyped transactions isn't interpreted")
+
+	retyped := odd
+	retyped.Type = 3
+	assert.ErrorIs(t, retyped.Verify(ctx), ErrInvalidChecksum, "the type should be signed")
+
+	err := odd.Verify(ctx)
+	assert.ErrorIs(t, err, ErrTxRejected)
+	assert.ErrorIs(t, err, errOddPayload)
+	var rejected *TxRejectedError
+	require.True(t, errors.As(err, &rejected))
+	assert.Equal(t, PayloadType(1), rejected.Type)
+
+	assert.ErrorIs(t, other.Verify(ctx), ErrTxRejected)
+	assert.NoError(t, odd.Verify(ChainContext{Params: &DefaultChainParams}), "no validators without the chain")
+	assert.Equal(t, []int{1, 1}, heights)
+
+	t.Run("block", func(t *testing.T) {
+		_, genesis := getGenesisPair()
+
+		newBlock := func(body Body) Block {
+			block := mineTestBlock(t, genesis, 60)
+			block.Body = body
+
+			var err error
+			block.MerkleRoot, err = merkleRoot(block.Version, body)
+			require.NoError(t, err)
+			block.Nonce, err = block.Header.GenNonce()
+			require.NoError(t, err)
+
+			return block
+		}
+
+		assert.ErrorIs(t, blkchain.ProcessBlock(newBlock(Body{even, odd})), errOddPayload)
+		assert.NoError(t, blkchain.ProcessBlock(newBlock(Body{even, opaque})))
+	})
+
+	t.Run("receiver", func(t *testing.T) {
+		logger := log.New(io.Discard, "", 0)
+		rcv := NewReceiverRPC(blkchain, NewMempool(DefaultMempoolConfig, logger), &mockPeerPool{}, Addr{}, logger)
+
+		var resp TransactionResp
+		require.NoError(t, rcv.HandleTransaction(TransactionReq{Transaction: odd}, &resp))
+		assert.False(t, resp.Status)
+		assert.Contains(t, resp.Msg, errOddPayload.Error())
+		assert.ErrorIs(t, resp.Err(), ErrTxRejected)
+
+		resp = TransactionResp{}
+		require.NoError(t, rcv.HandleTransaction(TransactionReq{Transaction: even}, &resp))
+		assert.True(t, resp.Status)
+		assert.NoError(t, resp.Err())
+		assert.Equal(t, 2, heights[len(heights)-1], "pending transactions are checked for the next block")
+	})
+}
+
+// countingIndex counts the transactions it's updated with
+type countingIndex struct {
+	added *int
+}
+
+func (c countingIndex) Add(Transaction) {
+	*c.added++
+}
+
+func TestPrecedingTxs(t *testing.T) {
+	txs, err := genRandTransactions(3)
+	require.NoError(t, err)
+
+	var (
+		added    int
+		newIndex = func() TxIndex { return countingIndex{&added} }
+	)
+
+	var none *PrecedingTxs
+	assert.Zero(t, none.Len())
+	assert.NotNil(t, none.Index(1, newIndex), "a fresh index is made without the preceding transactions")
+
+	preceding := NewPrecedingTxs(txs[:2]...)
+	index := preceding.Index(1, newIndex)
+	assert.Equal(t, 2, added, "the index should be built from the added transactions")
+
+	preceding.Add(txs[2])
+	assert.Equal(t, 3, added, "the index should be extended")
+	assert.Equal(t, index, preceding.Index(1, newIndex), "the index should be reused")
+	assert.Equal(t, 3, added)
+	assert.Equal(t, 3, preceding.Len())
+}
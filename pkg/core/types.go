@@ -1,9 +1,9 @@
 package core
 
 import (
-	"bytes"
-	"encoding/gob"
+	"fmt"
 	"math"
+	"net"
 
 	"github.com/meddion/pkg/crypto"
 )
@@ -13,17 +13,25 @@ const (
 )
 
 type Sender interface {
+	SendHandshake(HandshakeReq) (HandshakeResp, error)
 	SendTransaction(TransactionReq) (TransactionResp, error)
 	SendIsAlive() error
 	SendBlock(BlockReq) error
 	SendPeersDiscovery() (PeersDiscoveryResp, error)
+	SendGetBlocks(GetBlocksReq) (BlocksResp, error)
+	SendGetHeaders(GetHeadersReq) (HeadersResp, error)
+	SendGetTxProof(GetTxProofReq) (TxProofResp, error)
 }
 
 type Receiver interface {
+	HandleHandshake(HandshakeReq, *HandshakeResp) error
 	HandleTransaction(TransactionReq, *TransactionResp) error
 	HandleIsAlive(Empty, *Empty) error
 	HandleBlock(BlockReq, *Empty) error
 	HandlePeersDiscovery(Empty, *PeersDiscoveryResp) error
+	HandleGetBlocks(GetBlocksReq, *BlocksResp) error
+	HandleGetHeaders(GetHeadersReq, *HeadersResp) error
+	HandleGetTxProof(GetTxProofReq, *TxProofResp) error
 }
 
 type (
@@ -38,19 +46,78 @@ type (
 		Block
 	}
 
+	GetBlocksReq struct {
+		Hashes []crypto.HashValue
+	}
+
+	BlocksResp struct {
+		Blocks []Block
+	}
+
+	GetHeadersReq struct {
+		Locator []crypto.HashValue
+		// Zero value means as many headers as fit into a response
+		StopHash crypto.HashValue
+	}
+
+	HeadersResp struct {
+		Headers []Header
+	}
+
+	GetTxProofReq struct {
+		BlockHash crypto.HashValue
+		TxHash    crypto.HashValue
+	}
+
+	// TxProofResp proves that a transaction is included into the block
+	// with the header. See VerifyTxProof.
+	TxProofResp struct {
+		Header      Header
+		Height      int
+		InMainChain bool
+		Proof       crypto.MerkleProof
+	}
+
 	TransactionReq struct {
 		Transaction
 	}
 
+	// TransactionResp tells whether the transaction was accepted.
+	// Msg holds the reason of a rejection.
 	TransactionResp struct {
 		Status bool
 		Msg    string
 	}
 
+	GenerateReq struct {
+		Count int
+	}
+
+	GenerateResp struct {
+		Hashes []crypto.HashValue
+	}
+
+	// KnownAddr is the address of a node along with the last time,
+	// in Unix seconds, the node was known to be reachable
+	KnownAddr struct {
+		Addr     Addr
+		LastSeen int64
+	}
+
 	PeersDiscoveryResp struct {
-		addrs []Addr
+		Addrs []KnownAddr
 	}
 )
+
+// Err returns the rejection reason as an error matching ErrTxRejected.
+func (r TransactionResp) Err() error {
+	if r.Status {
+		return nil
+	}
+
+	return fmt.Errorf("%w: %s", ErrTxRejected, r.Msg)
+}
+
 type Addr struct {
 	IP, Port string
 }
@@ -59,14 +126,29 @@ func (a Addr) String() string {
 	return a.IP + ":" + a.Port
 }
 
+// IsRoutable reports whether the address is a public IP any node could
+// dial. Hostnames and loopback, private and link-local IPs are only dialed
+// when the operator configures them, the peers can't advertise them.
+func (a Addr) IsRoutable() bool {
+	if a.Port == "" {
+		return false
+	}
+
+	ip := net.ParseIP(a.IP)
+	return ip != nil && ip.IsGlobalUnicast() && !ip.IsPrivate()
+}
+
 const (
-	NonceMaxValue    = math.MaxUint32
-	BodyElementLimit = 64
-	TxBodySizeLimit  = 1024
+	NonceMaxValue = math.MaxUint32
+	BlocksPerReq  = 16
+	HeadersPerReq = 500
+	// Limits the number of addresses in a PeersDiscoveryResp
+	MaxAddrsPerReply = 250
 )
 
 type Signature interface {
 	Verify([]byte) bool
+	Bytes() ([]byte, error)
 }
 
 type (
@@ -80,8 +162,11 @@ type (
 		Timestamp     int64
 		PrevBlockHash crypto.HashValue
 		MerkleRoot    crypto.HashValue
-		Difficulty    Difficulty
-		Nonce         Nonce
+		// Used by the headers below _compactBitsVersion
+		Difficulty Difficulty
+		// Used by the headers starting from _compactBitsVersion
+		Bits  Bits
+		Nonce Nonce
 	}
 
 	Body   = []Transaction
@@ -90,60 +175,65 @@ type (
 	Transaction struct {
 		Sig  Signature
 		Hash crypto.HashValue
+		// PayloadOpaque for the untyped transactions
+		Type PayloadType
 		Data TxData
 	}
 )
 
-func (h Header) Bytes() ([]byte, error) {
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-	if err := enc.Encode(h); err != nil {
-		return nil, err
+// TxHash returns the hash a transaction with the data of the payload type
+// is signed by. The type of a typed transaction is hashed along with its
+// data, so that it can't be changed. The untyped transactions hash
+// the data only, as they always did.
+func TxHash(t PayloadType, data TxData) (crypto.HashValue, error) {
+	if t == PayloadOpaque {
+		return crypto.Hash256(data)
 	}
 
-	return buf.Bytes(), nil
+	var e encoder
+	e.uint8(_typedTxFormat)
+	e.uint8(uint8(t))
+	e.bytes(data)
+
+	return crypto.Hash256(e.buf)
 }
 
-func (h Header) Checksum() (crypto.HashValue, error) {
-	b, err := h.Bytes()
+// NewUnsignedTx returns a transaction with the data of the payload type.
+// Only the transactions of a genesis block can be left unsigned.
+func NewUnsignedTx(t PayloadType, data TxData) (Transaction, error) {
+	hash, err := TxHash(t, data)
 	if err != nil {
-		return crypto.ZeroHashValue, err
+		return Transaction{}, err
 	}
 
-	headerHash, err := crypto.Hash256(b)
+	return Transaction{Hash: hash, Type: t, Data: data}, nil
+}
+
+// NewTx returns a transaction with the data of the payload type signed
+// by the signer.
+func NewTx(signer crypto.SignerECDSA, t PayloadType, data TxData) (Transaction, error) {
+	tx, err := NewUnsignedTx(t, data)
 	if err != nil {
-		return crypto.ZeroHashValue, err
+		return Transaction{}, err
 	}
 
-	return headerHash, nil
-}
-
-func (b Block) Bytes() ([]byte, error) {
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-	if err := enc.Encode(b); err != nil {
-		return nil, err
+	if tx.Sig, err = signer.Sign(tx.Hash[:]); err != nil {
+		return Transaction{}, err
 	}
 
-	return buf.Bytes(), nil
+	return tx, nil
 }
 
-func (b *Block) FromBytes(data []byte) error {
-	reader := bytes.NewReader(data)
-	dec := gob.NewDecoder(reader)
-	if err := dec.Decode(&b); err != nil {
-		return err
+func (h Header) Checksum() (crypto.HashValue, error) {
+	b, err := h.Bytes()
+	if err != nil {
+		return crypto.ZeroHashValue, err
 	}
 
-	return nil
-}
-
-func (t Transaction) Bytes() ([]byte, error) {
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-	if err := enc.Encode(t); err != nil {
-		return nil, err
+	headerHash, err := crypto.Hash256(b)
+	if err != nil {
+		return crypto.ZeroHashValue, err
 	}
 
-	return buf.Bytes(), nil
+	return headerHash, nil
 }
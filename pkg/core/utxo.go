@@ -0,0 +1,233 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/meddion/pkg/crypto"
+)
+
+// PayloadUTXO is the payload type of the UTXO transactions, see UTXOSet
+const PayloadUTXO PayloadType = 3
+
+var (
+	ErrNoInputs          = errors.New("only the genesis transactions can have no inputs")
+	ErrNoOutputs         = errors.New("transaction has no outputs")
+	ErrZeroOutput        = errors.New("output amount is zero")
+	ErrAmountOverflow    = errors.New("amount overflow")
+	ErrDuplicateInput    = errors.New("input is spent twice by a transaction")
+	ErrDoubleSpend       = errors.New("output is already spent")
+	ErrMissingUTXO       = errors.New("output doesn't exist or is already spent")
+	ErrInputSignature    = errors.New("invalid input signature")
+	ErrInputOwner        = errors.New("input isn't signed by the output owner")
+	ErrInsufficientInput = errors.New("inputs don't cover the outputs")
+)
+
+// OutPoint references an output of a transaction by its hash and index
+type OutPoint struct {
+	TxHash crypto.HashValue
+	Index  uint32
+}
+
+func (o OutPoint) String() string {
+	return fmt.Sprintf("%x:%d", o.TxHash, o.Index)
+}
+
+// TxIn spends an output. Sig signs UTXOTx.SigHash with the key of the output owner.
+type TxIn struct {
+	Prev OutPoint
+	Sig  Signature
+}
+
+// TxOut pays Amount to the owner of the address
+type TxOut struct {
+	Amount uint64
+	To     crypto.Address
+}
+
+// UTXOTx is the payload of a UTXO transaction. Its outputs are referenced
+// by the hash of the enclosing Transaction.
+//
+//	UTXOTx = InCount u32 | (TxHash [32] | Index u32 | Sig bytes) * InCount |
+//	         OutCount u32 | (Amount u64 | To [20]) * OutCount
+type UTXOTx struct {
+	Inputs  []TxIn
+	Outputs []TxOut
+}
+
+func (u UTXOTx) Bytes() ([]byte, error) {
+	var e encoder
+	if err := e.utxoTx(u); err != nil {
+		return nil, err
+	}
+
+	return e.buf, nil
+}
+
+func (u *UTXOTx) FromBytes(data []byte) error {
+	d := decoder{buf: data}
+	tx := d.utxoTx()
+	if err := d.finish(); err != nil {
+		return err
+	}
+
+	*u = tx
+	return nil
+}
+
+// SigHash is the hash the inputs are signed over: the encoding of
+// the transaction without the input signatures.
+func (u UTXOTx) SigHash() (crypto.HashValue, error) {
+	unsigned := UTXOTx{Inputs: make([]TxIn, len(u.Inputs)), Outputs: u.Outputs}
+	for i, in := range u.Inputs {
+		unsigned.Inputs[i].Prev = in.Prev
+	}
+
+	b, err := unsigned.Bytes()
+	if err != nil {
+		return crypto.HashValue{}, err
+	}
+
+	return crypto.Hash256(b)
+}
+
+// OutputSum returns the total amount of the outputs.
+func (u UTXOTx) OutputSum() (uint64, error) {
+	var sum uint64
+	for _, out := range u.Outputs {
+		if sum > math.MaxUint64-out.Amount {
+			return 0, ErrAmountOverflow
+		}
+		sum += out.Amount
+	}
+
+	return sum, nil
+}
+
+// verify performs the checks that don't need the UTXO set.
+func (u UTXOTx) verify() error {
+	if len(u.Outputs) == 0 {
+		return ErrNoOutputs
+	}
+
+	for _, out := range u.Outputs {
+		if out.Amount == 0 {
+			return ErrZeroOutput
+		}
+	}
+
+	if _, err := u.OutputSum(); err != nil {
+		return err
+	}
+
+	seen := make(map[OutPoint]struct{}, len(u.Inputs))
+	for _, in := range u.Inputs {
+		if _, exists := seen[in.Prev]; exists {
+			return fmt.Errorf("%w: %s", ErrDuplicateInput, in.Prev)
+		}
+		seen[in.Prev] = struct{}{}
+	}
+
+	if len(u.Inputs) == 0 {
+		return nil
+	}
+
+	hash, err := u.SigHash()
+	if err != nil {
+		return err
+	}
+
+	for i, in := range u.Inputs {
+		if in.Sig == nil || !in.Sig.Verify(hash[:]) {
+			return fmt.Errorf("%w: input #%d", ErrInputSignature, i)
+		}
+	}
+
+	return nil
+}
+
+// decodeUTXOTx returns false for the transactions of other payload types.
+func decodeUTXOTx(tx Transaction) (UTXOTx, bool, error) {
+	if tx.Type != PayloadUTXO {
+		return UTXOTx{}, false, nil
+	}
+
+	var u UTXOTx
+	return u, true, u.FromBytes(tx.Data)
+}
+
+type addresser interface {
+	Address() (crypto.Address, error)
+}
+
+// signerAddress returns the address of the key a signature is made with.
+func signerAddress(sig Signature) (crypto.Address, error) {
+	a, ok := sig.(addresser)
+	if !ok {
+		return crypto.Address{}, ErrInputOwner
+	}
+
+	return a.Address()
+}
+
+func (e *encoder) utxoTx(u UTXOTx) error {
+	e.uint32(uint32(len(u.Inputs)))
+	for _, in := range u.Inputs {
+		e.outPoint(in.Prev)
+		if err := e.signature(in.Sig); err != nil {
+			return err
+		}
+	}
+
+	e.uint32(uint32(len(u.Outputs)))
+	for _, out := range u.Outputs {
+		e.txOut(out)
+	}
+
+	return nil
+}
+
+func (d *decoder) utxoTx() UTXOTx {
+	var u UTXOTx
+
+	// Every input takes at least 40 bytes, every output 28
+	n := d.uint32()
+	if d.err == nil && uint64(n)*40 > uint64(len(d.buf)) {
+		d.err = fmt.Errorf("%w: %d inputs don't fit into the data", ErrInvalidEncoding, n)
+	}
+	for i := uint32(0); i < n && d.err == nil; i++ {
+		u.Inputs = append(u.Inputs, TxIn{Prev: d.outPoint(), Sig: d.signature()})
+	}
+
+	n = d.uint32()
+	if d.err == nil && uint64(n)*28 > uint64(len(d.buf)) {
+		d.err = fmt.Errorf("%w: %d outputs don't fit into the data", ErrInvalidEncoding, n)
+	}
+	for i := uint32(0); i < n && d.err == nil; i++ {
+		u.Outputs = append(u.Outputs, d.txOut())
+	}
+
+	return u
+}
+
+func (e *encoder) outPoint(o OutPoint) {
+	e.hash(o.TxHash)
+	e.uint32(o.Index)
+}
+
+func (d *decoder) outPoint() OutPoint {
+	return OutPoint{TxHash: d.hash(), Index: d.uint32()}
+}
+
+func (e *encoder) txOut(out TxOut) {
+	e.uint64(out.Amount)
+	e.buf = append(e.buf, out.To[:]...)
+}
+
+func (d *decoder) txOut() TxOut {
+	out := TxOut{Amount: d.uint64()}
+	copy(out.To[:], d.next(crypto.AddressLen))
+
+	return out
+}
@@ -0,0 +1,268 @@
+package core
+
+import (
+	"context"
+	"io"
+	"log"
+	"path/filepath"
+	"testing"
+
+	"github.com/meddion/pkg/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestSigner(t *testing.T) crypto.SignerECDSA {
+	signer, err := crypto.NewSignerECDSA()
+	require.NoError(t, err, "on creating a signer")
+
+	return signer
+}
+
+// spendTestTx returns a transaction spending the outputs of the signer.
+func spendTestTx(t *testing.T, signer crypto.SignerECDSA, prevs []OutPoint, outs ...TxOut) Transaction {
+	u := UTXOTx{Outputs: outs}
+	for _, prev := range prevs {
+		u.Inputs = append(u.Inputs, TxIn{Prev: prev})
+	}
+
+	sigHash, err := u.SigHash()
+	require.NoError(t, err, "on hashing a transaction")
+	for i := range u.Inputs {
+		u.Inputs[i].Sig, err = signer.Sign(sigHash[:])
+		require.NoError(t, err, "on signing an input")
+	}
+
+	data, err := u.Bytes()
+	require.NoError(t, err)
+
+	tx, err := NewTx(signer, PayloadUTXO, data)
+	require.NoError(t, err)
+
+	return tx
+}
+
+func mineRegtestBlock(t *testing.T, parent Block, timeOffset int64, body Body) Block {
+	var err error
+	block := Block{Header: Header{
+		Version:   LatestBlockVersion,
+		Timestamp: parent.Timestamp + timeOffset,
+		Bits:      Difficulty(1).Bits(),
+	}, Body: body}
+
+	block.PrevBlockHash, err = parent.Header.Checksum()
+	require.NoError(t, err)
+	block.MerkleRoot, err = merkleRoot(block.Version, body)
+	require.NoError(t, err)
+	block.Nonce, err = block.Header.GenNonce()
+	require.NoError(t, err)
+
+	return block
+}
+
+// newTestUTXOChain returns a chain executed by a UTXOSet. Its genesis block
+// has a single transaction allocating the outputs.
+func newTestUTXOChain(t *testing.T, params ChainParams, outs ...TxOut) (*Blockchain, *UTXOSet, crypto.HashValue) {
+	data, err := UTXOTx{Outputs: outs}.Bytes()
+	require.NoError(t, err)
+	allocation, err := NewUnsignedTx(PayloadUTXO, data)
+	require.NoError(t, err)
+
+	params.Genesis = mineRegtestBlock(t, params.Genesis, 0, Body{allocation})
+	params.Genesis.PrevBlockHash = crypto.ZeroHashValue
+
+	db, err := NewBlockRepo(filepath.Join(t.TempDir(), "blocks.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	blkchain, err := NewBlockchain(db, &params, log.New(io.Discard, "", 0))
+	require.NoError(t, err)
+
+	utxos, err := NewUTXOSet(db, &params)
+	require.NoError(t, err)
+	require.NoError(t, blkchain.RegisterTxValidator(PayloadUTXO, utxos.Validator()))
+	require.NoError(t, blkchain.SetApplication(utxos))
+
+	return blkchain, utxos, allocation.Hash
+}
+
+func TestUTXOTxEncoding(t *testing.T) {
+	alice := newTestSigner(t)
+	tx := spendTestTx(t, alice, []OutPoint{{TxHash: crypto.HashValue{1}, Index: 2}, {TxHash: crypto.HashValue{3}}},
+		TxOut{Amount: 10, To: alice.Address()})
+
+	u, ok, err := decodeUTXOTx(tx)
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Len(t, u.Inputs, 2)
+	assert.Equal(t, OutPoint{TxHash: crypto.HashValue{1}, Index: 2}, u.Inputs[0].Prev)
+	assert.Equal(t, []TxOut{{Amount: 10, To: alice.Address()}}, u.Outputs)
+	assert.NoError(t, u.verify())
+
+	u.Outputs[0].Amount = 11
+	assert.ErrorIs(t, u.verify(), ErrInputSignature, "the outputs are signed")
+
+	var decoded UTXOTx
+	assert.ErrorIs(t, decoded.FromBytes([]byte{0xff, 0xff, 0xff, 0xff}), ErrInvalidEncoding)
+}
+
+func TestUTXOSet(t *testing.T) {
+	alice, bob := newTestSigner(t), newTestSigner(t)
+	logger := log.New(io.Discard, "", 0)
+
+	blkchain, utxos, allocationHash := newTestUTXOChain(t, RegtestChainParams,
+		TxOut{Amount: 100, To: alice.Address()}, TxOut{Amount: 50, To: alice.Address()})
+	genesis := blkchain.params.Genesis
+
+	g0, g1 := OutPoint{TxHash: allocationHash}, OutPoint{TxHash: allocationHash, Index: 1}
+	entry, err := utxos.UTXO(g0)
+	require.NoError(t, err)
+	assert.Equal(t, UTXOEntry{Out: TxOut{Amount: 100, To: alice.Address()}}, entry, "the genesis outputs should be created")
+
+	mempool := NewMempool(DefaultMempoolConfig, logger)
+	mempool.Follow(blkchain)
+	rcv := NewReceiverRPC(blkchain, mempool, NewPeerPool(logger, 0), Addr{}, logger)
+
+	submit := func(tx Transaction) TransactionResp {
+		var resp TransactionResp
+		require.NoError(t, rcv.HandleTransaction(TransactionReq{Transaction: tx}, &resp))
+		return resp
+	}
+
+	toBob := spendTestTx(t, alice, []OutPoint{g0}, TxOut{Amount: 60, To: bob.Address()}, TxOut{Amount: 40, To: alice.Address()})
+	fromBob := spendTestTx(t, bob, []OutPoint{{TxHash: toBob.Hash}}, TxOut{Amount: 60, To: alice.Address()})
+
+	t.Run("mempool admission", func(t *testing.T) {
+		assert.True(t, submit(toBob).Status)
+		assert.True(t, submit(fromBob).Status, "the outputs of the pending transactions can be spent")
+
+		for _, c := range []struct {
+			tx  Transaction
+			err error
+		}{
+			{spendTestTx(t, alice, []OutPoint{g0}, TxOut{Amount: 100, To: alice.Address()}), ErrDoubleSpend},
+			{spendTestTx(t, bob, []OutPoint{g1}, TxOut{Amount: 50, To: bob.Address()}), ErrInputOwner},
+			{spendTestTx(t, alice, []OutPoint{g1}, TxOut{Amount: 51, To: bob.Address()}), ErrInsufficientInput},
+			{spendTestTx(t, alice, []OutPoint{{TxHash: crypto.HashValue{1}}}, TxOut{Amount: 1, To: bob.Address()}), ErrMissingUTXO},
+			{spendTestTx(t, alice, []OutPoint{g1, g1}, TxOut{Amount: 1, To: bob.Address()}), ErrDuplicateInput},
+			{spendTestTx(t, alice, nil, TxOut{Amount: 1, To: alice.Address()}), ErrNoInputs},
+		} {
+			resp := submit(c.tx)
+			assert.False(t, resp.Status)
+			assert.Contains(t, resp.Msg, c.err.Error())
+		}
+	})
+
+	miner := NewMiner(blkchain, mempool, nil, 1, logger)
+	block, err := miner.MineBlock(context.Background())
+	require.NoError(t, err)
+	require.Len(t, block.Body, 2)
+
+	_, err = utxos.UTXO(g0)
+	assert.ErrorIs(t, err, ErrMissingUTXO)
+	_, err = utxos.UTXO(OutPoint{TxHash: toBob.Hash})
+	assert.ErrorIs(t, err, ErrMissingUTXO, "the output was spent within the block")
+	entry, err = utxos.UTXO(OutPoint{TxHash: fromBob.Hash})
+	require.NoError(t, err)
+	assert.Equal(t, UTXOEntry{Out: TxOut{Amount: 60, To: alice.Address()}, Height: 1}, entry)
+
+	resp := submit(spendTestTx(t, alice, []OutPoint{g0}, TxOut{Amount: 100, To: alice.Address()}))
+	assert.False(t, resp.Status)
+	assert.Contains(t, resp.Msg, ErrMissingUTXO.Error(), "the output is spent by the chain")
+
+	t.Run("block validation", func(t *testing.T) {
+		spendG1 := func() Transaction {
+			return spendTestTx(t, alice, []OutPoint{g1}, TxOut{Amount: 50, To: bob.Address()})
+		}
+
+		assert.ErrorIs(t, blkchain.ProcessBlock(mineRegtestBlock(t, block, 1, Body{spendG1(), spendG1()})), ErrDoubleSpend)
+		assert.ErrorIs(t, blkchain.ProcessBlock(mineRegtestBlock(t, block, 2, Body{toBob})), ErrMissingUTXO)
+
+		tip, height := blkchain.BestBlock()
+		assert.Equal(t, blockHash(t, block), tip)
+		assert.Equal(t, 1, height)
+		_, err := utxos.UTXO(g1)
+		assert.NoError(t, err, "rejected blocks shouldn't change the set")
+	})
+
+	t.Run("reorganization", func(t *testing.T) {
+		before := utxos.Info()
+
+		f1 := mineRegtestBlock(t, genesis, 10, Body{})
+		f2 := mineRegtestBlock(t, f1, 10, Body{})
+		require.NoError(t, blkchain.ProcessBlock(f1))
+		require.NoError(t, blkchain.ProcessBlock(f2))
+
+		_, height := blkchain.BestBlock()
+		require.Equal(t, 2, height)
+
+		entry, err := utxos.UTXO(g0)
+		require.NoError(t, err, "the spent outputs should be restored")
+		assert.Equal(t, UTXOEntry{Out: TxOut{Amount: 100, To: alice.Address()}}, entry)
+		_, err = utxos.UTXO(OutPoint{TxHash: fromBob.Hash})
+		assert.ErrorIs(t, err, ErrMissingUTXO, "the created outputs should be removed")
+		assert.NotEqual(t, before.AppHash, utxos.Info().AppHash)
+
+		reloaded, err := NewUTXOSet(blkchain.db, blkchain.params)
+		require.NoError(t, err)
+		assert.Equal(t, utxos.Info(), reloaded.Info(), "the set should be persisted")
+
+		// The node stopped after committing f2 but before storing it as the tip
+		require.NoError(t, blkchain.db.StoreTip(blockHash(t, f1)))
+		restarted, err := NewBlockchain(blkchain.db, blkchain.params, logger)
+		require.NoError(t, err)
+		require.NoError(t, restarted.SetApplication(reloaded))
+		assert.Equal(t, blockHash(t, f1), reloaded.Info().LastBlockHash, "the block above the tip should be rolled back")
+
+		require.NoError(t, restarted.ProcessBlock(mineRegtestBlock(t, f2, 10, Body{})))
+		assert.Equal(t, 3, reloaded.Info().LastHeight, "the stored f2 should be executed again")
+	})
+}
+
+func TestMempoolFollowsUTXOChain(t *testing.T) {
+	alice, bob := newTestSigner(t), newTestSigner(t)
+	logger := log.New(io.Discard, "", 0)
+
+	blkchain, _, allocationHash := newTestUTXOChain(t, RegtestChainParams,
+		TxOut{Amount: 100, To: alice.Address()}, TxOut{Amount: 50, To: alice.Address()})
+	genesis := blkchain.params.Genesis
+	g0, g1 := OutPoint{TxHash: allocationHash}, OutPoint{TxHash: allocationHash, Index: 1}
+
+	mempool := NewMempool(DefaultMempoolConfig, logger)
+	mempool.Follow(blkchain)
+	rcv := NewReceiverRPC(blkchain, mempool, NewPeerPool(logger, 0), Addr{}, logger)
+
+	submit := func(tx Transaction) {
+		var resp TransactionResp
+		require.NoError(t, rcv.HandleTransaction(TransactionReq{Transaction: tx}, &resp))
+		require.True(t, resp.Status, resp.Msg)
+	}
+
+	reasons := make(map[crypto.HashValue]RemovalReason)
+	mempool.Subscribe(func(e MempoolEvent) {
+		if e.Type == TxRemoved {
+			reasons[e.Tx.Hash] = e.Reason
+		}
+	})
+
+	toBob := spendTestTx(t, alice, []OutPoint{g1}, TxOut{Amount: 50, To: bob.Address()})
+	fromBob := spendTestTx(t, bob, []OutPoint{{TxHash: toBob.Hash}}, TxOut{Amount: 50, To: alice.Address()})
+	submit(toBob)
+	submit(fromBob)
+
+	toAlice := spendTestTx(t, alice, []OutPoint{g1}, TxOut{Amount: 50, To: alice.Address()})
+	require.NoError(t, blkchain.ProcessBlock(mineRegtestBlock(t, genesis, 1, Body{toAlice})))
+
+	assert.Zero(t, mempool.Len(), "the transactions conflicting with the block should be removed")
+	assert.Equal(t, RemovedConflict, reasons[toBob.Hash])
+	assert.Equal(t, RemovedConflict, reasons[fromBob.Hash], "the descendants of a conflict should be removed")
+
+	t.Run("disconnected", func(t *testing.T) {
+		spendG0 := spendTestTx(t, alice, []OutPoint{g0}, TxOut{Amount: 100, To: bob.Address()})
+
+		// toBob spends the output spent at the tip
+		mempool.HandleNotification(Notification{Type: NTBlockDisconnected, Block: Block{Body: Body{toBob, spendG0}}})
+		assert.False(t, mempool.Has(toBob.Hash), "the returned transactions should be verified")
+		assert.True(t, mempool.Has(spendG0.Hash))
+	})
+}
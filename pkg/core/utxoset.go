@@ -0,0 +1,441 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+
+	"github.com/meddion/pkg/crypto"
+)
+
+// TxResult codes of UTXOSet
+const (
+	UTXOCodeRejected uint32 = iota + 1
+	UTXOCodeUnknownPayload
+)
+
+// UTXOSet is the Application of the UTXO ledger mode. The unspent outputs
+// and the undo data of every block are kept in the BlockRepo, so the set
+// survives restarts and reorganizations.
+//
+// The transactions without inputs are only allowed in the genesis block
+// where they allocate the initial outputs. Later the outputs are created
+// by the coinbase transactions, see ChainParams.CoinbaseMaturity.
+type UTXOSet struct {
+	db     *BlockRepo
+	params *ChainParams
+
+	mtx  sync.RWMutex
+	info AppInfo
+
+	// The block being executed: the outputs it spent and created,
+	// and the first transaction that failed
+	block   BlockInfo
+	spent   map[OutPoint]UTXOEntry
+	created map[OutPoint]UTXOEntry
+	failed  error
+}
+
+var (
+	_ Application   = (*UTXOSet)(nil)
+	_ FeeCalculator = (*UTXOSet)(nil)
+)
+
+func NewUTXOSet(db *BlockRepo, params *ChainParams) (*UTXOSet, error) {
+	info, err := db.UTXOInfo()
+	if errors.Is(err, ErrMissingChainState) {
+		info, err = AppInfo{LastHeight: -1}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("on loading the UTXO set: %w", err)
+	}
+
+	return &UTXOSet{db: db, params: params, info: info}, nil
+}
+
+// UTXO returns a committed unspent output.
+func (s *UTXOSet) UTXO(op OutPoint) (UTXOEntry, error) {
+	return s.db.UTXO(op)
+}
+
+func (s *UTXOSet) Info() AppInfo {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	return s.info
+}
+
+func (s *UTXOSet) BeginBlock(info BlockInfo) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if info.Height != s.info.LastHeight+1 {
+		return fmt.Errorf("block at height %d doesn't follow height %d", info.Height, s.info.LastHeight)
+	}
+
+	s.block = info
+	s.spent = make(map[OutPoint]UTXOEntry)
+	s.created = make(map[OutPoint]UTXOEntry)
+	s.failed = nil
+
+	return nil
+}
+
+// DeliverTx spends the inputs of a UTXO transaction and creates its outputs.
+// A failed transaction makes the whole block invalid, see EndBlock.
+func (s *UTXOSet) DeliverTx(tx Transaction) TxResult {
+	if coinbase, ok, err := decodeCoinbase(tx); ok {
+		s.mtx.Lock()
+		defer s.mtx.Unlock()
+
+		if err == nil {
+			err = s.checkOutputs(tx.Hash, len(coinbase.Outputs))
+		}
+		if err == nil {
+			s.create(tx.Hash, coinbase.Outputs, true)
+		}
+		return s.result(tx, err)
+	}
+
+	u, ok, err := decodeUTXOTx(tx)
+	if !ok {
+		return TxResult{Code: UTXOCodeUnknownPayload, Log: "not a UTXO transaction"}
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if err == nil {
+		err = s.apply(tx.Hash, u)
+	}
+
+	return s.result(tx, err)
+}
+
+// Must be called with s.mtx held.
+func (s *UTXOSet) result(tx Transaction, err error) TxResult {
+	if err != nil {
+		if s.failed == nil {
+			s.failed = fmt.Errorf("transaction %x: %w", tx.Hash, err)
+		}
+		return TxResult{Code: UTXOCodeRejected, Log: err.Error()}
+	}
+
+	return TxResult{Code: TxCodeOK}
+}
+
+// Must be called with s.mtx held.
+func (s *UTXOSet) apply(hash crypto.HashValue, u UTXOTx) error {
+	if err := u.verify(); err != nil {
+		return err
+	}
+
+	if len(u.Inputs) == 0 && s.block.Height != 0 {
+		return ErrNoInputs
+	}
+
+	entries := make([]UTXOEntry, len(u.Inputs))
+	for i, in := range u.Inputs {
+		entry, err := s.lookup(in.Prev)
+		if err != nil {
+			return err
+		}
+		entries[i] = entry
+	}
+
+	if _, err := s.checkInputs(u, entries, s.block.Height); err != nil {
+		return err
+	}
+
+	if err := s.checkOutputs(hash, len(u.Outputs)); err != nil {
+		return err
+	}
+
+	for i, in := range u.Inputs {
+		if _, exists := s.created[in.Prev]; exists {
+			delete(s.created, in.Prev)
+		} else {
+			s.spent[in.Prev] = entries[i]
+		}
+	}
+
+	s.create(hash, u.Outputs, false)
+
+	return nil
+}
+
+// create adds the outputs of a transaction to the block being executed.
+// Must be called with s.mtx held.
+func (s *UTXOSet) create(hash crypto.HashValue, outs []TxOut, coinbase bool) {
+	for i, out := range outs {
+		s.created[OutPoint{TxHash: hash, Index: uint32(i)}] = UTXOEntry{Out: out, Height: s.block.Height, Coinbase: coinbase}
+	}
+}
+
+// checkOutputs makes sure the outputs of a transaction don't exist yet.
+// Must be called with s.mtx held.
+func (s *UTXOSet) checkOutputs(hash crypto.HashValue, n int) error {
+	for i := 0; i < n; i++ {
+		op := OutPoint{TxHash: hash, Index: uint32(i)}
+		if _, err := s.lookup(op); err == nil || errors.Is(err, ErrDoubleSpend) {
+			return fmt.Errorf("%w: output %s already exists", ErrDuplicateTx, op)
+		}
+	}
+
+	return nil
+}
+
+// lookup finds an output unspent by the block being executed.
+// Must be called with s.mtx held.
+func (s *UTXOSet) lookup(op OutPoint) (UTXOEntry, error) {
+	if entry, exists := s.created[op]; exists {
+		return entry, nil
+	}
+
+	if _, spent := s.spent[op]; spent {
+		return UTXOEntry{}, fmt.Errorf("%w: %s", ErrDoubleSpend, op)
+	}
+
+	return s.db.UTXO(op)
+}
+
+// checkInputs checks that the inputs are signed by the owners of the spent
+// outputs, the spent coinbase outputs are mature and the inputs cover
+// the outputs of the transaction. Returns the fee of the transaction.
+func (s *UTXOSet) checkInputs(u UTXOTx, entries []UTXOEntry, height int) (uint64, error) {
+	var sum uint64
+	for i, in := range u.Inputs {
+		addr, err := signerAddress(in.Sig)
+		if err != nil || addr != entries[i].Out.To {
+			return 0, fmt.Errorf("%w: input #%d", ErrInputOwner, i)
+		}
+
+		if entries[i].Coinbase && height-entries[i].Height < s.params.CoinbaseMaturity {
+			return 0, fmt.Errorf("%w: %s", ErrImmatureCoinbase, in.Prev)
+		}
+
+		if sum > math.MaxUint64-entries[i].Out.Amount {
+			return 0, ErrAmountOverflow
+		}
+		sum += entries[i].Out.Amount
+	}
+
+	if len(u.Inputs) == 0 {
+		return 0, nil
+	}
+
+	outSum, err := u.OutputSum()
+	if err != nil {
+		return 0, err
+	}
+
+	if sum < outSum {
+		return 0, fmt.Errorf("%w: %d < %d", ErrInsufficientInput, sum, outSum)
+	}
+
+	return sum - outSum, nil
+}
+
+func (s *UTXOSet) EndBlock(BlockInfo) error {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	return s.failed
+}
+
+func (s *UTXOSet) Commit() (crypto.HashValue, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.failed != nil {
+		return crypto.HashValue{}, s.failed
+	}
+
+	undo := utxoUndo{prevInfo: s.info, spent: s.spent, created: sortedOutPoints(s.created)}
+
+	appHash, err := s.changesHash(undo)
+	if err != nil {
+		return crypto.HashValue{}, err
+	}
+
+	info := AppInfo{LastHeight: s.block.Height, LastBlockHash: s.block.Hash, AppHash: appHash}
+	if err := s.db.commitUTXOBlock(info, undo, s.created); err != nil {
+		return crypto.HashValue{}, fmt.Errorf("on storing the UTXO set: %w", err)
+	}
+
+	s.info = info
+	s.spent, s.created = nil, nil
+
+	return appHash, nil
+}
+
+// changesHash chains the previous app hash with the changes of the block:
+// Hash(PrevAppHash | BlockHash | spent OutPoints | created OutPoints with outputs).
+// Must be called with s.mtx held.
+func (s *UTXOSet) changesHash(undo utxoUndo) (crypto.HashValue, error) {
+	var e encoder
+	e.hash(s.info.AppHash)
+	e.hash(s.block.Hash)
+
+	for _, op := range sortedOutPoints(undo.spent) {
+		e.outPoint(op)
+	}
+	for _, op := range undo.created {
+		e.outPoint(op)
+		e.utxoEntry(s.created[op])
+	}
+
+	return crypto.Hash256(e.buf)
+}
+
+func (s *UTXOSet) Rollback(info BlockInfo) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if info.Hash != s.info.LastBlockHash || s.info.LastHeight < 0 {
+		return fmt.Errorf("block %x isn't the last applied one", info.Hash)
+	}
+
+	prevInfo, err := s.db.rollbackUTXOBlock(info.Hash)
+	if err != nil {
+		return fmt.Errorf("on rolling back the UTXO set: %w", err)
+	}
+	s.info = prevInfo
+
+	return nil
+}
+
+// Validator checks the UTXO transactions. It rejects the transactions
+// spending the outputs already spent by the transactions preceding them.
+// For the pending transactions the inputs are also checked against
+// the UTXO set. The transactions of a block are checked against the set
+// once it is executed. It should be registered with PayloadUTXO.
+func (s *UTXOSet) Validator() TxValidator {
+	return TxValidatorFunc(func(ctx ChainContext, tx Transaction, payload []byte) error {
+		var u UTXOTx
+		if err := u.FromBytes(payload); err != nil {
+			return err
+		}
+
+		if err := u.verify(); err != nil {
+			return err
+		}
+
+		if len(u.Inputs) == 0 {
+			return ErrNoInputs
+		}
+
+		if !ctx.Pending {
+			spent := precedingOutputs(ctx).spent
+			for _, in := range u.Inputs {
+				if _, exists := spent[in.Prev]; exists {
+					return fmt.Errorf("%w: %s", ErrDoubleSpend, in.Prev)
+				}
+			}
+
+			return nil
+		}
+
+		_, err := s.pendingFee(ctx, u)
+		return err
+	})
+}
+
+// Fee returns the difference between the inputs and the outputs of
+// a UTXO transaction. The inputs are looked up among the outputs of
+// the preceding transactions and in the UTXO set.
+func (s *UTXOSet) Fee(ctx ChainContext, tx Transaction) (uint64, error) {
+	u, ok, err := decodeUTXOTx(tx)
+	if !ok || len(u.Inputs) == 0 {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return s.pendingFee(ctx, u)
+}
+
+func (s *UTXOSet) pendingFee(ctx ChainContext, u UTXOTx) (uint64, error) {
+	preceding := precedingOutputs(ctx)
+
+	entries := make([]UTXOEntry, len(u.Inputs))
+	for i, in := range u.Inputs {
+		if _, exists := preceding.spent[in.Prev]; exists {
+			return 0, fmt.Errorf("%w: %s", ErrDoubleSpend, in.Prev)
+		}
+
+		entry, exists := preceding.created[in.Prev]
+		if exists {
+			entry.Height = ctx.Height
+		} else {
+			var err error
+			if entry, err = s.db.UTXO(in.Prev); err != nil {
+				return 0, err
+			}
+		}
+		entries[i] = entry
+	}
+
+	return s.checkInputs(u, entries, ctx.Height)
+}
+
+// precedingOutputs returns the outputs spent and created by the transactions
+// preceding the one being checked. The height of the created ones isn't set.
+func precedingOutputs(ctx ChainContext) *outputsIndex {
+	return ctx.Preceding.Index(PayloadUTXO, func() TxIndex { return newOutputsIndex() }).(*outputsIndex)
+}
+
+// outputsIndex keeps the outputs spent and created by the UTXO transactions
+// and the coinbases.
+type outputsIndex struct {
+	spent   map[OutPoint]struct{}
+	created map[OutPoint]UTXOEntry
+}
+
+func newOutputsIndex() *outputsIndex {
+	return &outputsIndex{
+		spent:   make(map[OutPoint]struct{}),
+		created: make(map[OutPoint]UTXOEntry),
+	}
+}
+
+func (o *outputsIndex) Add(tx Transaction) {
+	if coinbase, ok, err := decodeCoinbase(tx); ok && err == nil {
+		for i, out := range coinbase.Outputs {
+			o.created[OutPoint{TxHash: tx.Hash, Index: uint32(i)}] = UTXOEntry{Out: out, Coinbase: true}
+		}
+		return
+	}
+
+	u, ok, err := decodeUTXOTx(tx)
+	if !ok || err != nil {
+		return
+	}
+
+	for _, in := range u.Inputs {
+		o.spent[in.Prev] = struct{}{}
+	}
+	for i, out := range u.Outputs {
+		o.created[OutPoint{TxHash: tx.Hash, Index: uint32(i)}] = UTXOEntry{Out: out}
+	}
+}
+
+func sortedOutPoints(m map[OutPoint]UTXOEntry) []OutPoint {
+	ops := make([]OutPoint, 0, len(m))
+	for op := range m {
+		ops = append(ops, op)
+	}
+
+	sort.Slice(ops, func(i, j int) bool {
+		if c := bytes.Compare(ops[i].TxHash[:], ops[j].TxHash[:]); c != 0 {
+			return c < 0
+		}
+		return ops[i].Index < ops[j].Index
+	})
+
+	return ops
+}
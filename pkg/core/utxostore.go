@@ -0,0 +1,241 @@
+package core
+
+import (
+	"fmt"
+
+	"github.com/boltdb/bolt"
+	"github.com/meddion/pkg/crypto"
+)
+
+const (
+	_dbUTXOBucket     = "utxo"
+	_dbUTXOUndoBucket = "utxoundo"
+)
+
+var _utxoInfoKey = []byte("utxoinfo")
+
+// UTXOEntry is an unspent output along with the height of its block
+type UTXOEntry struct {
+	Out    TxOut
+	Height int
+	// Coinbase outputs can only be spent after ChainParams.CoinbaseMaturity blocks
+	Coinbase bool
+}
+
+// utxoUndo reverts the changes a block made to the UTXO set
+type utxoUndo struct {
+	prevInfo AppInfo
+	spent    map[OutPoint]UTXOEntry
+	created  []OutPoint
+}
+
+// UTXO returns an unspent output. ErrMissingUTXO is returned if there is none.
+func (b *BlockRepo) UTXO(op OutPoint) (UTXOEntry, error) {
+	var entry UTXOEntry
+	if err := b.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(_dbUTXOBucket))
+		if bucket == nil {
+			return ErrBucketNotFound
+		}
+
+		v := bucket.Get(outPointKey(op))
+		if v == nil {
+			return fmt.Errorf("%w: %s", ErrMissingUTXO, op)
+		}
+
+		d := decoder{buf: v}
+		entry = d.utxoEntry()
+		return d.finish()
+	}); err != nil {
+		return UTXOEntry{}, err
+	}
+
+	return entry, nil
+}
+
+// UTXOInfo returns the last block applied to the UTXO set.
+// ErrMissingChainState is returned for an empty set.
+func (b *BlockRepo) UTXOInfo() (AppInfo, error) {
+	var info AppInfo
+	if err := b.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(_dbChainStateBucket))
+		if bucket == nil {
+			return ErrBucketNotFound
+		}
+
+		v := bucket.Get(_utxoInfoKey)
+		if v == nil {
+			return ErrMissingChainState
+		}
+
+		d := decoder{buf: v}
+		info = d.appInfo()
+		return d.finish()
+	}); err != nil {
+		return AppInfo{}, err
+	}
+
+	return info, nil
+}
+
+// commitUTXOBlock applies the changes of a block to the UTXO set
+// and keeps the undo data under the block hash.
+func (b *BlockRepo) commitUTXOBlock(info AppInfo, undo utxoUndo, created map[OutPoint]UTXOEntry) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		utxos, undos, state := tx.Bucket([]byte(_dbUTXOBucket)), tx.Bucket([]byte(_dbUTXOUndoBucket)),
+			tx.Bucket([]byte(_dbChainStateBucket))
+		if utxos == nil || undos == nil || state == nil {
+			return ErrBucketNotFound
+		}
+
+		for op := range undo.spent {
+			if err := utxos.Delete(outPointKey(op)); err != nil {
+				return err
+			}
+		}
+
+		for op, entry := range created {
+			var e encoder
+			e.utxoEntry(entry)
+			if err := utxos.Put(outPointKey(op), e.buf); err != nil {
+				return err
+			}
+		}
+
+		var e encoder
+		e.utxoUndo(undo)
+		if err := undos.Put(info.LastBlockHash[:], e.buf); err != nil {
+			return err
+		}
+
+		return putAppInfo(state, info)
+	})
+}
+
+// rollbackUTXOBlock reverts the changes of a block and returns
+// the info of the UTXO set before it.
+func (b *BlockRepo) rollbackUTXOBlock(hash crypto.HashValue) (AppInfo, error) {
+	var prevInfo AppInfo
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		utxos, undos, state := tx.Bucket([]byte(_dbUTXOBucket)), tx.Bucket([]byte(_dbUTXOUndoBucket)),
+			tx.Bucket([]byte(_dbChainStateBucket))
+		if utxos == nil || undos == nil || state == nil {
+			return ErrBucketNotFound
+		}
+
+		v := undos.Get(hash[:])
+		if v == nil {
+			return fmt.Errorf("%w: no undo data for block %x", ErrMissingChainState, hash)
+		}
+
+		d := decoder{buf: v}
+		undo := d.utxoUndo()
+		if err := d.finish(); err != nil {
+			return err
+		}
+
+		for _, op := range undo.created {
+			if err := utxos.Delete(outPointKey(op)); err != nil {
+				return err
+			}
+		}
+
+		for op, entry := range undo.spent {
+			var e encoder
+			e.utxoEntry(entry)
+			if err := utxos.Put(outPointKey(op), e.buf); err != nil {
+				return err
+			}
+		}
+
+		if err := undos.Delete(hash[:]); err != nil {
+			return err
+		}
+
+		prevInfo = undo.prevInfo
+		return putAppInfo(state, prevInfo)
+	})
+
+	return prevInfo, err
+}
+
+func putAppInfo(bucket *bolt.Bucket, info AppInfo) error {
+	var e encoder
+	e.appInfo(info)
+
+	return bucket.Put(_utxoInfoKey, e.buf)
+}
+
+func outPointKey(op OutPoint) []byte {
+	var e encoder
+	e.outPoint(op)
+
+	return e.buf
+}
+
+func (e *encoder) utxoEntry(entry UTXOEntry) {
+	e.txOut(entry.Out)
+	e.int64(int64(entry.Height))
+	if entry.Coinbase {
+		e.buf = append(e.buf, 1)
+	} else {
+		e.buf = append(e.buf, 0)
+	}
+}
+
+func (d *decoder) utxoEntry() UTXOEntry {
+	entry := UTXOEntry{Out: d.txOut(), Height: int(d.int64())}
+	if b := d.next(1); len(b) == 1 {
+		entry.Coinbase = b[0] == 1
+	}
+
+	return entry
+}
+
+func (e *encoder) appInfo(info AppInfo) {
+	e.int64(int64(info.LastHeight))
+	e.hash(info.LastBlockHash)
+	e.hash(info.AppHash)
+}
+
+func (d *decoder) appInfo() AppInfo {
+	return AppInfo{
+		LastHeight:    int(d.int64()),
+		LastBlockHash: d.hash(),
+		AppHash:       d.hash(),
+	}
+}
+
+// The undo data is encoded as
+//
+//	utxoUndo = PrevInfo | SpentCount u32 | (OutPoint | UTXOEntry) * SpentCount |
+//	           CreatedCount u32 | OutPoint * CreatedCount
+func (e *encoder) utxoUndo(u utxoUndo) {
+	e.appInfo(u.prevInfo)
+
+	e.uint32(uint32(len(u.spent)))
+	for _, op := range sortedOutPoints(u.spent) {
+		e.outPoint(op)
+		e.utxoEntry(u.spent[op])
+	}
+
+	e.uint32(uint32(len(u.created)))
+	for _, op := range u.created {
+		e.outPoint(op)
+	}
+}
+
+func (d *decoder) utxoUndo() utxoUndo {
+	u := utxoUndo{prevInfo: d.appInfo(), spent: make(map[OutPoint]UTXOEntry)}
+
+	for i, n := uint32(0), d.uint32(); i < n && d.err == nil; i++ {
+		op := d.outPoint()
+		u.spent[op] = d.utxoEntry()
+	}
+
+	for i, n := uint32(0), d.uint32(); i < n && d.err == nil; i++ {
+		u.created = append(u.created, d.outPoint())
+	}
+
+	return u
+}
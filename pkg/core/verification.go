@@ -8,35 +8,73 @@ import (
 	"github.com/meddion/pkg/crypto"
 )
 
+const (
+	_minDifficulty Difficulty = 15
+	// Starting from this version the merkle tree of a body is domain separated
+	// and can't contain duplicate transactions
+	_taggedMerkleVersion uint8 = 3
+	// The latest block version supported by this node
+	LatestBlockVersion uint8 = 3
+)
+
 var (
-	ErrUnsupportedVer    = errors.New("unsupported version")
-	ErrInvalidTimestamp  = errors.New("invalid timestamp")
-	ErrInvalidMerkleRoot = errors.New("invalid merkle root")
-	ErrInvalidDifficulty = errors.New("invalid difficulty")
-	ErrInvalidNonce      = errors.New("invalid nonce")
+	ErrUnsupportedVer   = errors.New("unsupported version")
+	ErrInvalidTimestamp = errors.New("invalid timestamp")
+	// Both match ErrInvalidTimestamp with errors.Is
+	ErrTimestampTooOld      = fmt.Errorf("%w: not after the median time past", ErrInvalidTimestamp)
+	ErrTimestampTooFarAhead = fmt.Errorf("%w: too far ahead of the network time", ErrInvalidTimestamp)
+	ErrInvalidMerkleRoot    = errors.New("invalid merkle root")
+	ErrInvalidDifficulty    = errors.New("invalid difficulty")
+	ErrInvalidNonce         = errors.New("invalid nonce")
+	ErrTooManyTxs           = errors.New("too many transactions in a block")
+	ErrBlockTooLarge        = errors.New("block is too large")
+	ErrDuplicateTx          = errors.New("duplicate transaction in a block")
 )
 
-// TODO: impl
-func (b Block) Verify() error {
-	if !verifyVersion(b.Version) {
+// Verify performs the checks that don't depend on the chain
+func (h Header) Verify(params *ChainParams) error {
+	if !params.isVersionAllowed(h.Version) {
 		return ErrUnsupportedVer
 	}
 
-	if !verifyDifficulty(b.Header.Difficulty) {
+	if h.Version < _compactBitsVersion {
+		if h.Bits != 0 || !verifyDifficulty(params, h.Difficulty) {
+			return ErrInvalidDifficulty
+		}
+	} else if h.Difficulty != 0 || !verifyBits(params, h.Bits) {
 		return ErrInvalidDifficulty
 	}
 
-	if err := b.Difficulty.VerifyNonce(b.Header); err != nil {
+	if err := h.VerifyNonce(); err != nil {
 		return ErrInvalidNonce
 	}
 
+	return nil
+}
+
+// Verify checks the block on its own and its transactions in the given context
+func (b Block) Verify(ctx ChainContext) error {
+	if err := b.Header.Verify(ctx.Params); err != nil {
+		return err
+	}
+
+	if err := verifyBodyLimits(ctx.Params, b); err != nil {
+		return err
+	}
+
+	if err := verifyCoinbase(b.Body); err != nil {
+		return err
+	}
+
+	ctx.Preceding = NewPrecedingTxs()
 	for _, tx := range b.Body {
-		if err := tx.Verify(); err != nil {
+		if err := tx.Verify(ctx); err != nil {
 			return err
 		}
+		ctx.Preceding.Add(tx)
 	}
 
-	if hash, err := crypto.GenMerkleRoot(b.Body); err != nil {
+	if hash, err := merkleRoot(b.Version, b.Body); err != nil {
 		return fmt.Errorf("on generating a merkle root: %w", err)
 	} else if b.MerkleRoot != hash {
 		return ErrInvalidMerkleRoot
@@ -45,35 +83,116 @@ func (b Block) Verify() error {
 	return nil
 }
 
-func verifyDifficulty(diff Difficulty) bool {
-	return diff > 14
+// verifyBodyLimits checks the resource limits of a block: the number of
+// transactions, the encoded size and the uniqueness of transactions.
+func verifyBodyLimits(params *ChainParams, b Block) error {
+	if len(b.Body) > params.MaxBlockTxs {
+		return fmt.Errorf("%w: %d > %d", ErrTooManyTxs, len(b.Body), params.MaxBlockTxs)
+	}
+
+	size := HeaderSize + 4
+	seen := make(map[crypto.HashValue]struct{}, len(b.Body))
+	for _, tx := range b.Body {
+		if _, exists := seen[tx.Hash]; exists {
+			return fmt.Errorf("%w: %x", ErrDuplicateTx, tx.Hash)
+		}
+		seen[tx.Hash] = struct{}{}
+
+		txSize, err := encodedTxSize(tx)
+		if err != nil {
+			return err
+		}
+
+		if size += txSize; size > params.MaxBlockSize {
+			return fmt.Errorf("%w: more than %d bytes", ErrBlockTooLarge, params.MaxBlockSize)
+		}
+	}
+
+	return nil
 }
 
-func verifyVersion(ver uint8) bool {
-	switch ver {
-	case 1:
-		return true
+// encodedTxSize returns the number of bytes a transaction takes in an encoded block.
+func encodedTxSize(tx Transaction) (int, error) {
+	b, err := tx.Bytes()
+	if err != nil {
+		return 0, err
 	}
 
-	return false
+	return len(b) + 4, nil
+}
+
+// merkleRoot computes the merkle root of a body as defined by the block version.
+func merkleRoot(version uint8, body Body) (crypto.HashValue, error) {
+	if version < _taggedMerkleVersion {
+		return crypto.GenMerkleRoot(body)
+	}
+
+	return crypto.GenMerkleRootV2(body)
+}
+
+func merkleProof(version uint8, body Body, index int) (crypto.MerkleProof, error) {
+	if version < _taggedMerkleVersion {
+		return crypto.GenMerkleProof(body, index)
+	}
+
+	return crypto.GenMerkleProofV2(body, index)
+}
+
+// VerifyTxProof checks that the transaction is included into the block with
+// the header. The header itself should be checked against the chain.
+func VerifyTxProof(header Header, tx Transaction, proof crypto.MerkleProof) error {
+	leaf, err := tx.Bytes()
+	if err != nil {
+		return err
+	}
+
+	if header.Version < _taggedMerkleVersion {
+		return crypto.VerifyMerkleProof(header.MerkleRoot, leaf, proof)
+	}
+
+	return crypto.VerifyMerkleProofV2(header.MerkleRoot, leaf, proof)
+}
+
+func verifyDifficulty(params *ChainParams, diff Difficulty) bool {
+	return diff >= params.MinDifficulty && diff <= MaxDifficulty
+}
+
+// Only canonically encoded targets not easier than MinDifficulty are valid
+func verifyBits(params *ChainParams, bits Bits) bool {
+	target := bits.Target()
+
+	return target.Sign() > 0 &&
+		target.Cmp(params.MinDifficulty.DifficultyBits()) <= 0 &&
+		TargetToBits(target) == bits
 }
 
 var (
 	ErrEmptyTxData      = errors.New("empty transaction data")
+	ErrOversizedTx      = errors.New("transaction is too large")
 	ErrInvalidSignature = errors.New("invalid signature")
 	ErrInvalidChecksum  = errors.New("invalid checksum")
 )
 
-func (tx Transaction) Verify() error {
+// Verify checks the transaction and passes its payload to the registered
+// TxValidator, if there is one for the payload type.
+func (tx Transaction) Verify(ctx ChainContext) error {
 	if len(tx.Data) == 0 {
 		return ErrEmptyTxData
 	}
 
+	size, err := encodedTxSize(tx)
+	if err != nil {
+		return err
+	}
+	if size > ctx.Params.MaxTxSize {
+		return fmt.Errorf("%w: %d > %d bytes", ErrOversizedTx, size, ctx.Params.MaxTxSize)
+	}
+
 	if tx.Sig == nil {
 		return ErrInvalidSignature
 	}
 
-	hash, err := crypto.Hash256(tx.Data[:])
+	hash, err := TxHash(tx.Type, tx.Data)
 	if err != nil || !bytes.Equal(hash[:], tx.Hash[:]) {
 		return ErrInvalidChecksum
 	}
@@ -82,10 +201,17 @@ func (tx Transaction) Verify() error {
 		return ErrInvalidSignature
 	}
 
-	return verifyTransactionData(tx.Data)
+	if ctx.Pending && IsCoinbase(tx) {
+		return ErrCoinbaseInMempool
+	}
+
+	return verifyTransactionData(ctx, tx)
 }
 
-// TODO: impl
-func verifyTransactionData(txData TxData) error {
-	return nil
+func verifyTransactionData(ctx ChainContext, tx Transaction) error {
+	if ctx.validators == nil {
+		return nil
+	}
+
+	return ctx.validators.validate(ctx, tx)
 }
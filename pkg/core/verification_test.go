@@ -8,6 +8,7 @@ import (
 
 	"github.com/meddion/pkg/crypto"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func init() {
@@ -47,7 +48,7 @@ func TestTransactionValidation(t *testing.T) {
 	}
 
 	for i, testCase := range testTable {
-		assert.Equal(t, testCase.target, testCase.tx.Verify(), "table entry #%d", i)
+		assert.Equal(t, testCase.target, testCase.tx.Verify(ChainContext{Params: &DefaultChainParams}), "table entry #%d", i)
 	}
 }
 
@@ -61,7 +62,7 @@ func TestBlockchainValidation(t *testing.T) {
 		assert.Equal(t, genesisBlock, blocks[0], "on checking genesis block")
 
 		for i := 1; i < len(blocks); i++ {
-			assert.NoError(t, blocks[i].Verify(), "on verifying block")
+			assert.NoError(t, blocks[i].Verify(ChainContext{Params: &DefaultChainParams}), "on verifying block")
 		}
 	})
 
@@ -69,7 +70,88 @@ func TestBlockchainValidation(t *testing.T) {
 		j := len(blocks) - 1
 		blocks[j].Header.Nonce = Nonce(0)
 
-		assert.Equal(t, ErrInvalidNonce, blocks[j].Verify(), "on verifying block")
+		assert.Equal(t, ErrInvalidNonce, blocks[j].Verify(ChainContext{Params: &DefaultChainParams}), "on verifying block")
+	})
+}
+
+func TestTaggedMerkleVersion(t *testing.T) {
+	txs, err := genRandTransactions(3)
+	require.NoError(t, err, "on generating random txs")
+	mutated := append(txs, txs[2])
+
+	newBlock := func(version uint8, body Body) Block {
+		mroot, err := merkleRoot(version, body[:3])
+		require.NoError(t, err, "on generating a merkle root")
+
+		h := Header{Version: version, Timestamp: time.Now().Unix(), MerkleRoot: mroot}
+		if version < _compactBitsVersion {
+			h.Difficulty = _minDifficulty
+		} else {
+			h.Bits = _minDifficulty.Bits()
+		}
+		h.Nonce, err = h.GenNonce()
+		require.NoError(t, err, "on generating a nonce")
+
+		return Block{Header: h, Body: body}
+	}
+
+	// A v1 block with a duplicated transaction matches the original merkle root,
+	// only the rule against duplicate transactions rejects it
+	v1 := newBlock(1, mutated)
+	root, err := merkleRoot(v1.Version, v1.Body)
+	require.NoError(t, err)
+	assert.Equal(t, v1.MerkleRoot, root)
+	assert.ErrorIs(t, v1.Verify(ChainContext{Params: &DefaultChainParams}), ErrDuplicateTx)
+
+	assert.NoError(t, newBlock(_taggedMerkleVersion, txs).Verify(ChainContext{Params: &DefaultChainParams}))
+	_, err = merkleRoot(_taggedMerkleVersion, mutated)
+	assert.ErrorIs(t, err, crypto.ErrDuplicateLeaf)
+
+	block := newBlock(_taggedMerkleVersion, txs)
+	proof, err := merkleProof(block.Version, block.Body, 1)
+	require.NoError(t, err, "on generating a merkle proof")
+	assert.NoError(t, VerifyTxProof(block.Header, txs[1], proof))
+
+	block.Version = _compactBitsVersion
+	assert.ErrorIs(t, VerifyTxProof(block.Header, txs[1], proof), crypto.ErrInvalidMerkleProof)
+}
+
+func TestBlockLimits(t *testing.T) {
+	txs, err := genRandTransactions(3)
+	require.NoError(t, err, "on generating random txs")
+
+	params := DefaultChainParams
+	params.MaxBlockTxs = 3
+	txSize, err := encodedTxSize(txs[0])
+	require.NoError(t, err)
+	params.MaxTxSize = txSize
+	params.MaxBlockSize = HeaderSize + 4 + 3*txSize
+
+	assert.NoError(t, verifyBodyLimits(&params, Block{Body: txs}))
+	assert.ErrorIs(t, verifyBodyLimits(&params, Block{Body: append(txs, txs[0])}), ErrTooManyTxs)
+	assert.ErrorIs(t, verifyBodyLimits(&params, Block{Body: Body{txs[0], txs[1], txs[0]}}), ErrDuplicateTx)
+
+	params.MaxBlockSize--
+	assert.ErrorIs(t, verifyBodyLimits(&params, Block{Body: txs}), ErrBlockTooLarge)
+
+	assert.NoError(t, txs[0].Verify(ChainContext{Params: &params}))
+	params.MaxTxSize--
+	assert.ErrorIs(t, txs[0].Verify(ChainContext{Params: &params}), ErrOversizedTx)
+
+	t.Run("block", func(t *testing.T) {
+		mroot, err := crypto.GenMerkleRoot(txs)
+		require.NoError(t, err)
+
+		h := Header{Version: 1, Timestamp: time.Now().Unix(), MerkleRoot: mroot, Difficulty: _minDifficulty}
+		h.Nonce, err = h.GenNonce()
+		require.NoError(t, err)
+
+		block := Block{Header: h, Body: txs}
+		assert.NoError(t, block.Verify(ChainContext{Params: &DefaultChainParams}))
+
+		params := DefaultChainParams
+		params.MaxBlockTxs = 2
+		assert.ErrorIs(t, block.Verify(ChainContext{Params: &params}), ErrTooManyTxs)
 	})
 }
 
@@ -130,7 +212,7 @@ func genRandTransactions(num int) ([]Transaction, error) {
 
 	txs := make([]Transaction, num)
 	for i := 0; i < len(txs); i++ {
-		msg := make(TxData, TxBodySizeLimit)
+		msg := make(TxData, 1024)
 		if _, err := rand.Read(msg); err != nil {
 			return nil, fmt.Errorf("on writing a random byte sequence: %w", err)
 		}
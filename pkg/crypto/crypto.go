@@ -5,15 +5,22 @@ import (
 	"crypto/elliptic"
 	"crypto/rand"
 	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"math/big"
 )
 
 var _pubCurve = elliptic.P256()
 
+var (
+	ErrInvalidPubKey  = errors.New("invalid public key")
+	ErrInvalidPrivKey = errors.New("invalid private key")
+)
+
 func init() {
 	// https://stackoverflow.com/questions/21934730/gob-type-not-registered-for-interface-mapstringinterface
-	gob.Register(_pubCurve)
-	gob.Register(sigECDSA{})
+	gob.Register(SigECDSA{})
 }
 
 type SignerECDSA struct {
@@ -30,23 +37,137 @@ func NewSignerECDSA() (SignerECDSA, error) {
 	return SignerECDSA{sk: sk}, nil
 }
 
-func (sk SignerECDSA) Sign(message []byte) (sigECDSA, error) {
+// Bytes returns the private key as a fixed-size big-endian scalar.
+func (sk SignerECDSA) Bytes() []byte {
+	return sk.sk.D.FillBytes(make([]byte, _scalarLen))
+}
+
+// SignerECDSAFromBytes restores a signer encoded by SignerECDSA.Bytes.
+func SignerECDSAFromBytes(data []byte) (SignerECDSA, error) {
+	d := new(big.Int).SetBytes(data)
+	if len(data) != _scalarLen || d.Sign() == 0 || d.Cmp(_pubCurve.Params().N) >= 0 {
+		return SignerECDSA{}, ErrInvalidPrivKey
+	}
+
+	sk := &ecdsa.PrivateKey{D: d, PublicKey: ecdsa.PublicKey{Curve: _pubCurve}}
+	sk.PublicKey.X, sk.PublicKey.Y = _pubCurve.ScalarBaseMult(data)
+
+	return SignerECDSA{sk: sk}, nil
+}
+
+func (sk SignerECDSA) Sign(message []byte) (SigECDSA, error) {
 	r, s, err := ecdsa.Sign(rand.Reader, sk.sk, message)
-	return sigECDSA{PK: sk.sk.PublicKey, R: r, S: s}, err
+	return SigECDSA{PK: sk.sk.PublicKey, R: r, S: s}, err
+}
+
+// Address returns the address of the signer's public key.
+func (sk SignerECDSA) Address() Address {
+	return pubKeyAddress(&sk.sk.PublicKey)
 }
 
-type sigECDSA struct {
+const AddressLen = 20
+
+// Address identifies the owner of a key pair: the first AddressLen bytes
+// of the hashed marshaled public key
+type Address [AddressLen]byte
+
+func (a Address) String() string {
+	return hex.EncodeToString(a[:])
+}
+
+// AddressFromHex parses an address written by Address.String.
+func AddressFromHex(s string) (Address, error) {
+	var a Address
+
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != AddressLen {
+		return a, fmt.Errorf("invalid address %q", s)
+	}
+	copy(a[:], b)
+
+	return a, nil
+}
+
+func pubKeyAddress(pk *ecdsa.PublicKey) Address {
+	var a Address
+	// sha256 doesn't fail on writes
+	hash, _ := Hash256(elliptic.Marshal(_pubCurve, pk.X, pk.Y))
+	copy(a[:], hash[:AddressLen])
+
+	return a
+}
+
+// SigECDSA is a signature carrying the public key it's made with
+type SigECDSA struct {
 	PK   ecdsa.PublicKey
 	R, S *big.Int
 }
 
-func (sig sigECDSA) Verify(signedMsg []byte) bool {
+func (sig SigECDSA) Verify(signedMsg []byte) bool {
 	return sig.isValidPubKey() && ecdsa.Verify(&sig.PK, signedMsg, sig.R, sig.S)
 }
 
-func (sig sigECDSA) isValidPubKey() bool {
+// Address returns the address of the public key the signature is made with.
+func (sig SigECDSA) Address() (Address, error) {
+	if !sig.isValidPubKey() {
+		return Address{}, ErrInvalidPubKey
+	}
+
+	return pubKeyAddress(&sig.PK), nil
+}
+
+func (sig SigECDSA) isValidPubKey() bool {
 	return sig.PK.X != nil &&
 		sig.PK.Y != nil &&
 		sig.PK.Curve != nil &&
 		sig.PK.IsOnCurve(sig.PK.X, sig.PK.Y)
 }
+
+// A signature is encoded as a marshaled public key point followed by
+// fixed-size R and S
+const (
+	_pubKeyLen   = 65
+	_scalarLen   = 32
+	_sigECDSALen = _pubKeyLen + 2*_scalarLen
+)
+
+func (sig SigECDSA) Bytes() ([]byte, error) {
+	if !sig.isValidPubKey() || sig.R == nil || sig.S == nil {
+		return nil, ErrInvalidPubKey
+	}
+
+	buf := make([]byte, _sigECDSALen)
+	copy(buf, elliptic.Marshal(_pubCurve, sig.PK.X, sig.PK.Y))
+	sig.R.FillBytes(buf[_pubKeyLen : _pubKeyLen+_scalarLen])
+	sig.S.FillBytes(buf[_pubKeyLen+_scalarLen:])
+
+	return buf, nil
+}
+
+// SigECDSAFromBytes decodes a signature encoded by SigECDSA.Bytes.
+func SigECDSAFromBytes(data []byte) (SigECDSA, error) {
+	if len(data) != _sigECDSALen {
+		return SigECDSA{}, ErrInvalidPubKey
+	}
+
+	x, y := elliptic.Unmarshal(_pubCurve, data[:_pubKeyLen])
+	if x == nil {
+		return SigECDSA{}, ErrInvalidPubKey
+	}
+
+	return SigECDSA{
+		PK: ecdsa.PublicKey{Curve: _pubCurve, X: x, Y: y},
+		R:  new(big.Int).SetBytes(data[_pubKeyLen : _pubKeyLen+_scalarLen]),
+		S:  new(big.Int).SetBytes(data[_pubKeyLen+_scalarLen:]),
+	}, nil
+}
+
+// Curve implementations don't expose any fields to gob
+func (sig SigECDSA) GobEncode() ([]byte, error) {
+	return sig.Bytes()
+}
+
+func (sig *SigECDSA) GobDecode(data []byte) (err error) {
+	*sig, err = SigECDSAFromBytes(data)
+	return err
+}
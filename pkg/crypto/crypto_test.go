@@ -38,4 +38,34 @@ func TestSigningWithSecretKey(t *testing.T) {
 
 		assert.False(t, sig.Verify([]byte("0x000001")), "on verifying a message")
 	})
+
+	t.Run("encoding", func(t *testing.T) {
+		msg := []byte("encoded signature")
+		sig, err := signer.Sign(msg)
+		assert.NoError(t, err, "on signing a message")
+
+		b, err := sig.Bytes()
+		assert.NoError(t, err, "on encoding a signature")
+		assert.Len(t, b, _sigECDSALen)
+
+		decoded, err := SigECDSAFromBytes(b)
+		assert.NoError(t, err, "on decoding a signature")
+		assert.True(t, decoded.Verify(msg), "on verifying a message")
+
+		b[1] ^= 0xff
+		_, err = SigECDSAFromBytes(b)
+		assert.ErrorIs(t, err, ErrInvalidPubKey, "the point should be on the curve")
+
+		_, err = SigECDSAFromBytes(b[1:])
+		assert.ErrorIs(t, err, ErrInvalidPubKey)
+	})
+
+	t.Run("private_key_encoding", func(t *testing.T) {
+		restored, err := SignerECDSAFromBytes(signer.Bytes())
+		assert.NoError(t, err, "on decoding a private key")
+		assert.Equal(t, signer.Address(), restored.Address())
+
+		_, err = SignerECDSAFromBytes(make([]byte, _scalarLen))
+		assert.ErrorIs(t, err, ErrInvalidPrivKey)
+	})
 }
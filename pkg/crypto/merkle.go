@@ -2,6 +2,7 @@ package crypto
 
 import (
 	"crypto/sha256"
+	"errors"
 	"fmt"
 )
 
@@ -29,52 +30,220 @@ type bytesConverter interface {
 	Bytes() ([]byte, error)
 }
 
+var (
+	ErrLeafIndexOutOfRange = errors.New("leaf index is out of range")
+	ErrInvalidMerkleProof  = errors.New("merkle proof doesn't match the root")
+	ErrDuplicateLeaf       = errors.New("duplicate merkle leaf")
+)
+
+// merkleScheme defines how the leaves and the inner nodes of a tree are hashed.
+type merkleScheme struct {
+	leafPrefix, nodePrefix []byte
+	// Needed when odd levels are padded by duplication: otherwise [a b c]
+	// and [a b c c] have the same root
+	uniqueLeaves bool
+}
+
+var (
+	// The original scheme that hashes leaves and nodes the same way
+	_merkleV1 = merkleScheme{}
+	// The leaves and the nodes are domain separated and the leaves are unique
+	_merkleV2 = merkleScheme{
+		leafPrefix:   []byte{0x00},
+		nodePrefix:   []byte{0x01},
+		uniqueLeaves: true,
+	}
+)
+
+// MerkleProof is the path from a leaf to the root: Siblings are the hashes
+// paired with the leaf on each level, from the bottom up.
+type MerkleProof struct {
+	Index    uint32
+	Siblings []HashValue
+}
+
 func GenMerkleRoot[T bytesConverter](values []T) (HashValue, error) {
-	switch len(values) {
-	case 0:
+	return genMerkleRoot(_merkleV1, values)
+}
+
+// GenMerkleRootV2 computes the root of the domain separated tree.
+// ErrDuplicateLeaf is returned if some values are encoded equally.
+func GenMerkleRootV2[T bytesConverter](values []T) (HashValue, error) {
+	return genMerkleRoot(_merkleV2, values)
+}
+
+// GenMerkleProof builds the inclusion proof of values[index].
+func GenMerkleProof[T bytesConverter](values []T, index int) (MerkleProof, error) {
+	return genMerkleProof(_merkleV1, values, index)
+}
+
+func GenMerkleProofV2[T bytesConverter](values []T, index int) (MerkleProof, error) {
+	return genMerkleProof(_merkleV2, values, index)
+}
+
+// Root computes the root a leaf leads to along the proof.
+func (p MerkleProof) Root(leaf []byte) (HashValue, error) {
+	return p.root(_merkleV1, leaf)
+}
+
+func (p MerkleProof) RootV2(leaf []byte) (HashValue, error) {
+	return p.root(_merkleV2, leaf)
+}
+
+// VerifyMerkleProof checks that the leaf is included into the tree with the root.
+func VerifyMerkleProof(root HashValue, leaf []byte, proof MerkleProof) error {
+	return verifyMerkleProof(_merkleV1, root, leaf, proof)
+}
+
+func VerifyMerkleProofV2(root HashValue, leaf []byte, proof MerkleProof) error {
+	return verifyMerkleProof(_merkleV2, root, leaf, proof)
+}
+
+func genMerkleRoot[T bytesConverter](scheme merkleScheme, values []T) (HashValue, error) {
+	if len(values) == 0 {
 		return _defaultHashFunc([]byte{})
-	case 1:
-		v, err := values[0].Bytes()
+	}
+
+	hashes, err := merkleLeaves(scheme, values)
+	if err != nil {
+		return HashValue{}, err
+	}
+
+	for len(hashes) > 1 {
+		if hashes, err = scheme.level(hashes); err != nil {
+			return HashValue{}, err
+		}
+	}
+
+	return hashes[0], nil
+}
+
+func genMerkleProof[T bytesConverter](scheme merkleScheme, values []T, index int) (MerkleProof, error) {
+	if index < 0 || index >= len(values) {
+		return MerkleProof{}, ErrLeafIndexOutOfRange
+	}
+
+	hashes, err := merkleLeaves(scheme, values)
+	if err != nil {
+		return MerkleProof{}, err
+	}
+
+	proof := MerkleProof{Index: uint32(index)}
+	for i := index; len(hashes) > 1; i /= 2 {
+		// The last hash of an odd level is paired with itself
+		sibling := i ^ 1
+		if sibling == len(hashes) {
+			sibling = i
+		}
+		proof.Siblings = append(proof.Siblings, hashes[sibling])
+
+		if hashes, err = scheme.level(hashes); err != nil {
+			return MerkleProof{}, err
+		}
+	}
+
+	return proof, nil
+}
+
+func (p MerkleProof) root(scheme merkleScheme, leaf []byte) (HashValue, error) {
+	if len(p.Siblings) < 32 && p.Index>>len(p.Siblings) != 0 {
+		return HashValue{}, ErrLeafIndexOutOfRange
+	}
+
+	hash, err := scheme.leaf(leaf)
+	if err != nil {
+		return HashValue{}, err
+	}
+
+	for i, sibling := range p.Siblings {
+		if p.Index>>i&1 == 0 {
+			hash, err = scheme.node(hash, sibling)
+		} else {
+			hash, err = scheme.node(sibling, hash)
+		}
 		if err != nil {
 			return HashValue{}, err
 		}
+	}
+
+	return hash, nil
+}
 
-		return _defaultHashFunc(v)
+func verifyMerkleProof(scheme merkleScheme, root HashValue, leaf []byte, proof MerkleProof) error {
+	computed, err := proof.root(scheme, leaf)
+	if err != nil {
+		return err
+	}
+
+	if computed != root {
+		return ErrInvalidMerkleProof
+	}
+
+	return nil
+}
+
+func merkleLeaves[T bytesConverter](scheme merkleScheme, values []T) ([]HashValue, error) {
+	var seen map[HashValue]struct{}
+	if scheme.uniqueLeaves {
+		seen = make(map[HashValue]struct{}, len(values))
 	}
 
 	hashes := make([]HashValue, len(values))
 	for i, v := range values {
 		v, err := v.Bytes()
 		if err != nil {
-			return HashValue{}, err
+			return nil, err
 		}
 
-		hash, err := _defaultHashFunc(v)
-		if err != nil {
-			return HashValue{}, nil
+		if hashes[i], err = scheme.leaf(v); err != nil {
+			return nil, err
 		}
-		hashes[i] = hash
-	}
 
-	for len(hashes) > 1 {
-		if len(hashes)%2 != 0 {
-			hashes = append(hashes, hashes[len(hashes)-1])
+		if seen != nil {
+			if _, exists := seen[hashes[i]]; exists {
+				return nil, ErrDuplicateLeaf
+			}
+			seen[hashes[i]] = struct{}{}
 		}
+	}
 
-		for i, j := 0, 0; i < len(hashes); i, j = i+2, j+1 {
-			buf := make([]byte, HashLen*2)
-			copy(buf[:HashLen], hashes[i][:])
-			copy(buf[HashLen:], hashes[i+1][:])
+	return hashes, nil
+}
 
-			hash, err := _defaultHashFunc(buf)
-			if err != nil {
-				return HashValue{}, nil
-			}
-			hashes[j] = hash
+// level hashes the pairs of a level, duplicating the last hash if
+// the level is odd. The hashes slice is reused for the result.
+func (s merkleScheme) level(hashes []HashValue) ([]HashValue, error) {
+	if len(hashes)%2 != 0 {
+		hashes = append(hashes, hashes[len(hashes)-1])
+	}
+
+	for i, j := 0, 0; i < len(hashes); i, j = i+2, j+1 {
+		hash, err := s.node(hashes[i], hashes[i+1])
+		if err != nil {
+			return nil, err
 		}
+		hashes[j] = hash
+	}
+
+	return hashes[:len(hashes)/2], nil
+}
 
-		hashes = hashes[:len(hashes)/2]
+func (s merkleScheme) leaf(value []byte) (HashValue, error) {
+	if len(s.leafPrefix) == 0 {
+		return _defaultHashFunc(value)
 	}
 
-	return hashes[0], nil
+	buf := make([]byte, 0, len(s.leafPrefix)+len(value))
+	buf = append(buf, s.leafPrefix...)
+
+	return _defaultHashFunc(append(buf, value...))
+}
+
+func (s merkleScheme) node(left, right HashValue) (HashValue, error) {
+	buf := make([]byte, 0, len(s.nodePrefix)+int(HashLen)*2)
+	buf = append(buf, s.nodePrefix...)
+	buf = append(buf, left[:]...)
+	buf = append(buf, right[:]...)
+
+	return _defaultHashFunc(buf)
 }
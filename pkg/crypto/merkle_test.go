@@ -4,6 +4,7 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 // TODO: add more inteligent tests
@@ -38,3 +39,120 @@ func TestMerkleRoot(t *testing.T) {
 		assert.Equal(t, testCase.expected, out, "on comparing merkle root hashes")
 	}
 }
+
+func TestMerkleRootV2(t *testing.T) {
+	testTable := []struct {
+		input    []bytes
+		expected HashValue
+	}{
+		{
+			[]bytes{bytes("a")},
+			// sha256(0x00 || "a")
+			[32]byte{0x2, 0x2a, 0x69, 0x79, 0xe6, 0xda, 0xb7, 0xaa, 0x5a, 0xe4,
+				0xc3, 0xe5, 0xe4, 0x5f, 0x7e, 0x97, 0x71, 0x12, 0xa7, 0xe6, 0x35,
+				0x93, 0x82, 0xd, 0xbe, 0xc1, 0xec, 0x73, 0x8a, 0x24, 0xf9, 0x3c,
+			},
+		},
+		{
+			[]bytes{
+				bytes("0xdead00000"),
+				bytes("0x32fgd2300"),
+				bytes("0x444234"),
+			},
+			[32]byte{0x86, 0x4b, 0x1b, 0x34, 0x15, 0x59, 0x87, 0x34, 0x8d, 0x6c,
+				0x3b, 0xc6, 0x21, 0x38, 0x72, 0xdc, 0xf9, 0x67, 0xb0, 0x60, 0x4f,
+				0x24, 0xec, 0xf8, 0xa7, 0xff, 0x9e, 0x3f, 0x88, 0xee, 0xe8, 0x5a,
+			},
+		},
+	}
+
+	for _, testCase := range testTable {
+		out, err := GenMerkleRootV2(testCase.input)
+		assert.NoError(t, err, "on generating a merkle root hash")
+		assert.Equal(t, testCase.expected, out, "on comparing merkle root hashes")
+	}
+}
+
+func TestMerkleMutation(t *testing.T) {
+	body := []bytes{bytes("a"), bytes("b"), bytes("c")}
+	mutated := append(body, body[2])
+
+	// The v1 tree can't tell the bodies apart
+	root, err := GenMerkleRoot(body)
+	require.NoError(t, err)
+	mutatedRoot, err := GenMerkleRoot(mutated)
+	require.NoError(t, err)
+	assert.Equal(t, root, mutatedRoot)
+
+	_, err = GenMerkleRootV2(mutated)
+	assert.ErrorIs(t, err, ErrDuplicateLeaf)
+
+	// A leaf can't pass for an inner node of the v2 tree
+	leaves := make([]byte, 0, HashLen*2)
+	for _, v := range body[:2] {
+		hash, err := Hash256(append([]byte{0x00}, v...))
+		require.NoError(t, err)
+		leaves = append(leaves, hash[:]...)
+	}
+	root, err = GenMerkleRootV2(body[:2])
+	require.NoError(t, err)
+	forgedRoot, err := GenMerkleRootV2([]bytes{leaves})
+	require.NoError(t, err)
+	assert.NotEqual(t, root, forgedRoot)
+
+	rootV1, err := GenMerkleRoot(body[:2])
+	require.NoError(t, err)
+	hashes := make([]byte, 0, HashLen*2)
+	for _, v := range body[:2] {
+		hash, err := Hash256(v)
+		require.NoError(t, err)
+		hashes = append(hashes, hash[:]...)
+	}
+	forgedRootV1, err := GenMerkleRoot([]bytes{hashes})
+	require.NoError(t, err)
+	assert.Equal(t, rootV1, forgedRootV1, "the v1 tree takes the concatenated leaf hashes for a node")
+}
+
+func TestMerkleProof(t *testing.T) {
+	for n := 1; n <= 9; n++ {
+		values := make([]bytes, n)
+		for i := range values {
+			values[i] = bytes{byte(i), byte(n)}
+		}
+
+		root, err := GenMerkleRoot(values)
+		require.NoError(t, err, "on generating a merkle root hash")
+
+		rootV2, err := GenMerkleRootV2(values)
+		require.NoError(t, err, "on generating a merkle root hash")
+
+		for i, v := range values {
+			proof, err := GenMerkleProof(values, i)
+			require.NoError(t, err, "on generating a merkle proof")
+			assert.NoError(t, VerifyMerkleProof(root, v, proof), "leaf %d of %d", i, n)
+
+			assert.ErrorIs(t, VerifyMerkleProof(root, bytes("forged"), proof), ErrInvalidMerkleProof)
+
+			proof, err = GenMerkleProofV2(values, i)
+			require.NoError(t, err, "on generating a merkle proof")
+			assert.NoError(t, VerifyMerkleProofV2(rootV2, v, proof), "leaf %d of %d", i, n)
+			assert.ErrorIs(t, VerifyMerkleProof(rootV2, v, proof), ErrInvalidMerkleProof)
+		}
+	}
+
+	values := []bytes{bytes("a"), bytes("b"), bytes("c")}
+	root, err := GenMerkleRoot(values)
+	require.NoError(t, err)
+
+	_, err = GenMerkleProof(values, len(values))
+	assert.ErrorIs(t, err, ErrLeafIndexOutOfRange)
+
+	proof, err := GenMerkleProof(values, 1)
+	require.NoError(t, err)
+
+	proof.Index = 0
+	assert.ErrorIs(t, VerifyMerkleProof(root, values[1], proof), ErrInvalidMerkleProof, "should be bound to the index")
+
+	proof.Index = 4
+	assert.ErrorIs(t, VerifyMerkleProof(root, values[1], proof), ErrLeafIndexOutOfRange)
+}
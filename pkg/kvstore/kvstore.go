@@ -0,0 +1,225 @@
+// Package kvstore is an in-memory key/value Application, the reference for
+// the applications built on top of tchain. Its transactions assign values
+// to keys: "key=value".
+package kvstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/meddion/pkg/core"
+	"github.com/meddion/pkg/crypto"
+)
+
+// PayloadType of the kvstore transactions
+const PayloadType core.PayloadType = 1
+
+// TxResult codes
+const (
+	CodeInvalidTx uint32 = iota + 1
+	CodeUnknownPayload
+)
+
+var (
+	ErrInvalidTx         = errors.New("invalid kvstore transaction")
+	ErrNothingToRollback = errors.New("no committed blocks to roll back")
+	ErrNotLastBlock      = errors.New("block isn't the last committed one")
+)
+
+// NewTxData encodes the assignment of a value to a key. The transactions
+// carry it with PayloadType.
+func NewTxData(key, value string) core.TxData {
+	return core.TxData(key + "=" + value)
+}
+
+func parseTx(payload []byte) (key, value string, err error) {
+	i := bytes.IndexByte(payload, '=')
+	if i <= 0 {
+		return "", "", fmt.Errorf("%w: expected key=value", ErrInvalidTx)
+	}
+
+	return string(payload[:i]), string(payload[i+1:]), nil
+}
+
+// Validator rejects malformed kvstore transactions before they get into
+// the mempool or a block. It should be registered with PayloadType.
+func Validator() core.TxValidator {
+	return core.TxValidatorFunc(func(_ core.ChainContext, _ core.Transaction, payload []byte) error {
+		_, _, err := parseTx(payload)
+		return err
+	})
+}
+
+type (
+	write struct {
+		key, value string
+	}
+
+	// change records the value a key had before a write
+	change struct {
+		key, prev string
+		existed   bool
+	}
+
+	// blockUndo reverts a committed block
+	blockUndo struct {
+		prevInfo core.AppInfo
+		changes  []change
+	}
+)
+
+// Store keeps the whole state and the undo data of every committed block in memory.
+type Store struct {
+	mtx   sync.RWMutex
+	state map[string]string
+	info  core.AppInfo
+
+	// The block being executed
+	block   core.BlockInfo
+	pending []write
+
+	undo []blockUndo
+}
+
+var _ core.Application = (*Store)(nil)
+
+func New() *Store {
+	s := &Store{
+		state: make(map[string]string),
+		info:  core.AppInfo{LastHeight: -1},
+	}
+	s.info.AppHash = s.hash()
+
+	return s
+}
+
+// Get returns the committed value of the key.
+func (s *Store) Get(key string) (string, bool) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	v, ok := s.state[key]
+	return v, ok
+}
+
+func (s *Store) Info() core.AppInfo {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	return s.info
+}
+
+func (s *Store) BeginBlock(info core.BlockInfo) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if info.Height != s.info.LastHeight+1 {
+		return fmt.Errorf("block at height %d doesn't follow height %d", info.Height, s.info.LastHeight)
+	}
+
+	s.block = info
+	s.pending = nil
+
+	return nil
+}
+
+func (s *Store) DeliverTx(tx core.Transaction) core.TxResult {
+	if tx.Type != PayloadType {
+		return core.TxResult{Code: CodeUnknownPayload, Log: fmt.Sprintf("payload type %d isn't handled", tx.Type)}
+	}
+
+	key, value, err := parseTx(tx.Data)
+	if err != nil {
+		return core.TxResult{Code: CodeInvalidTx, Log: err.Error()}
+	}
+
+	s.mtx.Lock()
+	s.pending = append(s.pending, write{key: key, value: value})
+	s.mtx.Unlock()
+
+	return core.TxResult{Code: core.TxCodeOK}
+}
+
+func (s *Store) EndBlock(core.BlockInfo) error {
+	return nil
+}
+
+func (s *Store) Commit() (crypto.HashValue, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	undo := blockUndo{prevInfo: s.info, changes: make([]change, len(s.pending))}
+	for i, w := range s.pending {
+		prev, existed := s.state[w.key]
+		undo.changes[i] = change{key: w.key, prev: prev, existed: existed}
+		s.state[w.key] = w.value
+	}
+
+	s.undo = append(s.undo, undo)
+	s.pending = nil
+	s.info = core.AppInfo{
+		LastHeight:    s.block.Height,
+		LastBlockHash: s.block.Hash,
+		AppHash:       s.hash(),
+	}
+
+	return s.info.AppHash, nil
+}
+
+func (s *Store) Rollback(info core.BlockInfo) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if len(s.undo) == 0 {
+		return ErrNothingToRollback
+	}
+
+	if info.Hash != s.info.LastBlockHash {
+		return fmt.Errorf("%w: %x", ErrNotLastBlock, info.Hash)
+	}
+
+	last := s.undo[len(s.undo)-1]
+	for i := len(last.changes) - 1; i >= 0; i-- {
+		c := last.changes[i]
+		if c.existed {
+			s.state[c.key] = c.prev
+		} else {
+			delete(s.state, c.key)
+		}
+	}
+
+	s.undo = s.undo[:len(s.undo)-1]
+	s.info = last.prevInfo
+
+	return nil
+}
+
+// hash commits to the sorted key/value pairs, each length-prefixed.
+// Must be called with s.mtx held.
+func (s *Store) hash() crypto.HashValue {
+	keys := make([]string, 0, len(s.state))
+	for k := range s.state {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var (
+		buf    bytes.Buffer
+		length [4]byte
+	)
+	for _, k := range keys {
+		for _, field := range []string{k, s.state[k]} {
+			binary.BigEndian.PutUint32(length[:], uint32(len(field)))
+			buf.Write(length[:])
+			buf.WriteString(field)
+		}
+	}
+
+	hash, _ := crypto.Hash256(buf.Bytes())
+
+	return hash
+}
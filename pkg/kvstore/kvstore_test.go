@@ -0,0 +1,126 @@
+package kvstore
+
+import (
+	"context"
+	"io"
+	"log"
+	"path/filepath"
+	"testing"
+
+	"github.com/meddion/pkg/core"
+	"github.com/meddion/pkg/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type txSourceFunc func(int) []core.Transaction
+
+func (f txSourceFunc) PendingTransactions(max int) []core.Transaction {
+	return f(max)
+}
+
+func signTx(t *testing.T, signer crypto.SignerECDSA, data core.TxData) core.Transaction {
+	tx, err := core.NewTx(signer, PayloadType, data)
+	require.NoError(t, err, "on signing a transaction")
+
+	return tx
+}
+
+func kvTx(data core.TxData) core.Transaction {
+	return core.Transaction{Type: PayloadType, Data: data}
+}
+
+func execute(t *testing.T, s *Store, height int, txs ...core.Transaction) core.TxResult {
+	var result core.TxResult
+
+	require.NoError(t, s.BeginBlock(core.BlockInfo{Height: height, Hash: crypto.HashValue{byte(height)}}))
+	for _, tx := range txs {
+		result = s.DeliverTx(tx)
+	}
+	require.NoError(t, s.EndBlock(core.BlockInfo{}))
+	_, err := s.Commit()
+	require.NoError(t, err)
+
+	return result
+}
+
+func TestStore(t *testing.T) {
+	s := New()
+	empty := s.Info()
+	assert.Equal(t, -1, empty.LastHeight)
+
+	execute(t, s, 0, kvTx(NewTxData("a", "1")), kvTx(NewTxData("b", "2")))
+	first := s.Info()
+	assert.Equal(t, 0, first.LastHeight)
+	assert.NotEqual(t, empty.AppHash, first.AppHash)
+
+	result := execute(t, s, 1, kvTx(NewTxData("a", "3")), kvTx(NewTxData("c", "4")), core.Transaction{Data: core.TxData("x=y")})
+	assert.Equal(t, CodeUnknownPayload, result.Code)
+
+	v, ok := s.Get("a")
+	assert.True(t, ok)
+	assert.Equal(t, "3", v)
+
+	require.NoError(t, s.Rollback(core.BlockInfo{Hash: crypto.HashValue{1}}))
+	assert.Equal(t, first, s.Info(), "the state should be restored")
+	v, _ = s.Get("a")
+	assert.Equal(t, "1", v)
+	_, ok = s.Get("c")
+	assert.False(t, ok)
+
+	assert.ErrorIs(t, s.Rollback(core.BlockInfo{Hash: crypto.HashValue{1}}), ErrNotLastBlock)
+	require.NoError(t, s.Rollback(core.BlockInfo{Hash: crypto.HashValue{0}}))
+	assert.Equal(t, empty, s.Info())
+	assert.ErrorIs(t, s.Rollback(core.BlockInfo{}), ErrNothingToRollback)
+
+	other := New()
+	execute(t, other, 0, kvTx(NewTxData("b", "2")), kvTx(NewTxData("a", "1")))
+	assert.Equal(t, first.AppHash, other.Info().AppHash, "the hash shouldn't depend on the order of writes")
+
+	result = execute(t, other, 1, kvTx(NewTxData("", "1")))
+	assert.Equal(t, CodeInvalidTx, result.Code)
+	assert.Equal(t, first.AppHash, other.Info().AppHash)
+}
+
+func TestStoreOnChain(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	db, err := core.NewBlockRepo(filepath.Join(t.TempDir(), "blocks.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	blkchain, err := core.NewBlockchain(db, &core.RegtestChainParams, logger)
+	require.NoError(t, err)
+	require.NoError(t, blkchain.RegisterTxValidator(PayloadType, Validator()))
+
+	signer, err := crypto.NewSignerECDSA()
+	require.NoError(t, err)
+
+	invalid := signTx(t, signer, core.TxData("no assignment"))
+	assert.NoError(t, invalid.Verify(core.ChainContext{Params: &core.RegtestChainParams}),
+		"validators are only called in the chain context")
+
+	pending := []core.Transaction{signTx(t, signer, NewTxData("greeting", "hello")), invalid}
+	miner := core.NewMiner(blkchain, txSourceFunc(func(int) []core.Transaction { return pending }), nil, 1, logger)
+
+	store := New()
+	require.NoError(t, blkchain.SetApplication(store))
+
+	block, err := miner.MineBlock(context.Background())
+	require.NoError(t, err)
+	assert.Len(t, block.Body, 1, "the invalid transaction should be left out")
+
+	v, ok := store.Get("greeting")
+	assert.True(t, ok)
+	assert.Equal(t, "hello", v)
+
+	tip, height := blkchain.BestBlock()
+	assert.Equal(t, height, store.Info().LastHeight)
+	assert.Equal(t, tip, store.Info().LastBlockHash)
+
+	replayed := New()
+	blkchain2, err := core.NewBlockchain(db, &core.RegtestChainParams, logger)
+	require.NoError(t, err)
+	require.NoError(t, blkchain2.SetApplication(replayed), "on replaying the stored chain")
+	assert.Equal(t, store.Info(), replayed.Info())
+}
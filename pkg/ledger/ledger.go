@@ -0,0 +1,345 @@
+// Package ledger is an account-based token Application. Accounts are
+// identified by the addresses of their keys and hold a balance and the nonce
+// of the last transfer they sent. The genesis block allocates the initial
+// balances.
+package ledger
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+
+	"github.com/meddion/pkg/core"
+	"github.com/meddion/pkg/crypto"
+)
+
+// TxResult codes
+const (
+	CodeRejected uint32 = iota + 1
+	CodeUnknownPayload
+)
+
+var (
+	ErrUnknownSender          = errors.New("transaction sender is unknown")
+	ErrZeroAmount             = errors.New("zero amount")
+	ErrInsufficientFunds      = errors.New("insufficient funds")
+	ErrBalanceOverflow        = errors.New("balance overflow")
+	ErrNonceReused            = errors.New("nonce is already used")
+	ErrNonceGap               = errors.New("nonce skips the next one")
+	ErrAllocationAfterGenesis = errors.New("allocations are only allowed in the genesis block")
+	ErrNothingToRollback      = errors.New("no committed blocks to roll back")
+	ErrNotLastBlock           = errors.New("block isn't the last committed one")
+)
+
+type Account struct {
+	Balance uint64
+	// Nonce of the last transfer sent from the account
+	Nonce uint64
+}
+
+// transfer checks a transfer from the account and applies it.
+func (a *Account) transfer(o op) error {
+	switch {
+	case o.nonce <= a.Nonce:
+		return fmt.Errorf("%w: %d", ErrNonceReused, o.nonce)
+	case o.nonce > a.Nonce+1:
+		return fmt.Errorf("%w: expected %d, got %d", ErrNonceGap, a.Nonce+1, o.nonce)
+	case o.amount > a.Balance:
+		return fmt.Errorf("%w: %d > %d", ErrInsufficientFunds, o.amount, a.Balance)
+	}
+
+	a.Nonce = o.nonce
+	a.Balance -= o.amount
+
+	return nil
+}
+
+func (a *Account) credit(amount uint64) error {
+	if a.Balance > math.MaxUint64-amount {
+		return ErrBalanceOverflow
+	}
+	a.Balance += amount
+
+	return nil
+}
+
+// blockUndo keeps the accounts changed by a committed block as they were
+// before it. A missing account is stored as nil.
+type blockUndo struct {
+	prevInfo core.AppInfo
+	accounts map[crypto.Address]*Account
+}
+
+// Ledger keeps the accounts and the undo data of every committed block in memory.
+type Ledger struct {
+	mtx      sync.RWMutex
+	accounts map[crypto.Address]Account
+	info     core.AppInfo
+
+	// The block being executed: the accounts it changed
+	// and the first transaction that failed
+	block   core.BlockInfo
+	pending map[crypto.Address]Account
+	failed  error
+
+	undo []blockUndo
+}
+
+var _ core.Application = (*Ledger)(nil)
+
+func New() *Ledger {
+	l := &Ledger{
+		accounts: make(map[crypto.Address]Account),
+		info:     core.AppInfo{LastHeight: -1},
+	}
+	l.info.AppHash = l.hash()
+
+	return l
+}
+
+// Account returns the committed state of the account.
+func (l *Ledger) Account(addr crypto.Address) Account {
+	l.mtx.RLock()
+	defer l.mtx.RUnlock()
+
+	return l.accounts[addr]
+}
+
+func (l *Ledger) Info() core.AppInfo {
+	l.mtx.RLock()
+	defer l.mtx.RUnlock()
+
+	return l.info
+}
+
+func (l *Ledger) BeginBlock(info core.BlockInfo) error {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	if info.Height != l.info.LastHeight+1 {
+		return fmt.Errorf("block at height %d doesn't follow height %d", info.Height, l.info.LastHeight)
+	}
+
+	l.block = info
+	l.pending = make(map[crypto.Address]Account)
+	l.failed = nil
+
+	return nil
+}
+
+// DeliverTx applies a ledger transaction. A failed one makes the whole
+// block invalid, see EndBlock.
+func (l *Ledger) DeliverTx(tx core.Transaction) core.TxResult {
+	o, ok, err := decodeTx(tx)
+	if !ok {
+		return core.TxResult{Code: CodeUnknownPayload, Log: "not a ledger transaction"}
+	}
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	if err == nil {
+		err = l.apply(tx, o)
+	}
+
+	if err != nil {
+		if l.failed == nil {
+			l.failed = fmt.Errorf("transaction %x: %w", tx.Hash, err)
+		}
+		return core.TxResult{Code: CodeRejected, Log: err.Error()}
+	}
+
+	return core.TxResult{Code: core.TxCodeOK}
+}
+
+// Must be called with l.mtx held.
+func (l *Ledger) apply(tx core.Transaction, o op) error {
+	if o.kind == KindAllocation {
+		if l.block.Height != 0 {
+			return ErrAllocationAfterGenesis
+		}
+
+		to := l.pendingAccount(o.to)
+		if err := to.credit(o.amount); err != nil {
+			return err
+		}
+		l.pending[o.to] = to
+
+		return nil
+	}
+
+	if o.amount == 0 {
+		return ErrZeroAmount
+	}
+
+	sender, err := Sender(tx)
+	if err != nil {
+		return err
+	}
+
+	from := l.pendingAccount(sender)
+	if err := from.transfer(o); err != nil {
+		return err
+	}
+	l.pending[sender] = from
+
+	to := l.pendingAccount(o.to)
+	if err := to.credit(o.amount); err != nil {
+		// The sender's changes are dropped with the invalid block
+		return err
+	}
+	l.pending[o.to] = to
+
+	return nil
+}
+
+// Must be called with l.mtx held.
+func (l *Ledger) pendingAccount(addr crypto.Address) Account {
+	if a, ok := l.pending[addr]; ok {
+		return a
+	}
+
+	return l.accounts[addr]
+}
+
+func (l *Ledger) EndBlock(core.BlockInfo) error {
+	l.mtx.RLock()
+	defer l.mtx.RUnlock()
+
+	return l.failed
+}
+
+func (l *Ledger) Commit() (crypto.HashValue, error) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	if l.failed != nil {
+		return crypto.HashValue{}, l.failed
+	}
+
+	undo := blockUndo{prevInfo: l.info, accounts: make(map[crypto.Address]*Account, len(l.pending))}
+	for addr, a := range l.pending {
+		if prev, exists := l.accounts[addr]; exists {
+			undo.accounts[addr] = &prev
+		} else {
+			undo.accounts[addr] = nil
+		}
+		l.accounts[addr] = a
+	}
+
+	l.undo = append(l.undo, undo)
+	l.pending = nil
+	l.info = core.AppInfo{
+		LastHeight:    l.block.Height,
+		LastBlockHash: l.block.Hash,
+		AppHash:       l.hash(),
+	}
+
+	return l.info.AppHash, nil
+}
+
+func (l *Ledger) Rollback(info core.BlockInfo) error {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	if len(l.undo) == 0 {
+		return ErrNothingToRollback
+	}
+
+	if info.Hash != l.info.LastBlockHash {
+		return fmt.Errorf("%w: %x", ErrNotLastBlock, info.Hash)
+	}
+
+	last := l.undo[len(l.undo)-1]
+	for addr, prev := range last.accounts {
+		if prev == nil {
+			delete(l.accounts, addr)
+		} else {
+			l.accounts[addr] = *prev
+		}
+	}
+
+	l.undo = l.undo[:len(l.undo)-1]
+	l.info = last.prevInfo
+
+	return nil
+}
+
+// hash commits to the accounts sorted by address: Address | Balance u64 | Nonce u64.
+// Must be called with l.mtx held.
+func (l *Ledger) hash() crypto.HashValue {
+	addrs := make([]crypto.Address, 0, len(l.accounts))
+	for addr := range l.accounts {
+		addrs = append(addrs, addr)
+	}
+	sort.Slice(addrs, func(i, j int) bool { return bytes.Compare(addrs[i][:], addrs[j][:]) < 0 })
+
+	const entryLen = crypto.AddressLen + 16
+
+	buf := make([]byte, len(addrs)*entryLen)
+	for i, addr := range addrs {
+		a, entry := l.accounts[addr], buf[i*entryLen:]
+		copy(entry, addr[:])
+		binary.BigEndian.PutUint64(entry[crypto.AddressLen:], a.Balance)
+		binary.BigEndian.PutUint64(entry[crypto.AddressLen+8:], a.Nonce)
+	}
+
+	hash, _ := crypto.Hash256(buf)
+
+	return hash
+}
+
+// Validator rejects malformed ledger transactions. For the pending
+// transactions it also rejects the transfers that overdraw or reuse a nonce
+// given the committed state and the transfers preceding them. The transfers
+// of a block are checked against the state once it is executed.
+// It should be registered with PayloadType.
+func (l *Ledger) Validator() core.TxValidator {
+	return core.TxValidatorFunc(func(ctx core.ChainContext, tx core.Transaction, payload []byte) error {
+		o, err := decodePayload(payload)
+		if err != nil {
+			return err
+		}
+
+		if o.kind == KindAllocation {
+			return ErrAllocationAfterGenesis
+		}
+
+		if o.amount == 0 {
+			return ErrZeroAmount
+		}
+
+		sender, err := Sender(tx)
+		if err != nil {
+			return err
+		}
+
+		if !ctx.Pending {
+			return nil
+		}
+
+		from := l.Account(sender)
+		preceding := ctx.Preceding.Index(PayloadType, func() core.TxIndex { return transfersIndex{} }).(transfersIndex)
+		for _, po := range preceding[sender] {
+			// The preceding transfers that fail wouldn't change the account
+			_ = from.transfer(po)
+		}
+
+		return from.transfer(o)
+	})
+}
+
+// transfersIndex keeps the transfers of each sender in order.
+type transfersIndex map[crypto.Address][]op
+
+func (t transfersIndex) Add(tx core.Transaction) {
+	if o, ok, err := decodeTx(tx); ok && err == nil && o.kind == KindTransfer {
+		if sender, err := Sender(tx); err == nil {
+			t[sender] = append(t[sender], o)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package ledger
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+	"testing"
+
+	"github.com/meddion/pkg/core"
+	"github.com/meddion/pkg/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func signTx(t *testing.T, signer crypto.SignerECDSA, data core.TxData) core.Transaction {
+	tx, err := core.NewTx(signer, PayloadType, data)
+	require.NoError(t, err, "on signing a transaction")
+
+	return tx
+}
+
+func newSigner(t *testing.T) crypto.SignerECDSA {
+	signer, err := crypto.NewSignerECDSA()
+	require.NoError(t, err, "on creating a signer")
+
+	return signer
+}
+
+// genesisParams returns the params of a regtest-like network whose genesis block allocates the amounts.
+func genesisParams(t *testing.T, allocations ...Allocation) *core.ChainParams {
+	txs := ""
+	for i, a := range allocations {
+		tx, err := core.NewUnsignedTx(PayloadType, a.TxData())
+		require.NoError(t, err)
+
+		b, err := tx.Bytes()
+		require.NoError(t, err)
+
+		if i > 0 {
+			txs += ", "
+		}
+		txs += `"` + hex.EncodeToString(b) + `"`
+	}
+
+	params, err := core.ParseChainParams([]byte(fmt.Sprintf(`{
+		"network": "ledgertest",
+		"min_difficulty": 1,
+		"retarget_window": 0,
+		"block_versions": [3],
+		"mine_blocks_on_demand": true,
+		"genesis": {"version": 3, "timestamp": 1650000000, "bits": %d, "transactions": [%s]}
+	}`, core.Difficulty(1).Bits(), txs)))
+	require.NoError(t, err, "on parsing the chain params")
+
+	return params
+}
+
+func TestLedger(t *testing.T) {
+	alice, bob := newSigner(t), newSigner(t)
+	logger := log.New(io.Discard, "", 0)
+
+	db, err := core.NewBlockRepo(filepath.Join(t.TempDir(), "blocks.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	blkchain, err := core.NewBlockchain(db, genesisParams(t, Allocation{To: alice.Address(), Amount: 100}), logger)
+	require.NoError(t, err)
+
+	l := New()
+	require.NoError(t, blkchain.RegisterTxValidator(PayloadType, l.Validator()))
+	require.NoError(t, blkchain.SetApplication(l))
+	assert.Equal(t, Account{Balance: 100}, l.Account(alice.Address()), "the genesis allocation should be applied")
+
+	mempool := core.NewMempool(core.DefaultMempoolConfig, logger)
+	mempool.Follow(blkchain)
+	rcv := core.NewReceiverRPC(blkchain, mempool, core.NewPeerPool(logger, 0), core.Addr{}, logger)
+
+	submit := func(tx core.Transaction) core.TransactionResp {
+		var resp core.TransactionResp
+		require.NoError(t, rcv.HandleTransaction(core.TransactionReq{Transaction: tx}, &resp))
+		return resp
+	}
+
+	transfer := func(signer crypto.SignerECDSA, amount, nonce uint64) core.Transaction {
+		return signTx(t, signer, Transfer{To: bob.Address(), Amount: amount, Nonce: nonce}.TxData())
+	}
+
+	t.Run("mempool admission", func(t *testing.T) {
+		for _, c := range []struct {
+			tx  core.Transaction
+			err error
+		}{
+			{transfer(alice, 101, 1), ErrInsufficientFunds},
+			{transfer(alice, 60, 2), ErrNonceGap},
+			{transfer(alice, 0, 1), ErrZeroAmount},
+			{transfer(bob, 1, 1), ErrInsufficientFunds},
+			{signTx(t, alice, Allocation{To: alice.Address(), Amount: 1}.TxData()), ErrAllocationAfterGenesis},
+		} {
+			resp := submit(c.tx)
+			assert.False(t, resp.Status)
+			assert.Contains(t, resp.Msg, c.err.Error())
+		}
+
+		assert.True(t, submit(transfer(alice, 60, 1)).Status)
+		assert.True(t, submit(transfer(alice, 30, 2)).Status, "the pending transfers should be taken into account")
+
+		resp := submit(transfer(alice, 20, 3))
+		assert.False(t, resp.Status, "the pending transfers should be taken into account")
+		assert.Contains(t, resp.Msg, ErrInsufficientFunds.Error())
+	})
+
+	miner := core.NewMiner(blkchain, mempool, nil, 1, logger)
+	block, err := miner.MineBlock(context.Background())
+	require.NoError(t, err)
+	assert.Len(t, block.Body, 2)
+
+	assert.Equal(t, Account{Balance: 10, Nonce: 2}, l.Account(alice.Address()))
+	assert.Equal(t, Account{Balance: 90}, l.Account(bob.Address()))
+
+	resp := submit(transfer(alice, 5, 2))
+	assert.False(t, resp.Status)
+	assert.Contains(t, resp.Msg, ErrNonceReused.Error())
+
+	t.Run("block validation", func(t *testing.T) {
+		newBlock := func(body core.Body) core.Block {
+			template, err := miner.NewBlockTemplate()
+			require.NoError(t, err)
+
+			template.Body = body
+			template.MerkleRoot, err = crypto.GenMerkleRootV2(body)
+			require.NoError(t, err)
+			template.Nonce, err = template.Header.GenNonce()
+			require.NoError(t, err)
+
+			return template
+		}
+
+		assert.ErrorIs(t, blkchain.ProcessBlock(newBlock(core.Body{transfer(alice, 5, 3), transfer(alice, 6, 4)})), ErrInsufficientFunds)
+		assert.ErrorIs(t, blkchain.ProcessBlock(newBlock(core.Body{transfer(alice, 5, 2)})), ErrNonceReused)
+
+		_, height := blkchain.BestBlock()
+		assert.Equal(t, 1, height)
+		assert.Equal(t, Account{Balance: 10, Nonce: 2}, l.Account(alice.Address()), "rejected blocks shouldn't change the state")
+
+		require.NoError(t, blkchain.ProcessBlock(newBlock(core.Body{transfer(alice, 5, 3), transfer(bob, 90, 1)})))
+		assert.Equal(t, Account{Balance: 5, Nonce: 3}, l.Account(alice.Address()))
+		assert.Equal(t, Account{Balance: 95, Nonce: 1}, l.Account(bob.Address()), "a transfer to self keeps the balance")
+	})
+}
+
+func TestRollback(t *testing.T) {
+	alice, bob := newSigner(t), newSigner(t)
+
+	l := New()
+	execute := func(height int, txs ...core.Transaction) error {
+		info := core.BlockInfo{Height: height, Hash: crypto.HashValue{byte(height)}}
+		require.NoError(t, l.BeginBlock(info))
+		for _, tx := range txs {
+			l.DeliverTx(tx)
+		}
+		if err := l.EndBlock(info); err != nil {
+			return err
+		}
+		_, err := l.Commit()
+		return err
+	}
+
+	genesis := Allocation{To: alice.Address(), Amount: 50}.TxData()
+	require.NoError(t, execute(0, core.Transaction{Type: PayloadType, Data: genesis}))
+	before := l.Info()
+
+	require.NoError(t, execute(1, signTx(t, alice, Transfer{To: bob.Address(), Amount: 20, Nonce: 1}.TxData())))
+	assert.Equal(t, Account{Balance: 20}, l.Account(bob.Address()))
+	assert.NotEqual(t, before.AppHash, l.Info().AppHash)
+
+	require.NoError(t, l.Rollback(core.BlockInfo{Hash: crypto.HashValue{1}}))
+	assert.Equal(t, before, l.Info())
+	assert.Equal(t, Account{Balance: 50}, l.Account(alice.Address()))
+	assert.Equal(t, Account{}, l.Account(bob.Address()))
+
+	assert.ErrorIs(t, execute(1, core.Transaction{Type: PayloadType, Data: genesis}), ErrAllocationAfterGenesis)
+	assert.ErrorIs(t, execute(1, core.Transaction{Type: PayloadType, Data: Transfer{To: bob.Address(), Amount: 1, Nonce: 1}.TxData()}), ErrUnknownSender)
+	assert.Equal(t, before, l.Info(), "failed blocks shouldn't be committed")
+}
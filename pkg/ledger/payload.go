@@ -0,0 +1,118 @@
+package ledger
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/meddion/pkg/core"
+	"github.com/meddion/pkg/crypto"
+)
+
+// PayloadType of the ledger transactions
+const PayloadType core.PayloadType = 2
+
+// Kinds of the ledger payloads
+const (
+	KindTransfer uint8 = iota + 1
+	// Allocations credit the accounts in the genesis block only
+	KindAllocation
+)
+
+// A payload is Kind u8 | To[20] | Amount u64 followed by Nonce u64 for
+// transfers, all big-endian.
+const (
+	_allocationLen = 1 + crypto.AddressLen + 8
+	_transferLen   = _allocationLen + 8
+)
+
+var ErrInvalidPayload = errors.New("invalid ledger payload")
+
+// Transfer moves Amount from the account of the transaction signer to To.
+// Nonce must follow the nonce of the last transfer of the signer.
+type Transfer struct {
+	To     crypto.Address
+	Amount uint64
+	Nonce  uint64
+}
+
+// Allocation credits To with Amount in the genesis block
+type Allocation struct {
+	To     crypto.Address
+	Amount uint64
+}
+
+// TxData encodes the transfer, the transactions carry it with PayloadType.
+func (t Transfer) TxData() core.TxData {
+	buf := make([]byte, _transferLen)
+	putHead(buf, KindTransfer, t.To, t.Amount)
+	binary.BigEndian.PutUint64(buf[_allocationLen:], t.Nonce)
+
+	return buf
+}
+
+// TxData encodes the allocation, the transactions carry it with PayloadType.
+func (a Allocation) TxData() core.TxData {
+	buf := make([]byte, _allocationLen)
+	putHead(buf, KindAllocation, a.To, a.Amount)
+
+	return buf
+}
+
+func putHead(buf []byte, kind uint8, to crypto.Address, amount uint64) {
+	buf[0] = kind
+	copy(buf[1:], to[:])
+	binary.BigEndian.PutUint64(buf[1+crypto.AddressLen:], amount)
+}
+
+// op is a decoded ledger payload
+type op struct {
+	kind   uint8
+	to     crypto.Address
+	amount uint64
+	nonce  uint64
+}
+
+func decodePayload(payload []byte) (op, error) {
+	if len(payload) == 0 {
+		return op{}, fmt.Errorf("%w: empty", ErrInvalidPayload)
+	}
+
+	o := op{kind: payload[0]}
+	switch {
+	case o.kind == KindTransfer && len(payload) == _transferLen:
+		o.nonce = binary.BigEndian.Uint64(payload[_allocationLen:])
+	case o.kind == KindAllocation && len(payload) == _allocationLen:
+	default:
+		return op{}, fmt.Errorf("%w: kind %d of %d bytes", ErrInvalidPayload, o.kind, len(payload))
+	}
+
+	copy(o.to[:], payload[1:])
+	o.amount = binary.BigEndian.Uint64(payload[1+crypto.AddressLen:])
+
+	return o, nil
+}
+
+// decodeTx returns false for the transactions of other payload types.
+func decodeTx(tx core.Transaction) (op, bool, error) {
+	if tx.Type != PayloadType {
+		return op{}, false, nil
+	}
+
+	o, err := decodePayload(tx.Data)
+	return o, true, err
+}
+
+type addresser interface {
+	Address() (crypto.Address, error)
+}
+
+// Sender returns the address of the key the transaction is signed with.
+func Sender(tx core.Transaction) (crypto.Address, error) {
+	a, ok := tx.Sig.(addresser)
+	if !ok {
+		return crypto.Address{}, ErrUnknownSender
+	}
+
+	return a.Address()
+}